@@ -0,0 +1,221 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Format int
+
+const (
+	// One JSON object per line
+	FormatJSON Format = iota
+	// NCSA Common Log Format
+	FormatCommon
+	// Squid native access.log format
+	FormatSquid
+)
+
+var formatNames = map[string]Format{
+	"json":   FormatJSON,
+	"common": FormatCommon,
+	"squid":  FormatSquid,
+}
+
+// ParseFormat parses the name of a format, JSON being the default.
+func ParseFormat(s string) (Format, error) {
+	if s == "" {
+		return FormatJSON, nil
+	}
+	if f, ok := formatNames[strings.ToLower(s)]; ok {
+		return f, nil
+	}
+	return 0, fmt.Errorf("unknown access log format: %s", s)
+}
+
+// Entry is the record of a single request or tunnel.
+type Entry struct {
+	// Time the request was received
+	Time   time.Time
+	Client string
+	// Authenticated user, empty if anonymous
+	User string
+	// Protocol spoken by the client, such as HTTP/1.1 or SOCKS5
+	Protocol string
+	Method   string
+	// Absolute URL of forwarded requests, the address of tunnels
+	Target string
+	// Status code of HTTP responses, the reply code for SOCKS, empty if the
+	// connection was closed without any
+	Status string
+	// Bytes received from and sent to the client
+	BytesIn  int64
+	BytesOut int64
+	Duration time.Duration
+	// Address actually connected to, empty if none was
+	Upstream string
+	// Whether the upstream is the parent proxy rather than the destination
+	Parent bool
+}
+
+type jsonEntry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	User     string    `json:"user,omitempty"`
+	Protocol string    `json:"protocol"`
+	Method   string    `json:"method"`
+	Target   string    `json:"target"`
+	Status   string    `json:"status,omitempty"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+	Duration float64   `json:"duration"`
+	Upstream string    `json:"upstream,omitempty"`
+	Parent   bool      `json:"parent,omitempty"`
+}
+
+type Config struct {
+	// File records are appended to
+	File   string
+	Format Format
+}
+
+// Logger appends records to the access log file.
+type Logger struct {
+	file   string
+	format Format
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+func New(cfg Config) (*Logger, error) {
+	l := &Logger{
+		file:   cfg.File,
+		format: cfg.Format,
+	}
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Log writes the record as a single line. A nil logger discards it.
+func (l *Logger) Log(e Entry) error {
+	if l == nil {
+		return nil
+	}
+	b, err := l.formatEntry(e)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.f.Write(b)
+	return err
+}
+
+// Reopen closes the file and opens it again, letting records go to a fresh
+// file once the current one has been rotated.
+func (l *Logger) Reopen() error {
+	f, err := os.OpenFile(l.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	old := l.f
+	l.f = f
+	l.mu.Unlock()
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+func (l *Logger) formatEntry(e Entry) ([]byte, error) {
+	switch l.format {
+	case FormatCommon:
+		return []byte(formatCommon(e)), nil
+	case FormatSquid:
+		return []byte(formatSquid(e)), nil
+	}
+	b, err := json.Marshal(jsonEntry{
+		Time:     e.Time,
+		Client:   e.Client,
+		User:     e.User,
+		Protocol: e.Protocol,
+		Method:   e.Method,
+		Target:   e.Target,
+		Status:   e.Status,
+		BytesIn:  e.BytesIn,
+		BytesOut: e.BytesOut,
+		Duration: e.Duration.Seconds(),
+		Upstream: e.Upstream,
+		Parent:   e.Parent,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// formatCommon writes host, ident, user, time, request line, status and
+// bytes sent to the client, missing fields being dashes.
+func formatCommon(e Entry) string {
+	bytes := "-"
+	if e.BytesOut > 0 {
+		bytes = strconv.FormatInt(e.BytesOut, 10)
+	}
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %s %s\n",
+		hostOf(e.Client), dash(e.User), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, e.Target, e.Protocol, dash(e.Status), bytes)
+}
+
+// formatSquid writes time, elapsed milliseconds, client, action/status,
+// bytes, method, URL, user, hierarchy/peer and content type.
+func formatSquid(e Entry) string {
+	action := "TCP_MISS"
+	if e.Method == "CONNECT" {
+		action = "TCP_TUNNEL"
+	}
+	status := e.Status
+	if status == "" {
+		status = "000"
+	}
+	hierarchy := "HIER_NONE/-"
+	if e.Upstream != "" && e.Parent {
+		hierarchy = "FIRST_UP_PARENT/" + hostOf(e.Upstream)
+	} else if e.Upstream != "" {
+		hierarchy = "HIER_DIRECT/" + hostOf(e.Upstream)
+	}
+	ms := e.Time.UnixNano() / int64(time.Millisecond)
+	return fmt.Sprintf("%d.%03d %6d %s %s/%s %d %s %s %s %s -\n",
+		ms/1000, ms%1000, e.Duration.Milliseconds(), hostOf(e.Client), action, status,
+		e.BytesOut, e.Method, e.Target, dash(e.User), hierarchy)
+}
+
+// hostOf strips the port from an address.
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return dash(addr)
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
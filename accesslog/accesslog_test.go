@@ -0,0 +1,121 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testEntry = Entry{
+	Time:     time.Date(2020, time.October, 10, 13, 55, 36, 250e6, time.UTC),
+	Client:   "192.0.2.1:50000",
+	User:     "alice",
+	Protocol: "HTTP/1.1",
+	Method:   "GET",
+	Target:   "http://example.com/",
+	Status:   "200",
+	BytesIn:  10,
+	BytesOut: 2326,
+	Duration: 1500 * time.Millisecond,
+	Upstream: "93.184.216.34:80",
+}
+
+func TestParseFormat(t *testing.T) {
+	require := require.New(t)
+	for s, expected := range map[string]Format{"": FormatJSON, "JSON": FormatJSON, "common": FormatCommon, "squid": FormatSquid} {
+		f, err := ParseFormat(s)
+		require.NoError(err)
+		require.Equal(expected, f)
+	}
+	_, err := ParseFormat("combined")
+	require.Error(err)
+}
+
+func TestFormats(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "accesslog")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	tunnel := Entry{
+		Time:     testEntry.Time,
+		Client:   testEntry.Client,
+		Protocol: "SOCKS5",
+		Method:   "CONNECT",
+		Target:   "example.com:443",
+		Upstream: "198.51.100.1:3128",
+		Parent:   true,
+	}
+	for format, expected := range map[Format]string{
+		FormatCommon: `192.0.2.1 - alice [10/Oct/2020:13:55:36 +0000] "GET http://example.com/ HTTP/1.1" 200 2326` + "\n" +
+			`192.0.2.1 - - [10/Oct/2020:13:55:36 +0000] "CONNECT example.com:443 SOCKS5" - -` + "\n",
+		FormatSquid: `1602338136.250   1500 192.0.2.1 TCP_MISS/200 2326 GET http://example.com/ alice HIER_DIRECT/93.184.216.34 -` + "\n" +
+			`1602338136.250      0 192.0.2.1 TCP_TUNNEL/000 0 CONNECT example.com:443 - FIRST_UP_PARENT/198.51.100.1 -` + "\n",
+	} {
+		filename := filepath.Join(dir, "access.log")
+		l, err := New(Config{File: filename, Format: format})
+		require.NoError(err)
+		require.NoError(l.Log(testEntry))
+		require.NoError(l.Log(tunnel))
+		require.NoError(l.Close())
+		b, err := ioutil.ReadFile(filename)
+		require.NoError(err)
+		require.Equal(expected, string(b))
+		require.NoError(os.Remove(filename))
+	}
+}
+
+func TestJSON(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "accesslog")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "access.log")
+	l, err := New(Config{File: filename})
+	require.NoError(err)
+	require.NoError(l.Log(testEntry))
+	require.NoError(l.Close())
+
+	b, err := ioutil.ReadFile(filename)
+	require.NoError(err)
+	var v map[string]interface{}
+	require.NoError(json.Unmarshal(b, &v))
+	require.Equal("2020-10-10T13:55:36.25Z", v["time"])
+	require.Equal("alice", v["user"])
+	require.Equal("200", v["status"])
+	require.Equal(float64(10), v["bytes_in"])
+	require.Equal(float64(2326), v["bytes_out"])
+	require.Equal(1.5, v["duration"])
+	require.Equal("93.184.216.34:80", v["upstream"])
+}
+
+func TestReopen(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "accesslog")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "access.log")
+	l, err := New(Config{File: filename, Format: FormatCommon})
+	require.NoError(err)
+	defer l.Close()
+	require.NoError(l.Log(testEntry))
+
+	// Records keep going to the rotated file until reopened
+	rotated := filename + ".1"
+	require.NoError(os.Rename(filename, rotated))
+	require.NoError(l.Log(testEntry))
+	require.NoError(l.Reopen())
+	require.NoError(l.Log(testEntry))
+
+	b, err := ioutil.ReadFile(rotated)
+	require.NoError(err)
+	require.Len(b, 2*len(formatCommon(testEntry)))
+	b, err = ioutil.ReadFile(filename)
+	require.NoError(err)
+	require.Equal(formatCommon(testEntry), string(b))
+}
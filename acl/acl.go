@@ -0,0 +1,271 @@
+package acl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type Action int
+
+const (
+	Allow Action = iota
+	Deny
+)
+
+// Methods of requests made through protocols other than HTTP
+const (
+	MethodConnect = "CONNECT"
+	MethodBind    = "BIND"
+	MethodUDP     = "UDP"
+)
+
+func ParseAction(s string) (Action, error) {
+	switch strings.ToLower(s) {
+	case "", "allow":
+		return Allow, nil
+	case "deny":
+		return Deny, nil
+	}
+	return Allow, fmt.Errorf("unknown ACL action: %s", s)
+}
+
+func (a Action) String() string {
+	if a == Deny {
+		return "deny"
+	}
+	return "allow"
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	From int
+	To   int
+}
+
+// ParsePorts parses ports given either alone or as "from-to" ranges.
+func ParsePorts(ports []string) ([]PortRange, error) {
+	result := make([]PortRange, len(ports))
+	for i, s := range ports {
+		from, to := s, s
+		if idx := strings.IndexByte(s, '-'); idx >= 0 {
+			from, to = s[:idx], s[idx+1:]
+		}
+		f, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port range: %s", s)
+		}
+		t, err := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+		if err != nil || t < f {
+			return nil, fmt.Errorf("invalid port range: %s", s)
+		}
+		result[i] = PortRange{From: int(f), To: int(t)}
+	}
+	return result, nil
+}
+
+// MatchPort reports whether the port falls in any of the ranges.
+func MatchPort(ranges []PortRange, port int) bool {
+	for _, r := range ranges {
+		if port >= r.From && port <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+// Rule matches requests on every criterion it sets, criteria left empty
+// matching any request.
+type Rule struct {
+	Name   string
+	Action Action
+	// Shell patterns matched against the destination host
+	Hosts []string
+	// Networks matched against the addresses the destination resolves to
+	Networks []*net.IPNet
+	Ports    []PortRange
+	Methods  []string
+	Users    []string
+	// Networks matched against the client address
+	Sources []*net.IPNet
+}
+
+// Request describes a destination a client asks to reach.
+type Request struct {
+	User   string
+	Method string
+	Host   string
+	Port   int
+	// Addresses of the destination when already known, looked up otherwise
+	IPs    []net.IP
+	Source net.IP
+}
+
+// Decision is the outcome of evaluating the rules against a request.
+type Decision struct {
+	Allowed bool
+	Reason  string
+}
+
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+type Config struct {
+	Rules []Rule
+	// Action taken when no rule matches
+	Default  Action
+	Resolver Resolver
+}
+
+// ACL evaluates its rules in order, the first matching rule deciding.
+type ACL struct {
+	rules    []Rule
+	fallback Action
+	resolver Resolver
+}
+
+func New(cfg Config) *ACL {
+	if cfg.Resolver == nil {
+		cfg.Resolver = net.DefaultResolver
+	}
+	return &ACL{
+		rules:    cfg.Rules,
+		fallback: cfg.Default,
+		resolver: cfg.Resolver,
+	}
+}
+
+// Check evaluates the rules against the request. Destinations whose addresses
+// cannot be looked up are denied once a rule matching networks is reached,
+// since whether it matches cannot be known.
+func (a *ACL) Check(ctx context.Context, req Request) Decision {
+	ips := req.IPs
+	resolved := ips != nil
+	var lookupErr error
+	for i := range a.rules {
+		r := &a.rules[i]
+		if !r.match(&req) {
+			continue
+		}
+		name := r.Name
+		if name == "" {
+			name = "#" + strconv.Itoa(i+1)
+		}
+		if len(r.Networks) > 0 {
+			if !resolved {
+				ips, lookupErr = a.lookup(ctx, req.Host)
+				resolved = true
+			}
+			if lookupErr != nil {
+				return Decision{
+					Allowed: false,
+					Reason:  fmt.Sprintf("deny on failed lookup for rule %s: %v", name, lookupErr),
+				}
+			}
+			if !matchAnyNetwork(r.Networks, ips) {
+				continue
+			}
+		}
+		return Decision{
+			Allowed: r.Action == Allow,
+			Reason:  fmt.Sprintf("%s by rule %s", r.Action, name),
+		}
+	}
+	return Decision{
+		Allowed: a.fallback == Allow,
+		Reason:  fmt.Sprintf("%s by default", a.fallback),
+	}
+}
+
+func (a *ACL) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	addrs, err := a.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) <= 0 {
+		return nil, errors.New("no addresses found")
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+// match checks the request against every criterion of the rule but the
+// networks of the destination.
+func (r *Rule) match(req *Request) bool {
+	if len(r.Ports) > 0 && !MatchPort(r.Ports, req.Port) {
+		return false
+	}
+	if len(r.Methods) > 0 && !matchFold(r.Methods, req.Method) {
+		return false
+	}
+	if len(r.Users) > 0 && !matchString(r.Users, req.User) {
+		return false
+	}
+	if len(r.Sources) > 0 && !matchNetworks(r.Sources, req.Source) {
+		return false
+	}
+	if len(r.Hosts) > 0 && !matchHost(r.Hosts, req.Host) {
+		return false
+	}
+	return true
+}
+
+func matchAnyNetwork(networks []*net.IPNet, ips []net.IP) bool {
+	for _, ip := range ips {
+		if matchNetworks(networks, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHost(patterns []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchNetworks(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range networks {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchString(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func matchFold(a []string, s string) bool {
+	for _, v := range a {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
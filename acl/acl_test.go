@@ -0,0 +1,96 @@
+package acl
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type staticResolver map[string][]net.IPAddr
+
+func (r staticResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	if addrs, ok := r[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	_, ipnet, err := net.ParseCIDR(s)
+	require.NoError(t, err)
+	return ipnet
+}
+
+func TestACL(t *testing.T) {
+	require := require.New(t)
+	ports, err := ParsePorts([]string{"80", "8000-8080"})
+	require.NoError(err)
+	a := New(Config{
+		Rules: []Rule{
+			{Name: "admins", Action: Allow, Users: []string{"admin"}},
+			{Name: "internal", Action: Deny, Networks: []*net.IPNet{mustCIDR(t, "10.0.0.0/8")}},
+			{Action: Deny, Hosts: []string{"*.blocked.com"}},
+			{Action: Deny, Methods: []string{"delete"}},
+			{Action: Allow, Ports: ports, Sources: []*net.IPNet{mustCIDR(t, "192.0.2.0/24")}},
+			{Action: Allow, Ports: []PortRange{{443, 443}}},
+		},
+		Default: Deny,
+		Resolver: staticResolver{
+			"intranet.example.com": {{IP: net.ParseIP("10.1.2.3")}},
+			"example.com":          {{IP: net.ParseIP("93.184.216.34")}},
+			"www.Blocked.com":      {{IP: net.ParseIP("192.0.2.10")}},
+		},
+	})
+
+	for _, tc := range []struct {
+		req     Request
+		allowed bool
+		reason  string
+	}{
+		{Request{User: "admin", Host: "intranet.example.com", Port: 22}, true, "allow by rule admins"},
+		{Request{Host: "intranet.example.com", Port: 443}, false, "deny by rule internal"},
+		{Request{Host: "10.0.0.1", Port: 443}, false, "deny by rule internal"},
+		{Request{Host: "www.Blocked.com", Port: 443}, false, "deny by rule #3"},
+		{Request{Host: "example.com", Port: 80, Method: "DELETE"}, false, "deny by rule #4"},
+		{Request{Host: "example.com", Port: 8080, Source: net.ParseIP("192.0.2.1")}, true, "allow by rule #5"},
+		{Request{Host: "example.com", Port: 8080, Source: net.ParseIP("198.51.100.1")}, false, "deny by default"},
+		{Request{Host: "example.com", Port: 443}, true, "allow by rule #6"},
+		// Whether the destination is internal cannot be told
+		{Request{Host: "unknown.example.com", Port: 443}, false, "deny on failed lookup for rule internal: lookup unknown.example.com: no such host"},
+		// Known addresses take precedence over resolution
+		{Request{Host: "example.com", Port: 443, IPs: []net.IP{net.ParseIP("10.0.0.1")}}, false, "deny by rule internal"},
+	} {
+		d := a.Check(context.Background(), tc.req)
+		require.Equal(tc.allowed, d.Allowed, tc.req)
+		require.Equal(tc.reason, d.Reason, tc.req)
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	require := require.New(t)
+	ranges, err := ParsePorts([]string{"443", "1024-65535"})
+	require.NoError(err)
+	require.Equal([]PortRange{{443, 443}, {1024, 65535}}, ranges)
+	require.True(MatchPort(ranges, 443))
+	require.True(MatchPort(ranges, 2000))
+	require.False(MatchPort(ranges, 80))
+
+	for _, s := range []string{"http", "80-", "90-80", "65536"} {
+		_, err := ParsePorts([]string{s})
+		require.Error(err, s)
+	}
+}
+
+func TestParseAction(t *testing.T) {
+	require := require.New(t)
+	action, err := ParseAction("DENY")
+	require.NoError(err)
+	require.Equal(Deny, action)
+	action, err = ParseAction("")
+	require.NoError(err)
+	require.Equal(Allow, action)
+	_, err = ParseAction("drop")
+	require.Error(err)
+}
@@ -0,0 +1,113 @@
+package acl
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// DefaultBlockedNetworks covers the loopback, private, link-local and other
+// special purpose ranges no client should reach through the proxy.
+var DefaultBlockedNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// BlockedError is returned when dialing an address in a blocked range.
+type BlockedError struct {
+	IP net.IP
+}
+
+func (e *BlockedError) Error() string {
+	return fmt.Sprintf("destination address %s is blocked", e.IP)
+}
+
+type GuardConfig struct {
+	// DefaultBlockedNetworks are blocked when nil
+	Blocked []*net.IPNet
+	// Exceptions to the blocked ranges
+	Allowed []*net.IPNet
+}
+
+// Guard rejects connections to blocked addresses. It checks the address
+// actually connected to rather than the one a name resolved to beforehand,
+// so DNS rebinding cannot get around it.
+type Guard struct {
+	blocked []*net.IPNet
+	allowed []*net.IPNet
+}
+
+func NewGuard(cfg GuardConfig) *Guard {
+	if cfg.Blocked == nil {
+		for _, s := range DefaultBlockedNetworks {
+			_, ipnet, err := net.ParseCIDR(s)
+			if err != nil {
+				panic(err)
+			}
+			cfg.Blocked = append(cfg.Blocked, ipnet)
+		}
+	}
+	return &Guard{
+		blocked: cfg.Blocked,
+		allowed: cfg.Allowed,
+	}
+}
+
+func (g *Guard) Check(ip net.IP) error {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	if matchNetworks(g.allowed, ip) || !matchNetworks(g.blocked, ip) {
+		return nil
+	}
+	return &BlockedError{IP: ip}
+}
+
+// Control checks the address about to be connected to, suitable for use as
+// net.Dialer.Control.
+func (g *Guard) Control(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("unexpected dial address: %s", address)
+	}
+	return g.Check(ip)
+}
+
+// Dialer returns a copy of the dialer checking every address it connects to,
+// in addition to any control function it already had.
+func (g *Guard) Dialer(d *net.Dialer) *net.Dialer {
+	gd := new(net.Dialer)
+	if d != nil {
+		*gd = *d
+	}
+	control := gd.Control
+	gd.Control = func(network, address string, c syscall.RawConn) error {
+		if err := g.Control(network, address, c); err != nil {
+			return err
+		}
+		if control != nil {
+			return control(network, address, c)
+		}
+		return nil
+	}
+	return gd
+}
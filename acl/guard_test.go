@@ -0,0 +1,63 @@
+package acl
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGuard(t *testing.T) {
+	require := require.New(t)
+	g := NewGuard(GuardConfig{
+		Allowed: []*net.IPNet{mustCIDR(t, "10.1.0.0/16")},
+	})
+	for _, tc := range []struct {
+		ip      string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"10.0.0.1", true},
+		{"169.254.169.254", true},
+		{"192.168.1.1", true},
+		{"::1", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		// IPv4-mapped addresses are checked as IPv4
+		{"::ffff:127.0.0.1", true},
+		{"10.1.2.3", false},
+		{"93.184.216.34", false},
+		{"2606:2800:220:1::", false},
+	} {
+		err := g.Check(net.ParseIP(tc.ip))
+		require.Equal(tc.blocked, err != nil, tc.ip)
+	}
+}
+
+func TestGuardDialer(t *testing.T) {
+	require := require.New(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = c.Close()
+		}
+	}()
+
+	d := NewGuard(GuardConfig{}).Dialer(nil)
+	_, err = d.Dial("tcp", l.Addr().String())
+	var be *BlockedError
+	require.True(errors.As(err, &be), err)
+	require.True(be.IP.Equal(net.ParseIP("127.0.0.1")))
+
+	d = NewGuard(GuardConfig{Allowed: []*net.IPNet{mustCIDR(t, "127.0.0.1/32")}}).Dialer(nil)
+	c, err := d.Dial("tcp", l.Addr().String())
+	require.NoError(err)
+	require.NoError(c.Close())
+}
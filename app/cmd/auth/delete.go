@@ -13,10 +13,11 @@ func newDeleteCmd() *cobra.Command {
 
 func runDeleteCmd(cmd *cobra.Command, args []string) error {
 	filename, username := args[0], args[1]
-	creds, err := readCredentials(filename)
+	creds, meta, err := readCredentials(filename)
 	if err != nil {
 		return err
 	}
 	delete(creds, username)
-	return writeCredentials(filename, creds)
+	delete(meta, username)
+	return writeCredentials(filename, creds, meta)
 }
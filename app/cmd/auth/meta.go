@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+func newMetaCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "meta <filename> <username> [key=value...]",
+		Short: "Show or update user metadata in the passwords file",
+		Long:  "Show or update user metadata in the passwords file. Keys given an empty value are removed.",
+		Args:  cobra.MinimumNArgs(2),
+		RunE:  runMetaCmd,
+	}
+}
+
+func runMetaCmd(cmd *cobra.Command, args []string) error {
+	filename, username, pairs := args[0], args[1], args[2:]
+	creds, meta, err := readCredentials(filename)
+	if err != nil {
+		return err
+	}
+	if _, ok := creds[username]; !ok {
+		return fmt.Errorf("user not found: %s", username)
+	}
+	if len(pairs) <= 0 {
+		keys := make([]string, 0, len(meta[username]))
+		for k := range meta[username] {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			cmd.Printf("%s=%s\n", k, meta[username][k])
+		}
+		return nil
+	}
+
+	values := meta[username]
+	if values == nil {
+		values = make(map[string]string)
+		meta[username] = values
+	}
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) < 2 || kv[0] == "" || strings.ContainsAny(pair, ",:\n") {
+			return fmt.Errorf("invalid metadata: %s", pair)
+		}
+		if kv[1] == "" {
+			delete(values, kv[0])
+		} else {
+			values[kv[0]] = kv[1]
+		}
+	}
+	return writeCredentials(filename, creds, meta)
+}
@@ -15,24 +15,25 @@ func NewCmd() *cobra.Command {
 	}
 	cmd.AddCommand(newSetCmd())
 	cmd.AddCommand(newDeleteCmd())
+	cmd.AddCommand(newMetaCmd())
 	return cmd
 }
 
-func readCredentials(filename string) (auth.Credentials, error) {
+func readCredentials(filename string) (auth.Credentials, auth.Metadata, error) {
 	if filename == "" || filename == "-" {
-		return make(auth.Credentials), nil
+		return make(auth.Credentials), make(auth.Metadata), nil
 	}
 	f, err := os.Open(filename)
 	if os.IsNotExist(err) {
-		return make(auth.Credentials), nil
+		return make(auth.Credentials), make(auth.Metadata), nil
 	} else if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer f.Close()
-	return auth.ReadCredentials(f)
+	return auth.ReadCredentialsMetadata(f)
 }
 
-func writeCredentials(filename string, credentials auth.Credentials) error {
+func writeCredentials(filename string, credentials auth.Credentials, metadata auth.Metadata) error {
 	var w io.Writer = os.Stdout
 	if filename != "" && filename != "-" {
 		f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
@@ -42,5 +43,5 @@ func writeCredentials(filename string, credentials auth.Credentials) error {
 		defer f.Close()
 		w = f
 	}
-	return auth.WriteCredentials(w, credentials)
+	return auth.WriteCredentialsMetadata(w, credentials, metadata)
 }
@@ -29,10 +29,10 @@ func runSetCmd(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
-	creds, err := readCredentials(filename)
+	creds, meta, err := readCredentials(filename)
 	if err != nil {
 		return err
 	}
 	creds[username] = pw
-	return writeCredentials(filename, creds)
+	return writeCredentials(filename, creds, meta)
 }
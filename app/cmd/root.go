@@ -16,6 +16,7 @@ func NewCmd() *cobra.Command {
 		Run:   runServeCmd,
 	}
 	cmd.AddCommand(auth.NewCmd())
+	cmd.AddCommand(newUsageCmd())
 	return cmd
 }
 
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Frizz925/gilgamesh/app"
+	"github.com/Frizz925/gilgamesh/usage"
+	"github.com/spf13/cobra"
+)
+
+func newUsageCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "usage",
+		Short: "Report the bytes relayed for each user and destination",
+		Long: "Report the bytes relayed for each user and destination within a time window. " +
+			"Usage is recorded by the hour, so the window is widened to whole hours.",
+		Args: cobra.NoArgs,
+		RunE: runUsageCmd,
+	}
+	flags := cmd.Flags()
+	flags.String("file", "", "usage file, the one in the config if not given")
+	flags.Duration("since", 24*time.Hour, "report the usage of this long ago until now")
+	flags.String("from", "", "start of the window as RFC 3339, overriding --since")
+	flags.String("to", "", "end of the window as RFC 3339, now if not given")
+	flags.Bool("by-user", false, "add up the destinations of each user")
+	return cmd
+}
+
+func runUsageCmd(cmd *cobra.Command, args []string) error {
+	flags := cmd.Flags()
+	filename, _ := flags.GetString("file")
+	if filename == "" {
+		cfg, err := app.LoadConfig()
+		if err != nil {
+			return fmt.Errorf("config load: %+v", err)
+		}
+		if filename = cfg.Proxy.Usage.File; filename == "" {
+			return errors.New("usage file not configured")
+		}
+	}
+
+	to := time.Now()
+	if v, _ := flags.GetString("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return err
+		}
+		to = t
+	}
+	since, _ := flags.GetDuration("since")
+	from := to.Add(-since)
+	if v, _ := flags.GetString("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return err
+		}
+		from = t
+	}
+
+	records, err := usage.NewStore(filename).Read(from, to)
+	if err != nil {
+		return err
+	}
+	byUser, _ := flags.GetBool("by-user")
+	tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 8, 2, ' ', 0)
+	if byUser {
+		fmt.Fprintln(tw, "USER\tUPLOAD\tDOWNLOAD")
+	} else {
+		fmt.Fprintln(tw, "USER\tDESTINATION\tUPLOAD\tDOWNLOAD")
+	}
+	for _, r := range usage.Sum(records, byUser) {
+		user := r.User
+		if user == "" {
+			user = "-"
+		}
+		if byUser {
+			fmt.Fprintf(tw, "%s\t%d\t%d\n", user, r.Upload, r.Download)
+		} else {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\n", user, r.Destination, r.Upload, r.Download)
+		}
+	}
+	return tw.Flush()
+}
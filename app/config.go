@@ -1,16 +1,34 @@
 package app
 
-import "github.com/spf13/viper"
+import (
+	"time"
+
+	"github.com/spf13/viper"
+)
 
 type Config struct {
 	Proxy Proxy `mapstructure:"proxy"`
 }
 
 type Proxy struct {
-	PasswordsFile string      `mapstructure:"passwords_file"`
-	TLS           ProxyTLS    `mapstructure:"tls"`
-	Server        ProxyServer `mapstructure:"server"`
-	Worker        ProxyWorker `mapstructure:"worker"`
+	PasswordsFile string         `mapstructure:"passwords_file"`
+	TLS           ProxyTLS       `mapstructure:"tls"`
+	Server        ProxyServer    `mapstructure:"server"`
+	Worker        ProxyWorker    `mapstructure:"worker"`
+	Upstream      ProxyUpstream  `mapstructure:"upstream"`
+	ACL           ProxyACL       `mapstructure:"acl"`
+	Guard         ProxyGuard     `mapstructure:"guard"`
+	Ports         ProxyPorts     `mapstructure:"ports"`
+	Users         []ProxyUser    `mapstructure:"users"`
+	DNS           ProxyDNS       `mapstructure:"dns"`
+	Hosts         []ProxyHost    `mapstructure:"hosts"`
+	Bandwidth     ProxyBandwidth `mapstructure:"bandwidth"`
+	Limits        ProxyLimits    `mapstructure:"limits"`
+	Usage         ProxyUsage     `mapstructure:"usage"`
+	Quota         ProxyQuota     `mapstructure:"quota"`
+	Metrics       ProxyMetrics   `mapstructure:"metrics"`
+	Manager       ProxyManager   `mapstructure:"manager"`
+	AccessLog     ProxyAccessLog `mapstructure:"access_log"`
 }
 
 type ProxyTLS struct {
@@ -18,15 +36,177 @@ type ProxyTLS struct {
 	CertificateKey string `mapstructure:"certificate_key"`
 }
 
+type ProxyUpstream struct {
+	URL                string              `mapstructure:"url"`
+	InsecureSkipVerify bool                `mapstructure:"insecure_skip_verify"`
+	ProxyProtocol      []ProxyProtocolRule `mapstructure:"proxy_protocol"`
+}
+
+// ProxyProtocolRule opts matching destinations into receiving a PROXY
+// protocol header with the client address.
+type ProxyProtocolRule struct {
+	Hosts    []string `mapstructure:"hosts"`
+	Networks []string `mapstructure:"networks"`
+	Ports    []int    `mapstructure:"ports"`
+	Version  int      `mapstructure:"version"`
+}
+
+// ProxyACL lists the rules destinations are checked against in order, the
+// default action applying when none matches.
+type ProxyACL struct {
+	Default string         `mapstructure:"default"`
+	Rules   []ProxyACLRule `mapstructure:"rules"`
+}
+
+type ProxyACLRule struct {
+	Name     string   `mapstructure:"name"`
+	Action   string   `mapstructure:"action"`
+	Hosts    []string `mapstructure:"hosts"`
+	Networks []string `mapstructure:"networks"`
+	Ports    []string `mapstructure:"ports"`
+	Methods  []string `mapstructure:"methods"`
+	Users    []string `mapstructure:"users"`
+	Sources  []string `mapstructure:"sources"`
+}
+
+// ProxyGuard blocks destinations whose address falls in the blocked networks,
+// loopback, private and link-local ones if none are given. Destinations
+// dialed through the upstream proxy are checked by the addresses their names
+// resolve to locally, which does not protect against DNS rebinding.
+type ProxyGuard struct {
+	Enabled bool     `mapstructure:"enabled"`
+	Blocked []string `mapstructure:"blocked"`
+	Allowed []string `mapstructure:"allowed"`
+}
+
+// ProxyPorts lists the destination ports tunnels and plain HTTP requests may
+// reach, given alone or as "from-to" ranges.
+type ProxyPorts struct {
+	Connect []string `mapstructure:"connect"`
+	HTTP    []string `mapstructure:"http"`
+}
+
+// ProxyUser holds settings overriding the global ones for a single user.
+type ProxyUser struct {
+	Name  string     `mapstructure:"name"`
+	Ports ProxyPorts `mapstructure:"ports"`
+}
+
+// ProxyDNS configures the caching resolver of the destinations dialed
+// directly. Servers are given as "1.1.1.1" or "tcp://8.8.8.8:53", the system
+// ones being used if none are given.
+type ProxyDNS struct {
+	Servers     []string       `mapstructure:"servers"`
+	Rules       []ProxyDNSRule `mapstructure:"rules"`
+	TTL         time.Duration  `mapstructure:"ttl"`
+	NegativeTTL time.Duration  `mapstructure:"negative_ttl"`
+	Timeout     time.Duration  `mapstructure:"timeout"`
+	CacheSize   int            `mapstructure:"cache_size"`
+}
+
+// ProxyDNSRule forwards the lookups of names within the domains to the
+// servers.
+type ProxyDNSRule struct {
+	Domains []string `mapstructure:"domains"`
+	Servers []string `mapstructure:"servers"`
+}
+
+// ProxyHost redirects a destination name, or name:port, to another address,
+// keeping the destination port when the address has none.
+type ProxyHost struct {
+	From string `mapstructure:"from"`
+	To   string `mapstructure:"to"`
+}
+
+// ProxyBandwidth holds the default upload and download rates of each user in
+// bytes per second, zero meaning unlimited. Users override them with the
+// upload_rate and download_rate keys of their credentials metadata.
+// Anonymous and transparent clients get the default rates for each client
+// address.
+type ProxyBandwidth struct {
+	Upload   int64 `mapstructure:"upload"`
+	Download int64 `mapstructure:"download"`
+}
+
+// ProxyLimits caps the concurrent connections and the requests per second of
+// each authenticated user and each client address, zero meaning unlimited.
+// Bursts default to one second worth of requests.
+type ProxyLimits struct {
+	MaxConnsPerUser  int     `mapstructure:"max_conns_per_user"`
+	MaxConnsPerIP    int     `mapstructure:"max_conns_per_ip"`
+	UserRequestRate  float64 `mapstructure:"user_request_rate"`
+	UserRequestBurst int     `mapstructure:"user_request_burst"`
+	IPRequestRate    float64 `mapstructure:"ip_request_rate"`
+	IPRequestBurst   int     `mapstructure:"ip_request_burst"`
+}
+
+// ProxyUsage enables accounting the bytes relayed for each user and
+// destination, flushed to the file every flush interval.
+type ProxyUsage struct {
+	File          string        `mapstructure:"file"`
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+}
+
+// ProxyQuota caps the bytes each user may relay per month, given as sizes
+// such as "50GiB". Users override the default with the quota key of their
+// credentials metadata. The usage is saved to the file every usage flush
+// interval.
+type ProxyQuota struct {
+	Default      string `mapstructure:"default"`
+	ResetDay     int    `mapstructure:"reset_day"`
+	CloseTunnels bool   `mapstructure:"close_tunnels"`
+	File         string `mapstructure:"file"`
+}
+
+// ProxyMetrics exposes Prometheus metrics over HTTP at /metrics of the port,
+// disabled if zero.
+type ProxyMetrics struct {
+	Port int `mapstructure:"port"`
+}
+
+// ProxyManager serves management commands such as TLS_RELOAD on the
+// address, disabled if empty. Commands are not authenticated, so the address
+// should only be reachable locally.
+type ProxyManager struct {
+	Address string `mapstructure:"address"`
+}
+
+// ProxyAccessLog records every request and tunnel to the file, disabled if
+// empty. Format is one of json, common or squid, json if empty. The file is
+// reopened on SIGHUP.
+type ProxyAccessLog struct {
+	File   string `mapstructure:"file"`
+	Format string `mapstructure:"format"`
+}
+
 type ProxyServer struct {
-	Ports    []int `mapstructure:"ports"`
-	TLSPorts []int `mapstructure:"tls_ports"`
+	Ports            []int `mapstructure:"ports"`
+	TLSPorts         []int `mapstructure:"tls_ports"`
+	SOCKSPorts       []int `mapstructure:"socks_ports"`
+	TransparentPorts []int `mapstructure:"transparent_ports"`
+	// Ports of any type expecting a PROXY protocol header from trusted proxies
+	ProxyProtocolPorts []int    `mapstructure:"proxy_protocol_ports"`
+	TrustedProxies     []string `mapstructure:"trusted_proxies"`
+	DisableHTTP2       bool     `mapstructure:"disable_http2"`
+	// Time connections are given to finish on SIGINT or SIGTERM
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"`
 }
 
 type ProxyWorker struct {
-	PoolCount   int `mapstructure:"pool_count"`
-	ReadBuffer  int `mapstructure:"read_buffer"`
-	WriteBuffer int `mapstructure:"write_buffer"`
+	PoolCount           int           `mapstructure:"pool_count"`
+	ReadBuffer          int           `mapstructure:"read_buffer"`
+	WriteBuffer         int           `mapstructure:"write_buffer"`
+	MaxIdleConns        int           `mapstructure:"max_idle_conns"`
+	MaxIdleConnsPerHost int           `mapstructure:"max_idle_conns_per_host"`
+	IdleConnTimeout     time.Duration `mapstructure:"idle_conn_timeout"`
+	IdleConnHealthCheck bool          `mapstructure:"idle_conn_health_check"`
+	UDPIdleTimeout      time.Duration `mapstructure:"udp_idle_timeout"`
+	SOCKS4UserIDAuth    bool          `mapstructure:"socks4_userid_auth"`
+	SniffTimeout        time.Duration `mapstructure:"sniff_timeout"`
+	DialTimeout         time.Duration `mapstructure:"dial_timeout"`
+	HeaderTimeout       time.Duration `mapstructure:"header_timeout"`
+	IdleTimeout         time.Duration `mapstructure:"idle_timeout"`
+	MaxTunnelLifetime   time.Duration `mapstructure:"max_tunnel_lifetime"`
 }
 
 func LoadConfig() (*Config, error) {
@@ -1,15 +1,31 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/Frizz925/gilgamesh/accesslog"
+	"github.com/Frizz925/gilgamesh/acl"
 	"github.com/Frizz925/gilgamesh/app"
 	"github.com/Frizz925/gilgamesh/auth"
+	"github.com/Frizz925/gilgamesh/dns"
+	"github.com/Frizz925/gilgamesh/manager"
+	"github.com/Frizz925/gilgamesh/metrics"
+	"github.com/Frizz925/gilgamesh/proxyproto"
+	"github.com/Frizz925/gilgamesh/ratelimit"
 	"github.com/Frizz925/gilgamesh/server"
+	"github.com/Frizz925/gilgamesh/upstream"
+	"github.com/Frizz925/gilgamesh/usage"
 	"github.com/Frizz925/gilgamesh/utils"
 	"github.com/Frizz925/gilgamesh/worker"
 	"golang.org/x/sync/errgroup"
@@ -20,6 +36,14 @@ import (
 type Dependencies struct {
 	Logger    *zap.Logger
 	TLSConfig *tls.Config
+	// Reloaded from the configuration on SIGHUP
+	Hosts *worker.Hosts
+	// Flushed to the usage file in the background, nil if not enabled
+	Meter *usage.Meter
+	// Exposed on the metrics port, recorded but not exposed if nil
+	Metrics *metrics.Proxy
+	// Reopened on SIGHUP, nil if not enabled
+	AccessLog *accesslog.Logger
 }
 
 func Start() error {
@@ -50,51 +74,530 @@ func Start() error {
 		}
 	}
 
+	deps.Hosts, err = worker.NewHosts(newHostRules(cfg.Proxy.Hosts))
+	if err != nil {
+		return fmt.Errorf("hosts parsing: %+v", err)
+	}
+	if deps.AccessLog, err = newAccessLog(&cfg.Proxy.AccessLog); err != nil {
+		return fmt.Errorf("access log init: %+v", err)
+	}
+	go reloadOnSignal(deps)
+	if cfg.Proxy.Usage.File != "" {
+		deps.Meter = usage.NewMeter(usage.NewStore(cfg.Proxy.Usage.File))
+	}
+	if cfg.Proxy.Metrics.Port > 0 {
+		deps.Metrics = metrics.NewProxy(metrics.NewRegistry())
+	}
+
 	s, err := New(cfg, deps)
 	if err != nil {
 		return fmt.Errorf("server init: %+v", err)
 	}
+	// The quota set up from the users metadata is saved along with the usage
+	if deps.Meter != nil || s.Quota() != nil {
+		go flushUsage(deps, s, cfg.Proxy.Usage.FlushInterval)
+	}
 
+	listen, err := newListenFunc(&cfg.Proxy.Server)
+	if err != nil {
+		return err
+	}
 	g := &errgroup.Group{}
-	if err := listenAndServe(g, cfg.Proxy.Server.Ports, s.Serve); err != nil {
+	if err := listenAndServe(g, listen, cfg.Proxy.Server.Ports, s.Serve); err != nil {
+		return err
+	}
+	if err := listenAndServe(g, listen, cfg.Proxy.Server.TLSPorts, s.ServeTLS); err != nil {
+		return err
+	}
+	if err := listenAndServe(g, listen, cfg.Proxy.Server.SOCKSPorts, s.ServeSOCKS); err != nil {
 		return err
 	}
-	if err := listenAndServe(g, cfg.Proxy.Server.TLSPorts, s.ServeTLS); err != nil {
+	if err := listenAndServe(g, listen, cfg.Proxy.Server.TransparentPorts, s.ServeTransparent); err != nil {
+		return err
+	}
+	var metricsServer *http.Server
+	if deps.Metrics != nil {
+		if metricsServer, err = serveMetrics(g, cfg.Proxy.Metrics.Port, deps.Metrics); err != nil {
+			return err
+		}
+	}
+
+	var managerListener net.Listener
+	if cfg.Proxy.Manager.Address != "" {
+		m := manager.New(manager.Config{
+			Logger: deps.Logger,
+			Server: s,
+			LoadCertificate: func() (tls.Certificate, error) {
+				return tls.LoadX509KeyPair(cfg.Proxy.TLS.Certificate, cfg.Proxy.TLS.CertificateKey)
+			},
+			Resolver: s.Resolver(),
+			Quota:    s.Quota(),
+			Metrics:  deps.Metrics,
+		})
+		if managerListener, err = serveManager(cfg.Proxy.Manager.Address, m); err != nil {
+			return err
+		}
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		shutdownOnSignal(deps, s, metricsServer, managerListener, cfg.Proxy.Server.ShutdownTimeout)
+		close(stopped)
+	}()
+	// Listeners are only ever stopped by the shutdown, which may still be
+	// draining connections
+	if err := g.Wait(); err != server.ErrServerAlreadyStopped {
 		return err
 	}
-	return g.Wait()
+	<-stopped
+	return nil
 }
 
 func New(cfg *app.Config, deps *Dependencies) (*server.Server, error) {
 	var credentials auth.Credentials
+	var metadata auth.Metadata
 	if cfg.Proxy.PasswordsFile != "" {
 		f, err := os.Open(cfg.Proxy.PasswordsFile)
 		if err != nil {
 			return nil, fmt.Errorf("passwords file read: %+v", err)
 		}
-		v, err := auth.ReadCredentials(f)
+		credentials, metadata, err = auth.ReadCredentialsMetadata(f)
+		f.Close()
 		if err != nil {
 			return nil, fmt.Errorf("passwords file parsing: %+v", err)
 		}
-		credentials = v
+	}
+
+	var dialer upstream.Dialer
+	if cfg.Proxy.Upstream.URL != "" {
+		v, err := upstream.Parse(cfg.Proxy.Upstream.URL, upstream.Config{
+			TLSConfig: &tls.Config{
+				InsecureSkipVerify: cfg.Proxy.Upstream.InsecureSkipVerify, //nolint:gosec
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("upstream init: %+v", err)
+		}
+		dialer = v
+	}
+
+	proxyProtocolRules, err := newProxyProtocolRules(cfg.Proxy.Upstream.ProxyProtocol)
+	if err != nil {
+		return nil, fmt.Errorf("proxy protocol rules parsing: %+v", err)
+	}
+	resolver, err := newResolver(&cfg.Proxy.DNS)
+	if err != nil {
+		return nil, fmt.Errorf("dns parsing: %+v", err)
+	}
+	accessList, err := newACL(&cfg.Proxy.ACL, resolver)
+	if err != nil {
+		return nil, fmt.Errorf("acl parsing: %+v", err)
+	}
+	guard, err := newGuard(&cfg.Proxy.Guard)
+	if err != nil {
+		return nil, fmt.Errorf("guard parsing: %+v", err)
+	}
+	if guard != nil && dialer != nil {
+		deps.Logger.Warn("Guard only checks the local resolution of destinations dialed through the upstream proxy")
+	}
+	ports, err := newPortPolicy(&cfg.Proxy.Ports)
+	if err != nil {
+		return nil, fmt.Errorf("ports parsing: %+v", err)
+	}
+	if ports.ConnectPorts == nil {
+		ports.ConnectPorts = []acl.PortRange{{From: 443, To: 443}}
+	}
+	throttle, err := newThrottle(&cfg.Proxy.Bandwidth, metadata)
+	if err != nil {
+		return nil, fmt.Errorf("bandwidth parsing: %+v", err)
+	}
+	quota, err := newQuota(&cfg.Proxy.Quota, metadata)
+	if err != nil {
+		return nil, fmt.Errorf("quota init: %+v", err)
+	}
+	userPorts := make(map[string]worker.PortPolicy)
+	for _, user := range cfg.Proxy.Users {
+		if userPorts[user.Name], err = newPortPolicy(&user.Ports); err != nil {
+			return nil, fmt.Errorf("ports parsing of user %s: %+v", user.Name, err)
+		}
 	}
 
 	return server.New(server.Config{
-		Logger:    deps.Logger,
-		TLSConfig: deps.TLSConfig,
-		PoolSize:  cfg.Proxy.Worker.PoolCount,
+		Logger:        deps.Logger,
+		TLSConfig:     deps.TLSConfig,
+		PoolSize:      cfg.Proxy.Worker.PoolCount,
+		DisableHTTP2:  cfg.Proxy.Server.DisableHTTP2,
+		MaxConnsPerIP: cfg.Proxy.Limits.MaxConnsPerIP,
 		WorkerConfig: worker.Config{
-			Logger:          deps.Logger,
-			ReadBufferSize:  cfg.Proxy.Worker.ReadBuffer,
-			WriteBufferSize: cfg.Proxy.Worker.WriteBuffer,
-			Credentials:     credentials,
+			Logger:             deps.Logger,
+			ReadBufferSize:     cfg.Proxy.Worker.ReadBuffer,
+			WriteBufferSize:    cfg.Proxy.Worker.WriteBuffer,
+			Credentials:        credentials,
+			Resolver:           resolver,
+			Hosts:              deps.Hosts,
+			Upstream:           dialer,
+			UDPIdleTimeout:     cfg.Proxy.Worker.UDPIdleTimeout,
+			SOCKS4UserIDAuth:   cfg.Proxy.Worker.SOCKS4UserIDAuth,
+			SniffTimeout:       cfg.Proxy.Worker.SniffTimeout,
+			DialTimeout:        cfg.Proxy.Worker.DialTimeout,
+			HeaderTimeout:      cfg.Proxy.Worker.HeaderTimeout,
+			IdleTimeout:        cfg.Proxy.Worker.IdleTimeout,
+			MaxTunnelLifetime:  cfg.Proxy.Worker.MaxTunnelLifetime,
+			ProxyProtocolRules: proxyProtocolRules,
+			ACL:                accessList,
+			Guard:              guard,
+			Ports:              ports,
+			UserPorts:          userPorts,
+			Throttle:           throttle,
+			UserConns:          ratelimit.NewConnLimit(cfg.Proxy.Limits.MaxConnsPerUser),
+			UserRequests:       newRequestLimit(cfg.Proxy.Limits.UserRequestRate, cfg.Proxy.Limits.UserRequestBurst),
+			IPRequests:         newRequestLimit(cfg.Proxy.Limits.IPRequestRate, cfg.Proxy.Limits.IPRequestBurst),
+			Meter:              deps.Meter,
+			Quota:              quota,
+			CloseOverQuota:     cfg.Proxy.Quota.CloseTunnels,
+			Metrics:            deps.Metrics,
+			AccessLog:          deps.AccessLog,
+			ConnPool: worker.NewConnPool(worker.ConnPoolConfig{
+				MaxIdleConns:        cfg.Proxy.Worker.MaxIdleConns,
+				MaxIdleConnsPerHost: cfg.Proxy.Worker.MaxIdleConnsPerHost,
+				IdleConnTimeout:     cfg.Proxy.Worker.IdleConnTimeout,
+				HealthCheck:         cfg.Proxy.Worker.IdleConnHealthCheck,
+			}),
 		},
 	}), nil
 }
 
-func listenAndServe(g *errgroup.Group, ports []int, serve func(l net.Listener) error) error {
-	for _, port := range ports {
+// reloadOnSignal reopens the access log and reloads the settings which can
+// change at runtime whenever the process receives SIGHUP.
+func reloadOnSignal(deps *Dependencies) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		log := deps.Logger.With(zap.String("signal", "SIGHUP"))
+		if deps.AccessLog != nil {
+			if err := deps.AccessLog.Reopen(); err != nil {
+				log.Error("Failed to reopen access log", zap.Error(err))
+			} else {
+				log.Info("Reopened access log")
+			}
+		}
+		cfg, err := app.LoadConfig()
+		if err != nil {
+			log.Error("Failed to reload config", zap.Error(err))
+			continue
+		}
+		if err := deps.Hosts.Update(newHostRules(cfg.Proxy.Hosts)); err != nil {
+			log.Error("Failed to reload hosts", zap.Error(err))
+			continue
+		}
+		log.Info("Reloaded hosts", zap.Int("count", len(cfg.Proxy.Hosts)))
+	}
+}
+
+// shutdownOnSignal shuts the server down once the process receives SIGINT
+// or SIGTERM, giving connections the timeout to finish before closing them.
+// Usage is saved one last time once no more bytes are relayed.
+func shutdownOnSignal(deps *Dependencies, s *server.Server, metricsServer *http.Server, managerListener net.Listener, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = server.DefaultShutdownTimeout
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-ch
+	// Signaling again kills the process right away
+	signal.Stop(ch)
+
+	log := deps.Logger.With(zap.String("signal", sig.String()))
+	log.Info("Shutting down", zap.Duration("timeout", timeout))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if cut, err := s.Shutdown(ctx); err != nil {
+		log.Warn("Closed connections still open", zap.Int("count", cut), zap.Error(err))
+	}
+	s.Close()
+	if metricsServer != nil {
+		_ = metricsServer.Close()
+	}
+	if managerListener != nil {
+		_ = managerListener.Close()
+	}
+	saveUsage(deps, s)
+	if deps.AccessLog != nil {
+		_ = deps.AccessLog.Close()
+	}
+	log.Info("Shut down")
+}
+
+// flushUsage saves the bytes accounted so far to the usage file, and the
+// quota usage to its own, every interval.
+func flushUsage(deps *Dependencies, s *server.Server, interval time.Duration) {
+	if interval <= 0 {
+		interval = usage.DefaultFlushInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		saveUsage(deps, s)
+	}
+}
+
+func saveUsage(deps *Dependencies, s *server.Server) {
+	if deps.Meter != nil {
+		if err := deps.Meter.Flush(); err != nil {
+			deps.Logger.Error("Failed to flush usage", zap.Error(err))
+		}
+	}
+	if quota := s.Quota(); quota != nil {
+		if err := quota.Save(); err != nil {
+			deps.Logger.Error("Failed to save quota usage", zap.Error(err))
+		}
+	}
+}
+
+func newAccessLog(cfg *app.ProxyAccessLog) (*accesslog.Logger, error) {
+	if cfg.File == "" {
+		return nil, nil
+	}
+	format, err := accesslog.ParseFormat(cfg.Format)
+	if err != nil {
+		return nil, err
+	}
+	return accesslog.New(accesslog.Config{File: cfg.File, Format: format})
+}
+
+func newHostRules(hosts []app.ProxyHost) []worker.HostRule {
+	rules := make([]worker.HostRule, len(hosts))
+	for i, host := range hosts {
+		rules[i] = worker.HostRule{From: host.From, To: host.To}
+	}
+	return rules
+}
+
+func newResolver(cfg *app.ProxyDNS) (*dns.Resolver, error) {
+	servers, err := parseDNSServers(cfg.Servers)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]dns.Rule, len(cfg.Rules))
+	for i, rule := range cfg.Rules {
+		if len(rule.Servers) <= 0 {
+			return nil, fmt.Errorf("no servers for domains %s", strings.Join(rule.Domains, ", "))
+		}
+		r := dns.Rule{Domains: rule.Domains}
+		if r.Servers, err = parseDNSServers(rule.Servers); err != nil {
+			return nil, err
+		}
+		rules[i] = r
+	}
+	return dns.New(dns.Config{
+		Servers:     servers,
+		Rules:       rules,
+		TTL:         cfg.TTL,
+		NegativeTTL: cfg.NegativeTTL,
+		Timeout:     cfg.Timeout,
+		MaxEntries:  cfg.CacheSize,
+	}), nil
+}
+
+func parseDNSServers(a []string) ([]dns.Server, error) {
+	result := make([]dns.Server, len(a))
+	for i, v := range a {
+		server, err := dns.ParseServer(v)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = server
+	}
+	return result, nil
+}
+
+func newACL(cfg *app.ProxyACL, resolver acl.Resolver) (*acl.ACL, error) {
+	fallback, err := acl.ParseAction(cfg.Default)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Rules) <= 0 && fallback == acl.Allow {
+		return nil, nil
+	}
+	rules := make([]acl.Rule, len(cfg.Rules))
+	for i, rule := range cfg.Rules {
+		r := acl.Rule{
+			Name:    rule.Name,
+			Hosts:   rule.Hosts,
+			Methods: rule.Methods,
+			Users:   rule.Users,
+		}
+		if r.Action, err = acl.ParseAction(rule.Action); err != nil {
+			return nil, err
+		}
+		if r.Ports, err = acl.ParsePorts(rule.Ports); err != nil {
+			return nil, err
+		}
+		if r.Networks, err = parseCIDRs(rule.Networks); err != nil {
+			return nil, err
+		}
+		if r.Sources, err = parseCIDRs(rule.Sources); err != nil {
+			return nil, err
+		}
+		rules[i] = r
+	}
+	return acl.New(acl.Config{
+		Rules:    rules,
+		Default:  fallback,
+		Resolver: resolver,
+	}), nil
+}
+
+func newGuard(cfg *app.ProxyGuard) (*acl.Guard, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	blocked, err := parseCIDRs(cfg.Blocked)
+	if err != nil {
+		return nil, err
+	}
+	allowed, err := parseCIDRs(cfg.Allowed)
+	if err != nil {
+		return nil, err
+	}
+	return acl.NewGuard(acl.GuardConfig{Blocked: blocked, Allowed: allowed}), nil
+}
+
+// newPortPolicy leaves the port sets not configured nil.
+func newPortPolicy(cfg *app.ProxyPorts) (policy worker.PortPolicy, err error) {
+	if cfg.Connect != nil {
+		if policy.ConnectPorts, err = acl.ParsePorts(cfg.Connect); err != nil {
+			return policy, err
+		}
+	}
+	if cfg.HTTP != nil {
+		if policy.HTTPPorts, err = acl.ParsePorts(cfg.HTTP); err != nil {
+			return policy, err
+		}
+	}
+	return policy, nil
+}
+
+// newThrottle returns nil when neither the defaults nor any user limits the
+// bandwidth.
+func newThrottle(cfg *app.ProxyBandwidth, metadata auth.Metadata) (*ratelimit.Throttle, error) {
+	defaults := ratelimit.Limits{Upload: cfg.Upload, Download: cfg.Download}
+	users := make(map[string]ratelimit.Limits)
+	for user, meta := range metadata {
+		limits := defaults
+		var err error
+		if v, ok := meta["upload_rate"]; ok {
+			if limits.Upload, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid upload rate of user %s: %s", user, v)
+			}
+		}
+		if v, ok := meta["download_rate"]; ok {
+			if limits.Download, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid download rate of user %s: %s", user, v)
+			}
+		}
+		if limits != defaults {
+			users[user] = limits
+		}
+	}
+	if defaults == (ratelimit.Limits{}) && len(users) <= 0 {
+		return nil, nil
+	}
+	return ratelimit.NewThrottle(ratelimit.ThrottleConfig{
+		Default: defaults,
+		Users:   users,
+	}), nil
+}
+
+// newQuota returns nil when neither the default nor any user has a quota.
+func newQuota(cfg *app.ProxyQuota, metadata auth.Metadata) (*usage.Quota, error) {
+	var defaults int64
+	if cfg.Default != "" {
+		v, err := usage.ParseSize(cfg.Default)
+		if err != nil {
+			return nil, err
+		}
+		defaults = v
+	}
+	users := make(map[string]int64)
+	for user, meta := range metadata {
+		if v, ok := meta["quota"]; ok {
+			size, err := usage.ParseSize(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid quota of user %s: %s", user, v)
+			}
+			users[user] = size
+		}
+	}
+	if defaults <= 0 && len(users) <= 0 {
+		return nil, nil
+	}
+	return usage.NewQuota(usage.QuotaConfig{
+		Default:  defaults,
+		Users:    users,
+		ResetDay: cfg.ResetDay,
+		File:     cfg.File,
+	})
+}
+
+func newRequestLimit(rate float64, burst int) *ratelimit.RequestLimit {
+	if rate <= 0 {
+		return nil
+	}
+	return ratelimit.NewRequestLimit(rate, burst)
+}
+
+func newProxyProtocolRules(rules []app.ProxyProtocolRule) ([]worker.ProxyProtocolRule, error) {
+	result := make([]worker.ProxyProtocolRule, len(rules))
+	for i, rule := range rules {
+		if rule.Version != proxyproto.Version1 && rule.Version != proxyproto.Version2 {
+			return nil, fmt.Errorf("unsupported PROXY protocol version: %d", rule.Version)
+		}
+		r := worker.ProxyProtocolRule{
+			Hosts:   rule.Hosts,
+			Ports:   rule.Ports,
+			Version: byte(rule.Version),
+		}
+		networks, err := parseCIDRs(rule.Networks)
+		if err != nil {
+			return nil, err
+		}
+		r.Networks = networks
+		result[i] = r
+	}
+	return result, nil
+}
+
+// newListenFunc returns a function listening on the given port, expecting
+// PROXY protocol headers on the ports configured to.
+func newListenFunc(cfg *app.ProxyServer) (func(port int) (net.Listener, error), error) {
+	proxyPorts := make(map[int]bool)
+	for _, port := range cfg.ProxyProtocolPorts {
+		proxyPorts[port] = true
+	}
+	trusted, err := parseCIDRs(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("trusted proxies parsing: %+v", err)
+	}
+	if len(proxyPorts) > 0 && len(trusted) <= 0 {
+		return nil, errors.New("trusted proxies are required by PROXY protocol ports")
+	}
+	return func(port int) (net.Listener, error) {
 		l, err := net.Listen("tcp", portToAddr(port))
+		if err != nil || !proxyPorts[port] {
+			return l, err
+		}
+		return &server.Listener{
+			Listener:       l,
+			ProxyProtocol:  true,
+			TrustedProxies: trusted,
+		}, nil
+	}, nil
+}
+
+func listenAndServe(g *errgroup.Group, listen func(port int) (net.Listener, error), ports []int, serve func(l net.Listener) error) error {
+	for _, port := range ports {
+		l, err := listen(port)
 		if err != nil {
 			return fmt.Errorf("listener init: %+v", err)
 		}
@@ -105,6 +608,71 @@ func listenAndServe(g *errgroup.Group, ports []int, serve func(l net.Listener) e
 	return nil
 }
 
+// serveMetrics exposes the metrics at /metrics of the port until the
+// returned server is closed.
+func serveMetrics(g *errgroup.Group, port int, m *metrics.Proxy) (*http.Server, error) {
+	l, err := net.Listen("tcp", portToAddr(port))
+	if err != nil {
+		return nil, fmt.Errorf("metrics listener init: %+v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Registry)
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: worker.DefaultTimeout,
+	}
+	g.Go(func() error {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	})
+	return srv, nil
+}
+
+// serveManager serves the management commands on the address until the
+// returned listener is closed.
+func serveManager(address string, m *manager.Manager) (net.Listener, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("manager listener init: %+v", err)
+	}
+	go func() {
+		// Only ever ends once the listener is closed
+		_ = m.Serve(l)
+	}()
+	return l, nil
+}
+
+func parseCIDRs(a []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, v := range a {
+		ipnet, err := parseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, ipnet)
+	}
+	return result, nil
+}
+
+// parseCIDR accepts bare IP addresses as single host networks.
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, &net.ParseError{Type: "IP address", Text: s}
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	return ipnet, err
+}
+
 func portToAddr(port int) string {
 	return net.JoinHostPort("", strconv.Itoa(port))
 }
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 
 	"golang.org/x/crypto/bcrypt"
@@ -13,6 +14,10 @@ type Credentials map[string]Password
 
 type Password []byte
 
+// Metadata holds settings of each user, stored in the passwords file after
+// the password as comma separated key=value pairs.
+type Metadata map[string]map[string]string
+
 func CreatePassword(plaintext []byte) (Password, error) {
 	b, err := bcrypt.GenerateFromPassword(plaintext, bcrypt.DefaultCost)
 	return Password(b), err
@@ -23,6 +28,10 @@ func (p Password) Compare(password []byte) error {
 }
 
 func WriteCredentials(w io.Writer, credentials Credentials) error {
+	return WriteCredentialsMetadata(w, credentials, nil)
+}
+
+func WriteCredentialsMetadata(w io.Writer, credentials Credentials, metadata Metadata) error {
 	var bw *bufio.Writer
 	if v, ok := w.(*bufio.Writer); ok {
 		bw = v
@@ -30,8 +39,11 @@ func WriteCredentials(w io.Writer, credentials Credentials) error {
 		bw = bufio.NewWriter(w)
 	}
 	for user, password := range credentials {
-		line := fmt.Sprintf("%s:%s\n", user, password)
-		if _, err := bw.WriteString(line); err != nil {
+		line := fmt.Sprintf("%s:%s", user, password)
+		if meta := formatMetadata(metadata[user]); meta != "" {
+			line += ":" + meta
+		}
+		if _, err := bw.WriteString(line + "\n"); err != nil {
 			return err
 		}
 	}
@@ -39,12 +51,49 @@ func WriteCredentials(w io.Writer, credentials Credentials) error {
 }
 
 func ReadCredentials(r io.Reader) (Credentials, error) {
+	credentials, _, err := ReadCredentialsMetadata(r)
+	return credentials, err
+}
+
+func ReadCredentialsMetadata(r io.Reader) (Credentials, Metadata, error) {
 	sc := bufio.NewScanner(r)
-	result := make(Credentials)
+	credentials := make(Credentials)
+	metadata := make(Metadata)
 	for sc.Scan() {
-		parts := strings.Split(sc.Text(), ":")
+		parts := strings.SplitN(sc.Text(), ":", 3)
+		if len(parts) < 2 {
+			return nil, nil, fmt.Errorf("malformed credentials line: %s", sc.Text())
+		}
 		user, password := parts[0], Password(parts[1])
-		result[user] = password
+		credentials[user] = password
+		if len(parts) > 2 {
+			metadata[user] = parseMetadata(parts[2])
+		}
+	}
+	return credentials, metadata, sc.Err()
+}
+
+func parseMetadata(s string) map[string]string {
+	result := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) < 2 {
+			result[kv[0]] = ""
+		} else {
+			result[kv[0]] = kv[1]
+		}
+	}
+	return result
+}
+
+func formatMetadata(meta map[string]string) string {
+	pairs := make([]string, 0, len(meta))
+	for k, v := range meta {
+		pairs = append(pairs, k+"="+v)
 	}
-	return result, nil
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
 }
@@ -32,3 +32,24 @@ func TestCredentials(t *testing.T) {
 	bw := bufio.NewWriter(iotest.NewErrorWriter(expectedErr))
 	require.Equal(expectedErr, WriteCredentials(bw, creds))
 }
+
+func TestCredentialsMetadata(t *testing.T) {
+	require := require.New(t)
+	pw, err := CreatePassword([]byte("deadbeef"))
+	require.NoError(err)
+
+	buf := &bytes.Buffer{}
+	creds := Credentials{"alice": pw, "bob": pw}
+	meta := Metadata{"alice": {"upload_rate": "1024", "download_rate": "4096"}}
+	require.NoError(WriteCredentialsMetadata(buf, creds, meta))
+	require.Contains(buf.String(), "alice:"+string(pw)+":download_rate=4096,upload_rate=1024\n")
+	require.Contains(buf.String(), "bob:"+string(pw)+"\n")
+
+	readCreds, readMeta, err := ReadCredentialsMetadata(buf)
+	require.NoError(err)
+	require.Equal(creds, readCreds)
+	require.Equal(meta, readMeta)
+
+	_, err = ReadCredentials(bytes.NewBufferString("malformed\n"))
+	require.Error(err)
+}
@@ -0,0 +1,112 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Least time given to dial each address, as the standard dialer does
+const minDialTimeout = 2 * time.Second
+
+// Dialer dials hosts by name through the resolver, trying each of their
+// addresses in turn until one connects. The time left to dial is shared
+// among the addresses, so that an unresponsive one does not use it all up.
+type Dialer struct {
+	resolver *Resolver
+	dialer   *net.Dialer
+}
+
+func NewDialer(r *Resolver, d *net.Dialer) *Dialer {
+	if d == nil {
+		d = new(net.Dialer)
+	}
+	return &Dialer{resolver: r, dialer: d}
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := d.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if matchFamily(network, addr.IP) {
+			ips = append(ips, addr.IP)
+		}
+	}
+	var firstErr error
+	for i, ip := range ips {
+		now := time.Now()
+		dialCtx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := d.deadline(ctx, now); ok {
+			dialCtx, cancel = context.WithDeadline(ctx, partialDeadline(now, deadline, len(ips)-i))
+		}
+		c, err := d.dialer.DialContext(dialCtx, network, net.JoinHostPort(ip.String(), port))
+		cancel()
+		if err == nil {
+			return c, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = &net.OpError{
+			Op:  "dial",
+			Net: network,
+			Err: &net.DNSError{Err: "no suitable address found", Name: host},
+		}
+	}
+	return nil, firstErr
+}
+
+// deadline returns the earliest of the deadlines of the context and of the
+// dialer, if any.
+func (d *Dialer) deadline(ctx context.Context, now time.Time) (time.Time, bool) {
+	deadline, ok := ctx.Deadline()
+	if d.dialer.Timeout > 0 {
+		if v := now.Add(d.dialer.Timeout); !ok || v.Before(deadline) {
+			deadline, ok = v, true
+		}
+	}
+	if !d.dialer.Deadline.IsZero() && (!ok || d.dialer.Deadline.Before(deadline)) {
+		deadline, ok = d.dialer.Deadline, true
+	}
+	return deadline, ok
+}
+
+// partialDeadline returns the deadline for dialing the next of the remaining
+// addresses, sharing the time left evenly among them while giving each at
+// least minDialTimeout.
+func partialDeadline(now, deadline time.Time, remaining int) time.Time {
+	left := deadline.Sub(now)
+	if left <= 0 {
+		return deadline
+	}
+	timeout := left / time.Duration(remaining)
+	if timeout < minDialTimeout {
+		timeout = minDialTimeout
+		if left < timeout {
+			timeout = left
+		}
+	}
+	return now.Add(timeout)
+}
+
+func matchFamily(network string, ip net.IP) bool {
+	switch network[len(network)-1] {
+	case '4':
+		return ip.To4() != nil
+	case '6':
+		return ip.To4() == nil
+	}
+	return true
+}
@@ -0,0 +1,158 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// DNS record types whose TTLs bound how long addresses are cached
+const (
+	typeA     = 1
+	typeCNAME = 5
+	typeAAAA  = 28
+)
+
+type recorderKey struct{}
+
+// ttlRecorder keeps the lowest TTL of the address records found in the
+// answers read during a lookup.
+type ttlRecorder struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	found bool
+}
+
+func withRecorder(ctx context.Context, tr *ttlRecorder) context.Context {
+	return context.WithValue(ctx, recorderKey{}, tr)
+}
+
+func recorderFrom(ctx context.Context) *ttlRecorder {
+	tr, _ := ctx.Value(recorderKey{}).(*ttlRecorder)
+	return tr
+}
+
+func (tr *ttlRecorder) record(msg []byte) {
+	ttl, ok := minTTL(msg)
+	if !ok {
+		return
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if !tr.found || ttl < tr.ttl {
+		tr.ttl, tr.found = ttl, true
+	}
+}
+
+// lowest returns the lowest TTL recorded, if any.
+func (tr *ttlRecorder) lowest() (time.Duration, bool) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.ttl, tr.found
+}
+
+// recordConn wraps the connection to a DNS server so that the answers read
+// from it are recorded. The UDP connection is kept as is otherwise, since
+// the resolver tells datagram and stream connections apart by their type.
+func recordConn(c net.Conn, tr *ttlRecorder) net.Conn {
+	if uc, ok := c.(*net.UDPConn); ok {
+		return &recordPacketConn{UDPConn: uc, recorder: tr}
+	}
+	return &recordStreamConn{Conn: c, recorder: tr}
+}
+
+// recordPacketConn reads a whole message with every datagram.
+type recordPacketConn struct {
+	*net.UDPConn
+	recorder *ttlRecorder
+}
+
+func (c *recordPacketConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	if n > 0 {
+		c.recorder.record(b[:n])
+	}
+	return n, err
+}
+
+// recordStreamConn reads messages prefixed with their length, which may
+// span several reads.
+type recordStreamConn struct {
+	net.Conn
+	recorder *ttlRecorder
+	buf      []byte
+}
+
+func (c *recordStreamConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.buf = append(c.buf, b[:n]...)
+	for len(c.buf) >= 2 {
+		size := 2 + int(binary.BigEndian.Uint16(c.buf))
+		if len(c.buf) < size {
+			break
+		}
+		c.recorder.record(c.buf[2:size])
+		c.buf = c.buf[size:]
+	}
+	return n, err
+}
+
+// minTTL returns the lowest TTL of the address and alias records in the
+// answer section of the message, reporting whether there are any.
+func minTTL(msg []byte) (time.Duration, bool) {
+	if len(msg) < 12 {
+		return 0, false
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		if off = skipName(msg, off); off < 0 {
+			return 0, false
+		}
+		// Type and class
+		off += 4
+	}
+	var ttl uint32
+	found := false
+	for i := 0; i < ancount; i++ {
+		if off = skipName(msg, off); off < 0 || off+10 > len(msg) {
+			break
+		}
+		typ := binary.BigEndian.Uint16(msg[off:])
+		v := binary.BigEndian.Uint32(msg[off+4:])
+		off += 10 + int(binary.BigEndian.Uint16(msg[off+8:]))
+		if off > len(msg) {
+			break
+		}
+		if typ != typeA && typ != typeAAAA && typ != typeCNAME {
+			continue
+		}
+		if !found || v < ttl {
+			ttl, found = v, true
+		}
+	}
+	return time.Duration(ttl) * time.Second, found
+}
+
+// skipName returns the offset right after the name at the given offset, or
+// -1 if the name runs past the end of the message.
+func skipName(msg []byte, off int) int {
+	for off < len(msg) {
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1
+		case n&0xc0 == 0xc0:
+			// Compression pointer ending the name
+			if off+2 > len(msg) {
+				return -1
+			}
+			return off + 2
+		}
+		off += 1 + n
+	}
+	return -1
+}
@@ -0,0 +1,286 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	DefaultTTL         = time.Minute
+	DefaultNegativeTTL = 10 * time.Second
+	DefaultTimeout     = 5 * time.Second
+	DefaultMaxEntries  = 10000
+)
+
+// Server is an upstream DNS server queried over either UDP or TCP.
+type Server struct {
+	Network string
+	Address string
+}
+
+// ParseServer parses servers given as "udp://host:port", "tcp://host:port"
+// or a bare address, queried over UDP on port 53 unless told otherwise.
+func ParseServer(s string) (Server, error) {
+	server := Server{Network: "udp", Address: s}
+	if idx := strings.Index(s, "://"); idx >= 0 {
+		server.Network, server.Address = strings.ToLower(s[:idx]), s[idx+3:]
+	}
+	if server.Network != "udp" && server.Network != "tcp" {
+		return server, fmt.Errorf("unsupported DNS server network: %s", server.Network)
+	}
+	host, _, err := net.SplitHostPort(server.Address)
+	if err != nil {
+		host = strings.Trim(server.Address, "[]")
+		server.Address = net.JoinHostPort(host, "53")
+	}
+	if host == "" {
+		return server, fmt.Errorf("invalid DNS server address: %s", s)
+	}
+	return server, nil
+}
+
+// Rule forwards the lookups of names within its domains to its own servers.
+type Rule struct {
+	Domains []string
+	Servers []Server
+}
+
+type Config struct {
+	// Servers queried in turn, the system resolver being used if empty
+	Servers []Server
+	// Split DNS rules, the longest matching domain wins
+	Rules []Rule
+	// How long found and missing names are cached, found names expiring
+	// sooner if their records have shorter TTLs
+	TTL         time.Duration
+	NegativeTTL time.Duration
+	Timeout     time.Duration
+	MaxEntries  int
+}
+
+// Stats counts lookups answered from and missing the cache.
+type Stats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+}
+
+// Resolver looks up host addresses, caching both the found addresses and
+// names found not to exist. Record TTLs are only known for the answers of
+// configured servers, those of the system resolver being cached for the TTL.
+type Resolver struct {
+	fallback    *net.Resolver
+	rules       []domainRule
+	ttl         time.Duration
+	negativeTTL time.Duration
+	timeout     time.Duration
+	maxEntries  int
+
+	hits   uint64
+	misses uint64
+
+	group singleflight.Group
+	mu    sync.Mutex
+	cache map[string]*entry
+}
+
+type domainRule struct {
+	domain   string
+	resolver *net.Resolver
+}
+
+type entry struct {
+	addrs   []net.IPAddr
+	err     error
+	expires time.Time
+}
+
+func New(cfg Config) *Resolver {
+	if cfg.TTL <= 0 {
+		cfg.TTL = DefaultTTL
+	}
+	if cfg.NegativeTTL <= 0 {
+		cfg.NegativeTTL = DefaultNegativeTTL
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.MaxEntries <= 0 {
+		cfg.MaxEntries = DefaultMaxEntries
+	}
+	r := &Resolver{
+		fallback:    net.DefaultResolver,
+		ttl:         cfg.TTL,
+		negativeTTL: cfg.NegativeTTL,
+		timeout:     cfg.Timeout,
+		maxEntries:  cfg.MaxEntries,
+		cache:       make(map[string]*entry),
+	}
+	if len(cfg.Servers) > 0 {
+		r.fallback = newNetResolver(cfg.Servers)
+	}
+	for _, rule := range cfg.Rules {
+		resolver := newNetResolver(rule.Servers)
+		for _, domain := range rule.Domains {
+			r.rules = append(r.rules, domainRule{
+				domain:   normalizeName(domain),
+				resolver: resolver,
+			})
+		}
+	}
+	return r
+}
+
+// newNetResolver returns a resolver querying the servers in turn, so the
+// retries of the resolver fail over to the next server.
+func newNetResolver(servers []Server) *net.Resolver {
+	var next uint32
+	d := &net.Dialer{}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			s := servers[int(atomic.AddUint32(&next, 1)-1)%len(servers)]
+			// UDP servers are still asked over TCP after a truncated answer
+			if s.Network == "tcp" {
+				network = s.Network
+			}
+			c, err := d.DialContext(ctx, network, s.Address)
+			if tr := recorderFrom(ctx); tr != nil && err == nil {
+				c = recordConn(c, tr)
+			}
+			return c, err
+		},
+	}
+}
+
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	name := normalizeName(host)
+	if e := r.get(name); e != nil {
+		atomic.AddUint64(&r.hits, 1)
+		return copyAddrs(e.addrs), e.err
+	}
+	atomic.AddUint64(&r.misses, 1)
+
+	// Concurrent lookups of the same name share a single query
+	ch := r.group.DoChan(name, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+		defer cancel()
+		tr := &ttlRecorder{}
+		addrs, err := r.resolverFor(name).LookupIPAddr(withRecorder(ctx, tr), name)
+		if err == nil && len(addrs) <= 0 {
+			err = &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		r.put(name, addrs, err, tr)
+		return addrs, err
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return copyAddrs(res.Val.([]net.IPAddr)), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (r *Resolver) Stats() Stats {
+	r.mu.Lock()
+	entries := len(r.cache)
+	r.mu.Unlock()
+	return Stats{
+		Hits:    atomic.LoadUint64(&r.hits),
+		Misses:  atomic.LoadUint64(&r.misses),
+		Entries: entries,
+	}
+}
+
+func (r *Resolver) resolverFor(name string) *net.Resolver {
+	resolver, matched := r.fallback, -1
+	for _, rule := range r.rules {
+		if len(rule.domain) > matched && inDomain(name, rule.domain) {
+			resolver, matched = rule.resolver, len(rule.domain)
+		}
+	}
+	return resolver
+}
+
+func (r *Resolver) get(name string) *entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.cache[name]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(e.expires) {
+		delete(r.cache, name)
+		return nil
+	}
+	return e
+}
+
+// put caches the outcome of a lookup, failures other than the name not
+// existing being left out. Addresses are cached no longer than the lowest
+// TTL of their records.
+func (r *Resolver) put(name string, addrs []net.IPAddr, err error, tr *ttlRecorder) {
+	ttl := r.ttl
+	if v, ok := tr.lowest(); ok && v < ttl {
+		ttl = v
+	}
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return
+		}
+		ttl = r.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.cache) >= r.maxEntries {
+		for k, e := range r.cache {
+			if now.After(e.expires) {
+				delete(r.cache, k)
+			}
+		}
+	}
+	// Still full of live entries, make room by dropping any of them
+	for k := range r.cache {
+		if len(r.cache) < r.maxEntries {
+			break
+		}
+		delete(r.cache, k)
+	}
+	r.cache[name] = &entry{addrs: addrs, err: err, expires: now.Add(ttl)}
+}
+
+func inDomain(name, domain string) bool {
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func copyAddrs(addrs []net.IPAddr) []net.IPAddr {
+	if addrs == nil {
+		return nil
+	}
+	result := make([]net.IPAddr, len(addrs))
+	copy(result, addrs)
+	return result
+}
@@ -0,0 +1,299 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeServer answers A queries for its records over both UDP and TCP,
+// any other name being reported missing.
+type fakeServer struct {
+	records map[string]net.IP
+	// TTL of the records, a minute if unset
+	ttl     uint32
+	queries int32
+
+	pc net.PacketConn
+	l  net.Listener
+}
+
+func startFakeServer(t *testing.T, records map[string]net.IP) *fakeServer {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &fakeServer{records: records, pc: pc, l: l}
+	go s.serveUDP()
+	go s.serveTCP()
+	t.Cleanup(func() {
+		_ = pc.Close()
+		_ = l.Close()
+	})
+	return s
+}
+
+func (s *fakeServer) serveUDP() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if res := s.answer(buf[:n]); res != nil {
+			_, _ = s.pc.WriteTo(res, addr)
+		}
+	}
+}
+
+func (s *fakeServer) serveTCP() {
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			for {
+				var size [2]byte
+				if _, err := io.ReadFull(c, size[:]); err != nil {
+					return
+				}
+				req := make([]byte, binary.BigEndian.Uint16(size[:]))
+				if _, err := io.ReadFull(c, req); err != nil {
+					return
+				}
+				res := s.answer(req)
+				if res == nil {
+					return
+				}
+				binary.BigEndian.PutUint16(size[:], uint16(len(res)))
+				if _, err := c.Write(append(size[:], res...)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (s *fakeServer) answer(req []byte) []byte {
+	if len(req) < 12 {
+		return nil
+	}
+	var labels []string
+	off := 12
+	for off < len(req) && req[off] != 0 {
+		n := int(req[off])
+		if off+1+n > len(req) {
+			return nil
+		}
+		labels = append(labels, string(req[off+1:off+1+n]))
+		off += 1 + n
+	}
+	// Terminating label, type and class
+	off += 5
+	if off > len(req) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(req[off-4:])
+	name := strings.ToLower(strings.Join(labels, "."))
+	if qtype == 1 {
+		atomic.AddInt32(&s.queries, 1)
+	}
+
+	res := append([]byte(nil), req[:off]...)
+	// Response, recursion desired and available
+	res[2], res[3] = 0x81, 0x80
+	binary.BigEndian.PutUint16(res[6:], 0)
+	ip, ok := s.records[name]
+	if !ok {
+		// Name error
+		res[3] |= 3
+		return res
+	}
+	if qtype != 1 {
+		return res
+	}
+	ttl := atomic.LoadUint32(&s.ttl)
+	if ttl <= 0 {
+		ttl = 60
+	}
+	binary.BigEndian.PutUint16(res[6:], 1)
+	res = append(res, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 0, 0, 4)
+	binary.BigEndian.PutUint32(res[len(res)-6:], ttl)
+	return append(res, ip.To4()...)
+}
+
+func (s *fakeServer) server(network string) Server {
+	if network == "tcp" {
+		return Server{Network: network, Address: s.l.Addr().String()}
+	}
+	return Server{Network: network, Address: s.pc.LocalAddr().String()}
+}
+
+func TestResolver(t *testing.T) {
+	require := require.New(t)
+	public := startFakeServer(t, map[string]net.IP{
+		"www.example.test": net.ParseIP("192.0.2.1"),
+	})
+	internal := startFakeServer(t, map[string]net.IP{
+		"db.corp.test": net.ParseIP("10.0.0.1"),
+	})
+	r := New(Config{
+		Servers: []Server{public.server("udp")},
+		Rules: []Rule{{
+			Domains: []string{"corp.test"},
+			Servers: []Server{internal.server("tcp")},
+		}},
+		NegativeTTL: 50 * time.Millisecond,
+	})
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		addrs, err := r.LookupIPAddr(ctx, "WWW.example.test.")
+		require.NoError(err)
+		require.Len(addrs, 1)
+		require.Equal("192.0.2.1", addrs[0].IP.String())
+	}
+	require.Equal(int32(1), atomic.LoadInt32(&public.queries))
+
+	addrs, err := r.LookupIPAddr(ctx, "db.corp.test")
+	require.NoError(err)
+	require.Len(addrs, 1)
+	require.Equal("10.0.0.1", addrs[0].IP.String())
+	require.Equal(int32(1), atomic.LoadInt32(&internal.queries))
+
+	// Missing names are cached until the negative TTL expires
+	for i := 0; i < 2; i++ {
+		_, err = r.LookupIPAddr(ctx, "missing.corp.test")
+		var dnsErr *net.DNSError
+		require.True(errors.As(err, &dnsErr), err)
+		require.True(dnsErr.IsNotFound)
+	}
+	queries := atomic.LoadInt32(&internal.queries)
+	time.Sleep(100 * time.Millisecond)
+	_, err = r.LookupIPAddr(ctx, "missing.corp.test")
+	require.Error(err)
+	require.Greater(atomic.LoadInt32(&internal.queries), queries)
+
+	// Addresses are never looked up nor cached
+	addrs, err = r.LookupIPAddr(ctx, "127.0.0.1")
+	require.NoError(err)
+	require.Equal("127.0.0.1", addrs[0].IP.String())
+
+	stats := r.Stats()
+	require.Equal(uint64(2), stats.Hits)
+	require.Equal(uint64(4), stats.Misses)
+	require.Equal(3, stats.Entries)
+}
+
+func TestResolverRecordTTL(t *testing.T) {
+	require := require.New(t)
+	s := startFakeServer(t, map[string]net.IP{
+		"www.example.test": net.ParseIP("192.0.2.1"),
+	})
+	atomic.StoreUint32(&s.ttl, 1)
+	ctx := context.Background()
+	lookup := func(r *Resolver) {
+		addrs, err := r.LookupIPAddr(ctx, "www.example.test")
+		require.NoError(err)
+		require.Equal("192.0.2.1", addrs[0].IP.String())
+	}
+
+	// Answers are cached no longer than their records over either network
+	resolvers := []*Resolver{
+		New(Config{Servers: []Server{s.server("udp")}}),
+		New(Config{Servers: []Server{s.server("tcp")}}),
+	}
+	for _, r := range resolvers {
+		lookup(r)
+		lookup(r)
+	}
+	require.Equal(int32(2), atomic.LoadInt32(&s.queries))
+	time.Sleep(1100 * time.Millisecond)
+	for _, r := range resolvers {
+		lookup(r)
+	}
+	require.Equal(int32(4), atomic.LoadInt32(&s.queries))
+
+	// Nor longer than the configured TTL
+	r := New(Config{Servers: []Server{s.server("udp")}, TTL: 50 * time.Millisecond})
+	lookup(r)
+	time.Sleep(100 * time.Millisecond)
+	lookup(r)
+	require.Equal(int32(6), atomic.LoadInt32(&s.queries))
+}
+
+func TestPartialDeadline(t *testing.T) {
+	require := require.New(t)
+	now := time.Now()
+	for _, test := range []struct {
+		left      time.Duration
+		remaining int
+		expected  time.Duration
+	}{
+		{30 * time.Second, 3, 10 * time.Second},
+		{30 * time.Second, 1, 30 * time.Second},
+		{3 * time.Second, 3, 2 * time.Second},
+		{time.Second, 3, time.Second},
+		{-time.Second, 2, -time.Second},
+	} {
+		deadline := partialDeadline(now, now.Add(test.left), test.remaining)
+		require.Equal(test.expected, deadline.Sub(now), test)
+	}
+}
+
+func TestDialer(t *testing.T) {
+	require := require.New(t)
+	s := startFakeServer(t, map[string]net.IP{
+		"local.test": net.ParseIP("127.0.0.1"),
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			_ = c.Close()
+		}
+	}()
+
+	d := NewDialer(New(Config{Servers: []Server{s.server("udp")}}), nil)
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	c, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("local.test", port))
+	require.NoError(err)
+	require.Equal(l.Addr().String(), c.RemoteAddr().String())
+	require.NoError(c.Close())
+
+	_, err = d.DialContext(context.Background(), "tcp6", net.JoinHostPort("local.test", port))
+	require.Error(err)
+	_, err = d.DialContext(context.Background(), "tcp", net.JoinHostPort("missing.test", port))
+	var dnsErr *net.DNSError
+	require.True(errors.As(err, &dnsErr), err)
+}
+
+func TestParseServer(t *testing.T) {
+	require := require.New(t)
+	for s, expected := range map[string]Server{
+		"1.1.1.1":            {"udp", "1.1.1.1:53"},
+		"tcp://8.8.8.8:5353": {"tcp", "8.8.8.8:5353"},
+		"udp://[::1]":        {"udp", "[::1]:53"},
+		"2001:db8::1":        {"udp", "[2001:db8::1]:53"},
+	} {
+		server, err := ParseServer(s)
+		require.NoError(err, s)
+		require.Equal(expected, server, s)
+	}
+	for _, s := range []string{"https://1.1.1.1", "udp://", ""} {
+		_, err := ParseServer(s)
+		require.Error(err, s)
+	}
+}
@@ -5,13 +5,23 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/Frizz925/gilgamesh/dns"
+	"github.com/Frizz925/gilgamesh/metrics"
 	"github.com/Frizz925/gilgamesh/server"
+	"github.com/Frizz925/gilgamesh/usage"
 	"go.uber.org/zap"
 )
 
-const commandTLSReload = "TLS_RELOAD"
+const (
+	commandTLSReload  = "TLS_RELOAD"
+	commandDNSStats   = "DNS_STATS"
+	commandConnStats  = "CONN_STATS"
+	commandQuotaStats = "QUOTA_STATS"
+)
 
 type LoadCertificateFunc func() (tls.Certificate, error)
 
@@ -19,19 +29,34 @@ type Manager struct {
 	logger          *zap.Logger
 	server          *server.Server
 	loadCertificate LoadCertificateFunc
+	resolver        *dns.Resolver
+	quota           *usage.Quota
+	metrics         *metrics.Proxy
 }
 
 type Config struct {
 	Logger          *zap.Logger
 	Server          *server.Server
 	LoadCertificate LoadCertificateFunc
+	// Resolver reporting its cache stats, if any
+	Resolver *dns.Resolver
+	// Quota reporting the usage of each user, if any
+	Quota *usage.Quota
+	// Metrics counting TLS reloads, not exposed if nil
+	Metrics *metrics.Proxy
 }
 
 func New(cfg Config) *Manager {
+	if cfg.Metrics == nil {
+		cfg.Metrics = metrics.NewProxy(nil)
+	}
 	return &Manager{
 		logger:          cfg.Logger,
 		server:          cfg.Server,
 		loadCertificate: cfg.LoadCertificate,
+		resolver:        cfg.Resolver,
+		quota:           cfg.Quota,
+		metrics:         cfg.Metrics,
 	}
 }
 
@@ -54,12 +79,15 @@ func (m *Manager) Serve(l net.Listener) error {
 func (m *Manager) serveConn(log *zap.Logger, c net.Conn) {
 	var (
 		cmdOk  bool
+		result string
 		errMsg string
 	)
 	defer func() {
 		defer c.Close()
 		var res string
-		if cmdOk {
+		if cmdOk && result != "" {
+			res = fmt.Sprintf("OK %s\r\n", result)
+		} else if cmdOk {
 			res = "OK\r\n"
 		} else if errMsg != "" {
 			log.Error(errMsg)
@@ -90,18 +118,63 @@ func (m *Manager) serveConn(log *zap.Logger, c net.Conn) {
 		zap.String("cmd", cmd),
 		zap.Strings("args", args),
 	)
-	// For now we just handle TLS_RELOAD command
-	if cmd != commandTLSReload {
+	switch cmd {
+	case commandTLSReload:
+		if err := m.updateTLSConfig(); err != nil {
+			m.metrics.TLSReloads.With("error").Inc()
+			errMsg = fmt.Sprintf("Failed updating TLS config: %+v", err)
+			return
+		}
+		m.metrics.TLSReloads.With("ok").Inc()
+	case commandDNSStats:
+		if m.resolver == nil {
+			errMsg = "DNS resolver not enabled"
+			return
+		}
+		stats := m.resolver.Stats()
+		result = fmt.Sprintf("hits=%d misses=%d entries=%d", stats.Hits, stats.Misses, stats.Entries)
+	case commandConnStats:
+		counts := m.server.ConnCounts()
+		result = strings.Join(append(formatCounts("ip", counts.IPs), formatCounts("user", counts.Users)...), " ")
+	case commandQuotaStats:
+		if m.quota == nil {
+			errMsg = "Quota not enabled"
+			return
+		}
+		result = formatQuota(m.quota)
+	default:
 		errMsg = fmt.Sprintf("Unknown command '%s'", cmd)
 		return
 	}
-	if err := m.updateTLSConfig(); err != nil {
-		errMsg = fmt.Sprintf("Failed updating TLS config: %+v", err)
-		return
-	}
 	cmdOk = true
 }
 
+// formatCounts formats the counts as sorted "kind:key=count" fields.
+func formatCounts(kind string, counts map[string]int) []string {
+	fields := make([]string, 0, len(counts))
+	for k, v := range counts {
+		fields = append(fields, fmt.Sprintf("%s:%s=%d", kind, k, v))
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// formatQuota formats the next reset time followed by the sorted
+// "user=used/limit" fields of the users having used any of their quota.
+func formatQuota(q *usage.Quota) string {
+	fields := []string{"reset=" + q.Reset().Format(time.RFC3339)}
+	var users []string
+	stats := q.Stats()
+	for user := range stats {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		fields = append(fields, fmt.Sprintf("%s=%d/%d", user, stats[user].Used, stats[user].Limit))
+	}
+	return strings.Join(fields, " ")
+}
+
 func (m *Manager) updateTLSConfig() error {
 	cer, err := m.loadCertificate()
 	if err != nil {
@@ -2,6 +2,7 @@ package manager
 
 import (
 	"bufio"
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/tls"
@@ -10,10 +11,16 @@ import (
 	"errors"
 	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/Frizz925/gilgamesh/dns"
+	"github.com/Frizz925/gilgamesh/metrics"
 	"github.com/Frizz925/gilgamesh/server"
 	"github.com/Frizz925/gilgamesh/testutils/nettest"
+	"github.com/Frizz925/gilgamesh/usage"
 	"github.com/Frizz925/gilgamesh/worker"
 	"github.com/stretchr/testify/suite"
 	"go.uber.org/zap"
@@ -22,8 +29,11 @@ import (
 type ManagerTestSuite struct {
 	suite.Suite
 
-	logger *zap.Logger
-	server *server.Server
+	logger   *zap.Logger
+	server   *server.Server
+	resolver *dns.Resolver
+	quota    *usage.Quota
+	metrics  *metrics.Proxy
 }
 
 func TestManager(t *testing.T) {
@@ -38,6 +48,11 @@ func (suite *ManagerTestSuite) SetupSuite() {
 }
 
 func (suite *ManagerTestSuite) SetupTest() {
+	suite.resolver = dns.New(dns.Config{})
+	quota, err := usage.NewQuota(usage.QuotaConfig{Default: 1000})
+	suite.Require().NoError(err)
+	suite.quota = quota
+	suite.metrics = metrics.NewProxy(nil)
 	suite.server = server.New(server.Config{
 		Logger: suite.logger,
 		WorkerConfig: worker.Config{
@@ -60,6 +75,59 @@ func (suite *ManagerTestSuite) TestTLSReload() {
 	res, err := sendCommand(c, commandTLSReload)
 	assert.NoError(err)
 	assert.Equal("OK", res)
+	assert.Contains(suite.scrapeMetrics(), `gilgamesh_tls_reloads_total{result="ok"} 1`)
+	assert.NoError(c.Close())
+	assert.NoError(l.Close())
+}
+
+func (suite *ManagerTestSuite) TestDNSStats() {
+	assert := suite.Assert()
+	for i := 0; i < 2; i++ {
+		_, err := suite.resolver.LookupIPAddr(context.Background(), "localhost")
+		assert.NoError(err)
+	}
+	l, c := suite.startManager()
+	res, err := sendCommand(c, commandDNSStats)
+	assert.NoError(err)
+	assert.Equal("OK hits=1 misses=1 entries=1", res)
+	assert.NoError(c.Close())
+	assert.NoError(l.Close())
+}
+
+func (suite *ManagerTestSuite) TestConnStats() {
+	require := suite.Require()
+	pl, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer pl.Close()
+	go func() {
+		_ = suite.server.Serve(pl)
+	}()
+	pc, err := net.Dial("tcp", pl.Addr().String())
+	require.NoError(err)
+	defer pc.Close()
+
+	// The proxy counts the connection once it has accepted it
+	require.Eventually(func() bool {
+		return len(suite.server.ConnCounts().IPs) > 0
+	}, time.Second, 10*time.Millisecond)
+	l, c := suite.startManager()
+	res, err := sendCommand(c, commandConnStats)
+	require.NoError(err)
+	require.Equal("OK ip:127.0.0.1=1", res)
+	require.NoError(c.Close())
+	require.NoError(l.Close())
+}
+
+func (suite *ManagerTestSuite) TestQuotaStats() {
+	assert := suite.Assert()
+	suite.quota.User("bob").Add(20)
+	suite.quota.User("alice").Add(1500)
+	suite.quota.User("carol")
+	l, c := suite.startManager()
+	res, err := sendCommand(c, commandQuotaStats)
+	assert.NoError(err)
+	reset := suite.quota.Reset().Format(time.RFC3339)
+	assert.Equal("OK reset="+reset+" alice=1500/1000 bob=20/1000", res)
 	assert.NoError(c.Close())
 	assert.NoError(l.Close())
 }
@@ -90,6 +158,7 @@ func (suite *ManagerTestSuite) TestTLSReloadError() {
 	res, err := sendCommand(c, commandTLSReload)
 	assert.NoError(err)
 	assert.Equal("ERROR Failed updating TLS config: "+expectedErr.Error(), res)
+	assert.Contains(suite.scrapeMetrics(), `gilgamesh_tls_reloads_total{result="error"} 1`)
 	assert.NoError(c.Close())
 	assert.NoError(l.Close())
 }
@@ -103,6 +172,9 @@ func (suite *ManagerTestSuite) startManager(loader ...LoadCertificateFunc) (net.
 		Logger:          suite.logger,
 		Server:          suite.server,
 		LoadCertificate: lc,
+		Resolver:        suite.resolver,
+		Quota:           suite.quota,
+		Metrics:         suite.metrics,
 	})
 	l, c := nettest.NewListener()
 	go func() {
@@ -114,6 +186,12 @@ func (suite *ManagerTestSuite) startManager(loader ...LoadCertificateFunc) (net.
 	return l, c
 }
 
+func (suite *ManagerTestSuite) scrapeMetrics() string {
+	rec := httptest.NewRecorder()
+	suite.metrics.Registry.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	return rec.Body.String()
+}
+
 func sendCommand(c net.Conn, cmd string) (string, error) {
 	bw := bufio.NewWriter(c)
 	if _, err := bw.WriteString(cmd + "\r\n"); err != nil {
@@ -0,0 +1,318 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Registry holds metrics and writes them in the Prometheus text format.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+type collector interface {
+	write(bw *bufio.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// ServeHTTP writes every metric in the order they were registered.
+func (r *Registry) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+	bw := bufio.NewWriter(rw)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	_ = bw.Flush()
+}
+
+// desc names a metric family and its labels.
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) writeHeader(bw *bufio.Writer) {
+	fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", d.name, escapeHelp(d.help), d.name, d.typ)
+}
+
+// series returns the labels of a series as written within braces.
+func (d *desc) series(values []string, extra ...string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("%s expects %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	pairs := make([]string, 0, len(values)+len(extra)/2)
+	for i, v := range values {
+		pairs = append(pairs, d.labels[i]+"="+quoteLabel(v))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+quoteLabel(extra[i+1]))
+	}
+	if len(pairs) <= 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// value is a float64 updated atomically.
+type value struct {
+	bits uint64
+}
+
+func (v *value) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		next := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, next) {
+			return
+		}
+	}
+}
+
+func (v *value) set(f float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(f))
+}
+
+func (v *value) get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// vec holds the series of a metric family by their label values.
+type vec struct {
+	desc
+	mu     sync.Mutex
+	series map[string]interface{}
+	values map[string][]string
+}
+
+func newVec(d desc) vec {
+	return vec{
+		desc:   d,
+		series: make(map[string]interface{}),
+		values: make(map[string][]string),
+	}
+}
+
+func (v *vec) with(values []string, create func() interface{}) interface{} {
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, ok := v.series[key]
+	if !ok {
+		// Fails early on a wrong number of label values
+		v.desc.series(values)
+		s = create()
+		v.series[key] = s
+		v.values[key] = append([]string(nil), values...)
+	}
+	return s
+}
+
+// each calls fn with every series sorted by label values.
+func (v *vec) each(fn func(values []string, s interface{})) {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	series := make([]interface{}, len(keys))
+	values := make([][]string, len(keys))
+	for i, k := range keys {
+		series[i], values[i] = v.series[k], v.values[k]
+	}
+	v.mu.Unlock()
+	for i := range keys {
+		fn(values[i], series[i])
+	}
+}
+
+// Counter only ever goes up.
+type Counter struct {
+	v value
+}
+
+func (c *Counter) Inc() {
+	c.v.add(1)
+}
+
+func (c *Counter) Add(delta float64) {
+	if delta > 0 {
+		c.v.add(delta)
+	}
+}
+
+type CounterVec struct {
+	vec
+}
+
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	cv := &CounterVec{newVec(desc{name: name, help: help, typ: "counter", labels: labels})}
+	r.register(cv)
+	return cv
+}
+
+// With returns the counter of the given label values, in the order of the
+// labels.
+func (cv *CounterVec) With(values ...string) *Counter {
+	return cv.with(values, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+func (cv *CounterVec) write(bw *bufio.Writer) {
+	cv.writeHeader(bw)
+	cv.each(func(values []string, s interface{}) {
+		fmt.Fprintf(bw, "%s%s %s\n", cv.name, cv.desc.series(values), formatFloat(s.(*Counter).v.get()))
+	})
+}
+
+// Gauge goes up and down.
+type Gauge struct {
+	v value
+}
+
+func (g *Gauge) Inc() {
+	g.v.add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.v.add(-1)
+}
+
+func (g *Gauge) Set(f float64) {
+	g.v.set(f)
+}
+
+type GaugeVec struct {
+	vec
+}
+
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	gv := &GaugeVec{newVec(desc{name: name, help: help, typ: "gauge", labels: labels})}
+	r.register(gv)
+	return gv
+}
+
+func (gv *GaugeVec) With(values ...string) *Gauge {
+	return gv.with(values, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+
+func (gv *GaugeVec) write(bw *bufio.Writer) {
+	gv.writeHeader(bw)
+	gv.each(func(values []string, s interface{}) {
+		fmt.Fprintf(bw, "%s%s %s\n", gv.name, gv.desc.series(values), formatFloat(s.(*Gauge).v.get()))
+	})
+}
+
+type gaugeFunc struct {
+	desc
+	fn func() float64
+}
+
+// GaugeFunc registers a gauge whose value is read from fn when written.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.register(&gaugeFunc{desc{name: name, help: help, typ: "gauge"}, fn})
+}
+
+func (gf *gaugeFunc) write(bw *bufio.Writer) {
+	gf.writeHeader(bw)
+	fmt.Fprintf(bw, "%s %s\n", gf.name, formatFloat(gf.fn()))
+}
+
+// Histogram counts observations into buckets of upper bounds.
+type Histogram struct {
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    value
+}
+
+func (h *Histogram) Observe(f float64) {
+	i := sort.SearchFloat64s(h.bounds, f)
+	if i < len(h.counts) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	atomic.AddUint64(&h.count, 1)
+	h.sum.add(f)
+}
+
+type HistogramVec struct {
+	vec
+	bounds []float64
+}
+
+// Histogram registers a histogram of the given sorted bucket upper bounds,
+// the +Inf bucket being implied.
+func (r *Registry) Histogram(name, help string, bounds []float64, labels ...string) *HistogramVec {
+	hv := &HistogramVec{
+		vec:    newVec(desc{name: name, help: help, typ: "histogram", labels: labels}),
+		bounds: bounds,
+	}
+	r.register(hv)
+	return hv
+}
+
+func (hv *HistogramVec) With(values ...string) *Histogram {
+	return hv.with(values, func() interface{} {
+		return &Histogram{bounds: hv.bounds, counts: make([]uint64, len(hv.bounds))}
+	}).(*Histogram)
+}
+
+func (hv *HistogramVec) write(bw *bufio.Writer) {
+	hv.writeHeader(bw)
+	hv.each(func(values []string, s interface{}) {
+		h := s.(*Histogram)
+		var cumulative uint64
+		for i, bound := range h.bounds {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			fmt.Fprintf(bw, "%s_bucket%s %d\n", hv.name, hv.desc.series(values, "le", formatFloat(bound)), cumulative)
+		}
+		count := atomic.LoadUint64(&h.count)
+		fmt.Fprintf(bw, "%s_bucket%s %d\n", hv.name, hv.desc.series(values, "le", "+Inf"), count)
+		fmt.Fprintf(bw, "%s_sum%s %s\n", hv.name, hv.desc.series(values), formatFloat(h.sum.get()))
+		fmt.Fprintf(bw, "%s_count%s %d\n", hv.name, hv.desc.series(values), count)
+	})
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func quoteLabel(s string) string {
+	return `"` + labelEscaper.Replace(s) + `"`
+}
@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	require := require.New(t)
+	r := NewRegistry()
+	requests := r.Counter("requests_total", "Requests served.", "code")
+	requests.With("200").Inc()
+	requests.With("200").Add(2)
+	requests.With("404").Inc()
+	// Counters never go down
+	requests.With("404").Add(-1)
+	active := r.Gauge("active", "Open connections.\nSecond line.", "listener")
+	active.With(`a"b\c`).Inc()
+	active.With("http").Set(3)
+	active.With("http").Dec()
+	r.GaugeFunc("busy", "Busy workers.", func() float64 { return 7 })
+	latency := r.Histogram("latency_seconds", "Dial latency.", []float64{0.1, 1}, "result")
+	latency.With("ok").Observe(0.05)
+	latency.With("ok").Observe(0.5)
+	latency.With("ok").Observe(2)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal("text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	require.Equal(`# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{code="200"} 3
+requests_total{code="404"} 1
+# HELP active Open connections.\nSecond line.
+# TYPE active gauge
+active{listener="a\"b\\c"} 1
+active{listener="http"} 2
+# HELP busy Busy workers.
+# TYPE busy gauge
+busy 7
+# HELP latency_seconds Dial latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{result="ok",le="0.1"} 1
+latency_seconds_bucket{result="ok",le="1"} 2
+latency_seconds_bucket{result="ok",le="+Inf"} 3
+latency_seconds_sum{result="ok"} 2.55
+latency_seconds_count{result="ok"} 3
+`, rec.Body.String())
+
+	require.Panics(func() {
+		requests.With("200", "extra")
+	})
+}
@@ -0,0 +1,89 @@
+package metrics
+
+import "sync"
+
+// Upper bounds in seconds of the dial latency buckets
+var DialLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Proxy holds the metrics reported by the server, its workers and the
+// manager.
+type Proxy struct {
+	Registry *Registry
+
+	// Open client connections by listener type
+	ActiveConns *GaugeVec
+	// Requests by protocol and the status code or SOCKS reply answering them
+	Outcomes *CounterVec
+	// Failed authentications by reason
+	AuthFailures *CounterVec
+	// Time taken to dial destinations and upstream proxies by result
+	DialLatency *HistogramVec
+	// Bytes relayed by direction, upload being from the client
+	Bytes *CounterVec
+	// Reloads of the TLS certificate by result
+	TLSReloads *CounterVec
+
+	pools *poolSet
+}
+
+// Pool is a worker pool reporting its utilization.
+type Pool interface {
+	Size() int
+	Busy() int
+}
+
+// poolSet adds up the utilization of the worker pools of every server
+// sharing the metrics.
+type poolSet struct {
+	mu    sync.Mutex
+	pools map[Pool]struct{}
+}
+
+func (ps *poolSet) sum(fn func(p Pool) int) func() float64 {
+	return func() float64 {
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+		var n int
+		for p := range ps.pools {
+			n += fn(p)
+		}
+		return float64(n)
+	}
+}
+
+// NewProxy registers the proxy metrics, to a registry of their own if nil
+// for the metrics to be recorded without being exposed.
+func NewProxy(r *Registry) *Proxy {
+	if r == nil {
+		r = NewRegistry()
+	}
+	pools := &poolSet{pools: make(map[Pool]struct{})}
+	r.GaugeFunc("gilgamesh_worker_pool_size", "Workers pre-allocated to the pools, zero if they grow as needed.",
+		pools.sum(Pool.Size))
+	r.GaugeFunc("gilgamesh_worker_pool_busy", "Workers taken out of the pools to serve connections.",
+		pools.sum(Pool.Busy))
+	return &Proxy{
+		Registry:     r,
+		ActiveConns:  r.Gauge("gilgamesh_active_connections", "Client connections currently open.", "listener"),
+		Outcomes:     r.Counter("gilgamesh_requests_total", "Requests served by protocol and response code.", "protocol", "code"),
+		AuthFailures: r.Counter("gilgamesh_auth_failures_total", "Failed client authentications.", "reason"),
+		DialLatency: r.Histogram("gilgamesh_dial_duration_seconds", "Time taken to dial destinations.",
+			DialLatencyBuckets, "result"),
+		Bytes:      r.Counter("gilgamesh_bytes_total", "Bytes relayed between clients and destinations.", "direction"),
+		TLSReloads: r.Counter("gilgamesh_tls_reloads_total", "Reloads of the TLS certificate.", "result"),
+		pools:      pools,
+	}
+}
+
+// AddPool adds the utilization of the pool to the pool gauges until the
+// returned function is called.
+func (p *Proxy) AddPool(pool Pool) (remove func()) {
+	p.pools.mu.Lock()
+	p.pools.pools[pool] = struct{}{}
+	p.pools.mu.Unlock()
+	return func() {
+		p.pools.mu.Lock()
+		delete(p.pools.pools, pool)
+		p.pools.mu.Unlock()
+	}
+}
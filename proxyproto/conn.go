@@ -0,0 +1,33 @@
+package proxyproto
+
+import "net"
+
+// Conn reports the client address carried in the PROXY protocol header in
+// place of the one of the underlying connection. The local address is kept
+// since it is the one the proxy can actually bind to.
+type Conn struct {
+	net.Conn
+	header *Header
+}
+
+// NewConn wraps the connection the header has been read from. Headers
+// without addresses leave the connection untouched.
+func NewConn(c net.Conn, h *Header) *Conn {
+	return &Conn{Conn: c, header: h}
+}
+
+func (c *Conn) Header() *Header {
+	return c.header
+}
+
+// NetConn returns the underlying connection, such as to reach its socket.
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
@@ -0,0 +1,268 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	Version1 = 0x01
+	Version2 = 0x02
+)
+
+// Version 2 commands
+const (
+	CmdLocal = 0x00
+	CmdProxy = 0x01
+)
+
+// Version 2 address families and transport protocols
+const (
+	FamilyUnspec = 0x00
+	FamilyTCP4   = 0x11
+	FamilyTCP6   = 0x21
+)
+
+// The longest version 1 header, including the CRLF
+const maxV1Length = 107
+
+var (
+	signatureV1 = []byte("PROXY")
+	signatureV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+var (
+	ErrNoHeader      = errors.New("no PROXY protocol header")
+	ErrMalformed     = errors.New("malformed PROXY protocol header")
+	ErrLineTooLong   = errors.New("PROXY protocol header too long")
+	ErrUnsupportedV2 = errors.New("unsupported PROXY protocol version or command")
+)
+
+// Header is a PROXY protocol header as sent by load balancers in front of
+// the connection. Source and Destination are nil for connections made by
+// the balancer itself and for address families other than TCP.
+type Header struct {
+	Version     byte
+	Local       bool
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+}
+
+// NewHeader returns a header for a connection proxied from the source to the
+// destination. Addresses other than TCP ones are sent as unknown.
+func NewHeader(version byte, src, dst net.Addr) *Header {
+	h := &Header{Version: version}
+	sa, sok := src.(*net.TCPAddr)
+	da, dok := dst.(*net.TCPAddr)
+	if sok && dok {
+		h.Source, h.Destination = sa, da
+	}
+	return h
+}
+
+// Append encodes the header in its version into the buffer.
+func (h *Header) Append(b []byte) []byte {
+	if h.Version == Version1 {
+		return h.appendV1(b)
+	}
+	return h.appendV2(b)
+}
+
+func (h *Header) appendV1(b []byte) []byte {
+	b = append(b, signatureV1...)
+	src, dst, ipv4 := h.addrs()
+	switch {
+	case src == nil:
+		return append(b, " UNKNOWN\r\n"...)
+	case ipv4:
+		b = append(b, " TCP4 "...)
+		b = append(b, src.String()...)
+		b = append(b, ' ')
+		b = append(b, dst.String()...)
+	default:
+		b = append(b, " TCP6 "...)
+		b = appendIPv6(b, src)
+		b = append(b, ' ')
+		b = appendIPv6(b, dst)
+	}
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(h.Source.Port), 10)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(h.Destination.Port), 10)
+	return append(b, "\r\n"...)
+}
+
+func (h *Header) appendV2(b []byte) []byte {
+	b = append(b, signatureV2...)
+	if h.Local {
+		return append(b, Version2<<4|CmdLocal, FamilyUnspec, 0, 0)
+	}
+	src, dst, ipv4 := h.addrs()
+	switch {
+	case src == nil:
+		return append(b, Version2<<4|CmdProxy, FamilyUnspec, 0, 0)
+	case ipv4:
+		b = append(b, Version2<<4|CmdProxy, FamilyTCP4, 0, 2*net.IPv4len+4)
+	default:
+		b = append(b, Version2<<4|CmdProxy, FamilyTCP6, 0, 2*net.IPv6len+4)
+	}
+	b = append(b, src...)
+	b = append(b, dst...)
+	b = append(b, byte(h.Source.Port>>8), byte(h.Source.Port))
+	return append(b, byte(h.Destination.Port>>8), byte(h.Destination.Port))
+}
+
+// appendIPv6 keeps IPv4-mapped addresses in IPv6 notation, which is what
+// TCP6 lines are required to carry.
+func appendIPv6(b []byte, ip net.IP) []byte {
+	if v4 := ip.To4(); v4 != nil {
+		b = append(b, "::ffff:"...)
+		return append(b, v4.String()...)
+	}
+	return append(b, ip.String()...)
+}
+
+// addrs returns both IPs in the same family, nil if there are none.
+func (h *Header) addrs() (src, dst net.IP, ipv4 bool) {
+	if h.Source == nil || h.Destination == nil {
+		return nil, nil, false
+	}
+	src, dst = h.Source.IP.To4(), h.Destination.IP.To4()
+	if src != nil && dst != nil {
+		return src, dst, true
+	}
+	src, dst = h.Source.IP.To16(), h.Destination.IP.To16()
+	if src == nil || dst == nil {
+		return nil, nil, false
+	}
+	return src, dst, false
+}
+
+// ReadHeader decodes either version of the header from the reader. It never
+// reads past the end of the header, so the reader may be the connection.
+func ReadHeader(r io.Reader) (*Header, error) {
+	var b [16]byte
+	if _, err := io.ReadFull(r, b[:len(signatureV1)]); err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(b[:len(signatureV1)], signatureV1):
+		return readV1(r)
+	case bytes.Equal(b[:len(signatureV1)], signatureV2[:len(signatureV1)]):
+		if _, err := io.ReadFull(r, b[len(signatureV1):]); err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(b[:len(signatureV2)], signatureV2) {
+			return nil, ErrNoHeader
+		}
+		return readV2(r, b[12:])
+	}
+	return nil, ErrNoHeader
+}
+
+func readV1(r io.Reader) (*Header, error) {
+	// Read byte by byte so nothing following the header gets consumed
+	line := make([]byte, 0, maxV1Length)
+	line = append(line, signatureV1...)
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+		if b[0] == '\n' {
+			break
+		}
+		if len(line) >= maxV1Length {
+			return nil, ErrLineTooLong
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrMalformed
+	}
+
+	h := &Header{Version: Version1}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 {
+		return nil, ErrMalformed
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return h, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, ErrMalformed
+	}
+	if len(fields) != 6 {
+		return nil, ErrMalformed
+	}
+	var err error
+	if h.Source, err = parseV1Addr(fields[2], fields[4]); err != nil {
+		return nil, err
+	}
+	if h.Destination, err = parseV1Addr(fields[3], fields[5]); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func parseV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, ErrMalformed
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readV2(r io.Reader, b []byte) (*Header, error) {
+	verCmd, family := b[0], b[1]
+	if verCmd>>4 != Version2 {
+		return nil, ErrUnsupportedV2
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(b[2:4]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	h := &Header{Version: Version2}
+	switch verCmd & 0x0f {
+	case CmdLocal:
+		h.Local = true
+		return h, nil
+	case CmdProxy:
+	default:
+		return nil, ErrUnsupportedV2
+	}
+
+	// Any TLVs following the addresses are ignored
+	var n int
+	switch family {
+	case FamilyTCP4:
+		n = net.IPv4len
+	case FamilyTCP6:
+		n = net.IPv6len
+	default:
+		return h, nil
+	}
+	if len(payload) < 2*n+4 {
+		return nil, ErrMalformed
+	}
+	h.Source = &net.TCPAddr{
+		IP:   net.IP(payload[:n]),
+		Port: int(binary.BigEndian.Uint16(payload[2*n:])),
+	}
+	h.Destination = &net.TCPAddr{
+		IP:   net.IP(payload[n : 2*n]),
+		Port: int(binary.BigEndian.Uint16(payload[2*n+2:])),
+	}
+	return h, nil
+}
@@ -0,0 +1,130 @@
+package proxyproto
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadHeaderV1(t *testing.T) {
+	require := require.New(t)
+	r := bytes.NewReader([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET /"))
+	h, err := ReadHeader(r)
+	require.NoError(err)
+	require.Equal(byte(Version1), h.Version)
+	require.Equal("192.0.2.1:56324", h.Source.String())
+	require.Equal("198.51.100.1:443", h.Destination.String())
+
+	// Nothing past the header is consumed
+	rest, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	require.Equal("GET /", string(rest))
+}
+
+func TestReadHeaderV1TCP6(t *testing.T) {
+	require := require.New(t)
+	h, err := ReadHeader(bytes.NewReader([]byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n")))
+	require.NoError(err)
+	require.Equal("[2001:db8::1]:56324", h.Source.String())
+	require.Equal("[2001:db8::2]:443", h.Destination.String())
+}
+
+func TestReadHeaderV1Unknown(t *testing.T) {
+	require := require.New(t)
+	h, err := ReadHeader(bytes.NewReader([]byte("PROXY UNKNOWN\r\n")))
+	require.NoError(err)
+	require.Nil(h.Source)
+	require.Nil(h.Destination)
+}
+
+func TestReadHeaderV1Malformed(t *testing.T) {
+	require := require.New(t)
+	for _, line := range []string{
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+		"PROXY TCP4 example.com 198.51.100.1 56324 443\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 65536\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n",
+		"PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+	} {
+		_, err := ReadHeader(bytes.NewReader([]byte(line)))
+		require.Equal(ErrMalformed, err, line)
+	}
+	_, err := ReadHeader(bytes.NewReader(bytes.Repeat([]byte("PROXY "), 20)))
+	require.Equal(ErrLineTooLong, err)
+}
+
+func TestReadHeaderV2(t *testing.T) {
+	require := require.New(t)
+	b := append([]byte(nil), signatureV2...)
+	b = append(b, Version2<<4|CmdProxy, FamilyTCP4, 0, 15)
+	b = append(b, 192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb)
+	// TLV to be skipped
+	b = append(b, 0x01, 0x00, 0x00)
+	b = append(b, "GET /"...)
+
+	r := bytes.NewReader(b)
+	h, err := ReadHeader(r)
+	require.NoError(err)
+	require.Equal(byte(Version2), h.Version)
+	require.False(h.Local)
+	require.Equal("192.0.2.1:56324", h.Source.String())
+	require.Equal("198.51.100.1:443", h.Destination.String())
+	rest, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	require.Equal("GET /", string(rest))
+}
+
+func TestReadHeaderV2Local(t *testing.T) {
+	require := require.New(t)
+	b := append([]byte(nil), signatureV2...)
+	b = append(b, Version2<<4|CmdLocal, FamilyUnspec, 0, 0)
+	h, err := ReadHeader(bytes.NewReader(b))
+	require.NoError(err)
+	require.True(h.Local)
+	require.Nil(h.Source)
+}
+
+func TestReadHeaderMissing(t *testing.T) {
+	require := require.New(t)
+	_, err := ReadHeader(bytes.NewReader([]byte("GET / HTTP/1.1\r\n")))
+	require.Equal(ErrNoHeader, err)
+}
+
+func TestConn(t *testing.T) {
+	require := require.New(t)
+	c, _ := net.Pipe()
+	src := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 56324}
+	require.Equal(src, NewConn(c, &Header{Source: src}).RemoteAddr())
+	require.Equal(c.RemoteAddr(), NewConn(c, &Header{Local: true}).RemoteAddr())
+	require.Equal(c, NewConn(c, &Header{Local: true}).NetConn())
+}
+
+func TestHeaderAppend(t *testing.T) {
+	require := require.New(t)
+	src := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 56324}
+	dst := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 443}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+
+	b := NewHeader(Version1, src, dst).Append(nil)
+	require.Equal("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", string(b))
+	b = NewHeader(Version1, src6, dst).Append(nil)
+	require.Equal("PROXY TCP6 2001:db8::1 ::ffff:198.51.100.1 56324 443\r\n", string(b))
+	b = NewHeader(Version1, &net.UnixAddr{}, dst).Append(nil)
+	require.Equal("PROXY UNKNOWN\r\n", string(b))
+
+	for _, h := range []*Header{
+		NewHeader(Version2, src, dst),
+		NewHeader(Version2, src6, dst),
+		NewHeader(Version1, src6, dst),
+	} {
+		r, err := ReadHeader(bytes.NewReader(h.Append(nil)))
+		require.NoError(err)
+		require.True(h.Source.IP.Equal(r.Source.IP))
+		require.Equal(h.Source.Port, r.Source.Port)
+		require.True(h.Destination.IP.Equal(r.Destination.IP))
+		require.Equal(h.Destination.Port, r.Destination.Port)
+	}
+}
@@ -0,0 +1,105 @@
+package ratelimit
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket refilled at a constant rate of tokens per second
+// and shared by any number of goroutines. A nil bucket never limits.
+type Bucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a full bucket holding up to burst tokens, one second
+// worth of tokens if burst is not positive.
+func NewBucket(rate, burst int64) *Bucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	// Reads limited to the burst size must still make progress
+	if burst < 1 {
+		burst = 1
+	}
+	return &Bucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait takes n tokens from the bucket, blocking until the bucket has been
+// refilled enough to pay for them.
+func (b *Bucket) Wait(n int) {
+	if d := b.reserve(n); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// reserve takes the tokens right away, going into debt if the bucket does
+// not hold enough, and returns how long to wait for the debt to be repaid.
+func (b *Bucket) reserve(n int) time.Duration {
+	if b == nil || n <= 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// full reports whether the bucket has been refilled by now, which a nil
+// bucket always is.
+func (b *Bucket) full(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// Reader returns a reader paying for the bytes read from r with tokens of
+// the bucket. Reads are capped to the burst size so no single read waits
+// for much longer than a second.
+func (b *Bucket) Reader(r io.Reader) io.Reader {
+	if b == nil {
+		return r
+	}
+	return &bucketReader{r: r, b: b}
+}
+
+// Limit caps the size of the buffer to the burst size of the bucket.
+func (b *Bucket) Limit(buf []byte) []byte {
+	if b != nil && float64(len(buf)) > b.burst {
+		return buf[:int(b.burst)]
+	}
+	return buf
+}
+
+type bucketReader struct {
+	r io.Reader
+	b *Bucket
+}
+
+func (br *bucketReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(br.b.Limit(p))
+	br.b.Wait(n)
+	return n, err
+}
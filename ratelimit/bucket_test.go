@@ -0,0 +1,99 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucket(t *testing.T) {
+	require := require.New(t)
+	b := NewBucket(1000, 100)
+
+	// The burst is paid for right away, the rest at the bucket rate
+	start := time.Now()
+	b.Wait(100)
+	require.Less(int64(time.Since(start)), int64(20*time.Millisecond))
+	b.Wait(100)
+	require.GreaterOrEqual(int64(time.Since(start)), int64(80*time.Millisecond))
+
+	require.Len(b.Limit(make([]byte, 1000)), 100)
+	require.Len(b.Limit(make([]byte, 10)), 10)
+
+	start = time.Now()
+	data, err := ioutil.ReadAll(b.Reader(bytes.NewReader(make([]byte, 200))))
+	require.NoError(err)
+	require.Len(data, 200)
+	require.GreaterOrEqual(int64(time.Since(start)), int64(150*time.Millisecond))
+
+	// Nil buckets never limit
+	var nb *Bucket
+	nb.Wait(1 << 30)
+	require.Len(nb.Limit(make([]byte, 1000)), 1000)
+}
+
+func TestThrottle(t *testing.T) {
+	require := require.New(t)
+	th := NewThrottle(ThrottleConfig{
+		Default: Limits{Download: 1000},
+		Users: map[string]Limits{
+			"alice": {Upload: 500},
+		},
+	})
+
+	up, down := th.Buckets("alice")
+	require.NotNil(up)
+	require.Nil(down)
+	// Connections of the same user share the buckets
+	up2, _ := th.Buckets("alice")
+	require.Same(up, up2)
+
+	up, down = th.Buckets("bob")
+	require.Nil(up)
+	require.NotNil(down)
+	_, down2 := th.Buckets("carol")
+	require.NotSame(down, down2)
+
+	var nt *Throttle
+	up, down = nt.Buckets("alice")
+	require.Nil(up)
+	require.Nil(down)
+}
+
+func TestThrottleClients(t *testing.T) {
+	require := require.New(t)
+	th := NewThrottle(ThrottleConfig{
+		Default: Limits{Upload: 1000, Download: 1000},
+		Users: map[string]Limits{
+			"alice": {Upload: 500},
+		},
+	})
+
+	// Anonymous clients are limited per address rather than all together
+	up, down := th.ClientBuckets("192.0.2.1")
+	require.NotNil(up)
+	require.NotNil(down)
+	up2, _ := th.ClientBuckets("192.0.2.1")
+	require.Same(up, up2)
+	up3, _ := th.ClientBuckets("192.0.2.2")
+	require.NotSame(up, up3)
+	// Nor do they share the buckets of the users
+	up4, _ := th.Buckets("")
+	require.NotSame(up, up4)
+
+	// Buckets of the clients are swept once refilled
+	up.Wait(1000)
+	th.lastSweep = time.Now().Add(-sweepInterval)
+	up5, _ := th.ClientBuckets("192.0.2.1")
+	require.Same(up, up5)
+	_, ok := th.clients["192.0.2.2"]
+	require.False(ok)
+
+	var nt *Throttle
+	up, down = nt.ClientBuckets("192.0.2.1")
+	require.Nil(up)
+	require.Nil(down)
+}
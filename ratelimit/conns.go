@@ -0,0 +1,65 @@
+package ratelimit
+
+import "sync"
+
+// ConnLimit counts the connections open under each key, such as a client
+// address or user name, refusing new ones once a key reaches the maximum.
+// A nil limit never refuses nor counts.
+type ConnLimit struct {
+	max int
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// NewConnLimit returns a limit of max connections per key, zero meaning the
+// connections are only counted.
+func NewConnLimit(max int) *ConnLimit {
+	return &ConnLimit{
+		max:    max,
+		counts: make(map[string]int),
+	}
+}
+
+// Acquire counts a new connection under the key, reporting false without
+// counting it if the key already reached the maximum.
+func (l *ConnLimit) Acquire(key string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.counts[key] >= l.max {
+		return false
+	}
+	l.counts[key]++
+	return true
+}
+
+// Release uncounts a connection acquired under the key.
+func (l *ConnLimit) Release(key string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counts[key] <= 1 {
+		delete(l.counts, key)
+		return
+	}
+	l.counts[key]--
+}
+
+// Counts returns a snapshot of the keys having connections open.
+func (l *ConnLimit) Counts() map[string]int {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	counts := make(map[string]int, len(l.counts))
+	for k, v := range l.counts {
+		counts[k] = v
+	}
+	return counts
+}
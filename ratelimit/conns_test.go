@@ -0,0 +1,34 @@
+package ratelimit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnLimit(t *testing.T) {
+	require := require.New(t)
+	l := NewConnLimit(2)
+	require.True(l.Acquire("alice"))
+	require.True(l.Acquire("alice"))
+	require.False(l.Acquire("alice"))
+	require.True(l.Acquire("bob"))
+	require.Equal(map[string]int{"alice": 2, "bob": 1}, l.Counts())
+
+	l.Release("alice")
+	require.True(l.Acquire("alice"))
+	l.Release("bob")
+	require.Equal(map[string]int{"alice": 2}, l.Counts())
+
+	// Zero maximum only counts
+	l = NewConnLimit(0)
+	for i := 0; i < 10; i++ {
+		require.True(l.Acquire("alice"))
+	}
+	require.Equal(10, l.Counts()["alice"])
+
+	var nl *ConnLimit
+	require.True(nl.Acquire("alice"))
+	nl.Release("alice")
+	require.Nil(nl.Counts())
+}
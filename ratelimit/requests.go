@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Buckets idle for this long are swept once refilled
+const sweepInterval = time.Minute
+
+// RequestLimit allows each key, such as a client address or user name, a
+// number of requests per second with bursts of up to its burst size. A nil
+// limit allows every request.
+type RequestLimit struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*requestBucket
+	lastSweep time.Time
+}
+
+type requestBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRequestLimit returns a limit of rate requests per second, which must be
+// positive, allowing bursts of up to one second worth of requests if burst
+// is not positive.
+func NewRequestLimit(rate float64, burst int) *RequestLimit {
+	b := float64(burst)
+	if b <= 0 {
+		b = rate
+	}
+	if b < 1 {
+		b = 1
+	}
+	return &RequestLimit{
+		rate:      rate,
+		burst:     b,
+		buckets:   make(map[string]*requestBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow counts a request of the key, returning zero if allowed or else how
+// long to wait before the next request would be.
+func (l *RequestLimit) Allow(key string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &requestBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+// sweep forgets the buckets which have been refilled since they were last
+// used, keeping the number of buckets in check.
+func (l *RequestLimit) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+}
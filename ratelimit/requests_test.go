@@ -0,0 +1,29 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestLimit(t *testing.T) {
+	require := require.New(t)
+	l := NewRequestLimit(10, 2)
+	require.Zero(l.Allow("alice"))
+	require.Zero(l.Allow("alice"))
+	d := l.Allow("alice")
+	require.Greater(int64(d), int64(0))
+	require.LessOrEqual(int64(d), int64(100*time.Millisecond))
+	// Keys are limited separately
+	require.Zero(l.Allow("bob"))
+
+	time.Sleep(d)
+	require.Zero(l.Allow("alice"))
+	require.NotZero(l.Allow("alice"))
+
+	var nl *RequestLimit
+	for i := 0; i < 10; i++ {
+		require.Zero(nl.Allow("alice"))
+	}
+}
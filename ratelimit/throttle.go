@@ -0,0 +1,110 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limits are the upload and download rates in bytes per second, zero
+// meaning unlimited.
+type Limits struct {
+	Upload   int64
+	Download int64
+}
+
+type ThrottleConfig struct {
+	// Limits of users without their own
+	Default Limits
+	Users   map[string]Limits
+}
+
+// Throttle hands out the buckets limiting the bandwidth of each user, shared
+// by all of the connections of that user. Anonymous clients get buckets of
+// the default limits for each of their addresses instead.
+type Throttle struct {
+	defaults Limits
+	users    map[string]Limits
+
+	mu        sync.Mutex
+	buckets   map[string]*userBuckets
+	clients   map[string]*userBuckets
+	lastSweep time.Time
+}
+
+type userBuckets struct {
+	upload   *Bucket
+	download *Bucket
+}
+
+func NewThrottle(cfg ThrottleConfig) *Throttle {
+	return &Throttle{
+		defaults:  cfg.Default,
+		users:     cfg.Users,
+		buckets:   make(map[string]*userBuckets),
+		clients:   make(map[string]*userBuckets),
+		lastSweep: time.Now(),
+	}
+}
+
+func newUserBuckets(limits Limits) *userBuckets {
+	ub := &userBuckets{}
+	if limits.Upload > 0 {
+		ub.upload = NewBucket(limits.Upload, 0)
+	}
+	if limits.Download > 0 {
+		ub.download = NewBucket(limits.Download, 0)
+	}
+	return ub
+}
+
+// Buckets returns the upload and download buckets of the user, nil for the
+// directions left unlimited.
+func (t *Throttle) Buckets(user string) (upload, download *Bucket) {
+	if t == nil {
+		return nil, nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ub, ok := t.buckets[user]
+	if !ok {
+		limits, ok := t.users[user]
+		if !ok {
+			limits = t.defaults
+		}
+		ub = newUserBuckets(limits)
+		t.buckets[user] = ub
+	}
+	return ub.upload, ub.download
+}
+
+// ClientBuckets returns the upload and download buckets of the anonymous
+// client at the address, nil for the directions left unlimited.
+func (t *Throttle) ClientBuckets(addr string) (upload, download *Bucket) {
+	if t == nil {
+		return nil, nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweep(time.Now())
+	ub, ok := t.clients[addr]
+	if !ok {
+		ub = newUserBuckets(t.defaults)
+		t.clients[addr] = ub
+	}
+	return ub.upload, ub.download
+}
+
+// sweep forgets the buckets of the clients which have been refilled, keeping
+// the number of buckets in check. Connections still holding them keep using
+// them until they close.
+func (t *Throttle) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < sweepInterval {
+		return
+	}
+	t.lastSweep = now
+	for addr, ub := range t.clients {
+		if ub.upload.full(now) && ub.download.full(now) {
+			delete(t.clients, addr)
+		}
+	}
+}
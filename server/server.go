@@ -1,23 +1,94 @@
 package server
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
 	"errors"
 	"net"
+	"net/http"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/Frizz925/gilgamesh/dns"
+	"github.com/Frizz925/gilgamesh/metrics"
+	"github.com/Frizz925/gilgamesh/proxyproto"
+	"github.com/Frizz925/gilgamesh/ratelimit"
+	"github.com/Frizz925/gilgamesh/usage"
 	"github.com/Frizz925/gilgamesh/utils"
 	"github.com/Frizz925/gilgamesh/worker"
 	"go.uber.org/zap"
 )
 
-var ErrServerAlreadyStopped = errors.New("server already stopped")
+// Time given to load balancers to send the PROXY protocol header
+const ProxyHeaderTimeout = 5 * time.Second
+
+// Time given to rejected clients to send their request before being answered
+const RejectTimeout = 5 * time.Second
+
+// Time given to connections to finish when shutting down, unless configured
+// otherwise
+const DefaultShutdownTimeout = 30 * time.Second
+
+// Interval at which Shutdown checks for connections done or gone idle
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Time Shutdown waits for the connections it closed to be done with, letting
+// what they relayed be accounted and logged
+const closeWaitTimeout = time.Second
+
+var (
+	ErrServerAlreadyStopped = errors.New("server already stopped")
+	ErrUntrustedProxy       = errors.New("PROXY protocol header from untrusted source")
+)
+
+type listenerType int
+
+const (
+	listenerHTTP listenerType = iota
+	listenerTLS
+	listenerSOCKS
+	listenerTransparent
+)
+
+var listenerNames = map[listenerType]string{
+	listenerHTTP:        "http",
+	listenerTLS:         "tls",
+	listenerSOCKS:       "socks",
+	listenerTransparent: "transparent",
+}
+
+func (lt listenerType) String() string {
+	return listenerNames[lt]
+}
+
+// Listener carries settings specific to a single listener. It can be passed
+// to any of the Serve methods in place of the listener it wraps.
+type Listener struct {
+	net.Listener
+	// Connections must start with a PROXY protocol header and may only come
+	// from the trusted networks, whose headers carry the client address.
+	ProxyProtocol  bool
+	TrustedProxies []*net.IPNet
+}
 
 type Config struct {
 	WorkerConfig worker.Config
 	Logger       *zap.Logger
 	PoolSize     int
 	TLSConfig    *tls.Config
+	// Only offer HTTP/1.1 to clients of TLS listeners
+	DisableHTTP2 bool
+	// Concurrent connections of each client address, unlimited if zero
+	MaxConnsPerIP int
+}
+
+// ConnCounts holds the number of connections open by each client address
+// and each user limited by the worker config.
+type ConnCounts struct {
+	IPs   map[string]int
+	Users map[string]int
 }
 
 type Server struct {
@@ -25,61 +96,411 @@ type Server struct {
 
 	logger    *zap.Logger
 	pool      *worker.Pool
+	connPool  *worker.ConnPool
 	tlsConfig atomic.Value
+	http2     bool
+	ipConns   *ratelimit.ConnLimit
+	userConns *ratelimit.ConnLimit
+	metrics   *metrics.Proxy
+	quota     *usage.Quota
+	resolver  *dns.Resolver
+	// Stops the pool from being reported in the metrics
+	removePool func()
+	// Time TLS clients are given to complete the handshake
+	handshakeTimeout time.Duration
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[*trackedConn]struct{}
+	inShutdown utils.AtomicBool
+	// Connections whose serving has yet to return
+	serving sync.WaitGroup
+}
+
+// trackedConn is a connection being served along with the worker serving
+// it, if any yet.
+type trackedConn struct {
+	net.Conn
+	worker *worker.Worker
 }
 
 func New(cfg Config) *Server {
 	if cfg.Logger == nil {
 		panic("Logger is required")
 	}
+	if cfg.WorkerConfig.Metrics == nil {
+		cfg.WorkerConfig.Metrics = metrics.NewProxy(nil)
+	}
+	handshakeTimeout := cfg.WorkerConfig.HeaderTimeout
+	if handshakeTimeout <= 0 {
+		handshakeTimeout = worker.DefaultTimeout
+	}
 	s := &Server{
-		logger: cfg.Logger,
-		pool:   worker.NewPool(cfg.PoolSize, cfg.WorkerConfig),
+		logger:    cfg.Logger,
+		pool:      worker.NewPool(cfg.PoolSize, cfg.WorkerConfig),
+		connPool:  cfg.WorkerConfig.ConnPool,
+		http2:     !cfg.DisableHTTP2,
+		ipConns:   ratelimit.NewConnLimit(cfg.MaxConnsPerIP),
+		userConns: cfg.WorkerConfig.UserConns,
+		metrics:   cfg.WorkerConfig.Metrics,
+		quota:     cfg.WorkerConfig.Quota,
+		resolver:  cfg.WorkerConfig.Resolver,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*trackedConn]struct{}),
+
+		handshakeTimeout: handshakeTimeout,
 	}
+	s.removePool = s.metrics.AddPool(s.pool)
 	if cfg.TLSConfig != nil {
-		s.tlsConfig.Store(cfg.TLSConfig)
+		s.UpdateTLSConfig(cfg.TLSConfig)
 	}
 	return s
 }
 
 func (s *Server) UpdateTLSConfig(cfg *tls.Config) {
+	// Let clients negotiate HTTP/2 through ALPN
+	if s.http2 && len(cfg.NextProtos) <= 0 {
+		cfg = cfg.Clone()
+		cfg.NextProtos = []string{worker.HTTP2Proto, "http/1.1"}
+	}
 	s.tlsConfig.Store(cfg)
 }
 
 func (s *Server) Serve(l net.Listener) error {
-	return s.serve(l, false)
+	return s.serve(l, listenerHTTP)
 }
 
 func (s *Server) ServeTLS(l net.Listener) error {
-	return s.serve(l, true)
+	return s.serve(l, listenerTLS)
+}
+
+func (s *Server) ServeSOCKS(l net.Listener) error {
+	return s.serve(l, listenerSOCKS)
+}
+
+// ServeTransparent serves connections redirected by iptables REDIRECT or
+// TPROXY rules, relaying them to their original destination.
+func (s *Server) ServeTransparent(l net.Listener) error {
+	return s.serve(l, listenerTransparent)
+}
+
+func (s *Server) ConnCounts() ConnCounts {
+	return ConnCounts{
+		IPs:   s.ipConns.Counts(),
+		Users: s.userConns.Counts(),
+	}
+}
+
+// Quota returns the quota the workers count usage against, nil if none.
+func (s *Server) Quota() *usage.Quota {
+	return s.quota
+}
+
+// Resolver returns the resolver the workers look names up with, nil if they
+// use the system one.
+func (s *Server) Resolver() *dns.Resolver {
+	return s.resolver
+}
+
+// Shutdown stops accepting connections and waits for the ones being served
+// to finish, closing keep-alive connections as soon as they are idle. Once
+// ctx is done the remaining connections are closed, and how many there were
+// is returned along with the context error.
+func (s *Server) Shutdown(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	s.inShutdown.Set(true)
+	for l := range s.listeners {
+		_ = l.Close()
+	}
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			s.waitConns(closeWaitTimeout)
+			return 0, nil
+		}
+		select {
+		case <-ctx.Done():
+			n := s.closeConns()
+			s.waitConns(closeWaitTimeout)
+			return n, ctx.Err()
+		case <-ticker.C:
+		}
+	}
 }
 
 func (s *Server) Close() {
+	s.removePool()
 	s.pool.Close()
+	if s.connPool != nil {
+		s.connPool.Close()
+	}
 }
 
-func (s *Server) serve(l net.Listener, isTLS bool) error {
+func (s *Server) serve(l net.Listener, lt listenerType) error {
 	log := s.logger.With(
 		zap.String("domain", "server"),
 		zap.String("listener", l.Addr().String()),
 	)
+	var pl *Listener
+	if v, ok := l.(*Listener); ok && v.ProxyProtocol {
+		pl = v
+	}
+	if !s.trackListener(l) {
+		return ErrServerAlreadyStopped
+	}
+	defer s.untrackListener(l)
 	log.Info("Gilgamesh service started")
 	defer log.Info("Gilgamesh service stopped")
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			if s.inShutdown.Get() {
+				return ErrServerAlreadyStopped
+			}
 			return err
 		}
-		if isTLS {
-			tc := s.tlsConfig.Load().(*tls.Config)
-			c = tls.Server(c, tc)
-		}
-		go s.serveConn(c)
+		go s.serveConn(log, c, lt, pl)
 	}
 }
 
-func (s *Server) serveConn(c net.Conn) {
+func (s *Server) serveConn(log *zap.Logger, c net.Conn, lt listenerType, pl *Listener) {
+	tc, ok := s.trackConn(c)
+	if !ok {
+		_ = c.Close()
+		return
+	}
+	defer s.untrackConn(tc)
+	// The header comes before anything else, including the TLS handshake
+	if pl != nil {
+		pc, err := readProxyHeader(c, pl.TrustedProxies)
+		if err != nil {
+			log.Error("Failed to read PROXY protocol header",
+				zap.String("src", c.RemoteAddr().String()),
+				zap.Error(err),
+			)
+			_ = c.Close()
+			return
+		}
+		c = pc
+	}
+	// Connections are refused before any worker is taken from the pool
+	ip := addrIP(c.RemoteAddr())
+	if !s.ipConns.Acquire(ip) {
+		log.Warn("Too many connections",
+			zap.String("src", c.RemoteAddr().String()),
+			zap.String("reason", "ip connection limit"),
+		)
+		s.reject(c, lt)
+		return
+	}
+	defer s.ipConns.Release(ip)
+	active := s.metrics.ActiveConns.With(lt.String())
+	active.Inc()
+	defer active.Dec()
+	http2 := false
+	if lt == listenerTLS {
+		tc, err := s.handshake(c)
+		if err != nil {
+			log.Error("TLS handshake failed",
+				zap.String("src", c.RemoteAddr().String()),
+				zap.Error(err),
+			)
+			_ = c.Close()
+			return
+		}
+		http2 = tc.ConnectionState().NegotiatedProtocol == worker.HTTP2Proto
+		c = tc
+	}
 	w := s.pool.Get()
-	w.ServeConn(c)
+	s.setWorker(tc, w)
+	switch {
+	case http2:
+		w.ServeHTTP2(c)
+	case lt == listenerSOCKS:
+		w.ServeSOCKS(c)
+	case lt == listenerTransparent:
+		w.ServeTransparent(c)
+	default:
+		w.ServeConn(c)
+	}
+	s.setWorker(tc, nil)
 	s.pool.Put(w)
 }
+
+func (s *Server) trackListener(l net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inShutdown.Get() {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackListener(l net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, l)
+}
+
+// trackConn registers the raw connection accepted, which is what gets
+// closed on shutdown, failing if the server is shutting down.
+func (s *Server) trackConn(c net.Conn) (*trackedConn, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inShutdown.Get() {
+		return nil, false
+	}
+	tc := &trackedConn{Conn: c}
+	s.conns[tc] = struct{}{}
+	s.serving.Add(1)
+	return tc, true
+}
+
+func (s *Server) untrackConn(tc *trackedConn) {
+	s.mu.Lock()
+	delete(s.conns, tc)
+	s.mu.Unlock()
+	s.serving.Done()
+}
+
+func (s *Server) setWorker(tc *trackedConn, w *worker.Worker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tc.worker = w
+}
+
+// closeIdleConns closes the connections waiting for their next request,
+// reporting whether no connection is left.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for tc := range s.conns {
+		if tc.worker != nil && tc.worker.Idle() {
+			_ = tc.Close()
+			delete(s.conns, tc)
+		}
+	}
+	return len(s.conns) <= 0
+}
+
+// closeConns closes every connection left along with the tunnels they relay,
+// returning how many there were.
+func (s *Server) closeConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.conns)
+	for tc := range s.conns {
+		if tc.worker != nil {
+			tc.worker.EndTunnels()
+		}
+		_ = tc.Close()
+		delete(s.conns, tc)
+	}
+	return n
+}
+
+// waitConns waits up to the timeout for the connections being served to
+// return.
+func (s *Server) waitConns(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		s.serving.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+}
+
+// handshake runs the TLS handshake within the handshake timeout, so that
+// clients stalling it cannot hold on to their connection slots.
+func (s *Server) handshake(c net.Conn) (*tls.Conn, error) {
+	if err := c.SetDeadline(time.Now().Add(s.handshakeTimeout)); err != nil {
+		return nil, err
+	}
+	tc := tls.Server(c, s.tlsConfig.Load().(*tls.Config))
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	return tc, c.SetDeadline(time.Time{})
+}
+
+// reject answers HTTP clients with 429 Too Many Requests before closing
+// their connection, closing the others right away.
+func (s *Server) reject(c net.Conn, lt listenerType) {
+	defer c.Close()
+	if lt == listenerTLS {
+		tc, err := s.handshake(c)
+		if err != nil {
+			return
+		}
+		// HTTP/2 clients only expect frames
+		if tc.ConnectionState().NegotiatedProtocol == worker.HTTP2Proto {
+			return
+		}
+		c = tc
+	} else if lt != listenerHTTP {
+		return
+	}
+	// Reading the request first lets the client receive the response
+	// instead of a reset
+	if err := c.SetReadDeadline(time.Now().Add(RejectTimeout)); err != nil {
+		return
+	}
+	req, err := http.ReadRequest(bufio.NewReader(c))
+	if err != nil {
+		return
+	}
+	res := &http.Response{
+		StatusCode: http.StatusTooManyRequests,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Request:    req,
+		Close:      true,
+	}
+	_ = res.Write(c)
+}
+
+// addrIP returns the IP address of the client, the whole address if it has
+// no port.
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func readProxyHeader(c net.Conn, trusted []*net.IPNet) (net.Conn, error) {
+	addr, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok || !ipTrusted(addr.IP, trusted) {
+		return nil, ErrUntrustedProxy
+	}
+	if err := c.SetReadDeadline(time.Now().Add(ProxyHeaderTimeout)); err != nil {
+		return nil, err
+	}
+	h, err := proxyproto.ReadHeader(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return proxyproto.NewConn(c, h), nil
+}
+
+func ipTrusted(ip net.IP, trusted []*net.IPNet) bool {
+	for _, ipnet := range trusted {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,8 +1,22 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/Frizz925/gilgamesh/auth"
+	"github.com/Frizz925/gilgamesh/metrics"
 	"github.com/Frizz925/gilgamesh/testutils/nettest"
 	"github.com/Frizz925/gilgamesh/worker"
 	"github.com/stretchr/testify/require"
@@ -26,3 +40,431 @@ func TestServer(t *testing.T) {
 	})
 	s.Close()
 }
+
+func TestServerProxyProtocol(t *testing.T) {
+	require := require.New(t)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer origin.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(err)
+	s := New(Config{
+		Logger:       zap.NewNop(),
+		WorkerConfig: worker.Config{Logger: zap.NewNop()},
+	})
+	defer s.Close()
+	go func() {
+		_ = s.Serve(&Listener{
+			Listener:       l,
+			ProxyProtocol:  true,
+			TrustedProxies: []*net.IPNet{loopback},
+		})
+	}()
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(err)
+	defer c.Close()
+	_, err = io.WriteString(c, "PROXY TCP4 192.0.2.1 127.0.0.1 56324 80\r\n")
+	require.NoError(err)
+	req, err := http.NewRequest(http.MethodGet, origin.URL, nil)
+	require.NoError(err)
+	require.NoError(req.WriteProxy(c))
+	res, err := http.ReadResponse(bufio.NewReader(c), req)
+	require.NoError(err)
+	require.Equal(http.StatusNoContent, res.StatusCode)
+}
+
+func TestServerMaxConnsPerIP(t *testing.T) {
+	require := require.New(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer l.Close()
+	s := New(Config{
+		Logger:        zap.NewNop(),
+		WorkerConfig:  worker.Config{Logger: zap.NewNop()},
+		MaxConnsPerIP: 1,
+	})
+	defer s.Close()
+	go func() {
+		_ = s.Serve(l)
+	}()
+
+	c1, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(err)
+	defer c1.Close()
+	require.Eventually(func() bool {
+		return s.ConnCounts().IPs["127.0.0.1"] == 1
+	}, time.Second, 10*time.Millisecond)
+
+	c2, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(err)
+	defer c2.Close()
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	require.NoError(err)
+	require.NoError(req.WriteProxy(c2))
+	res, err := http.ReadResponse(bufio.NewReader(c2), req)
+	require.NoError(err)
+	require.Equal(http.StatusTooManyRequests, res.StatusCode)
+
+	// Closed connections are uncounted
+	require.NoError(c1.Close())
+	require.Eventually(func() bool {
+		return len(s.ConnCounts().IPs) <= 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestServerTLSHandshakeTimeout(t *testing.T) {
+	require := require.New(t)
+	origin := httptest.NewTLSServer(http.NotFoundHandler())
+	defer origin.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer l.Close()
+	s := New(Config{
+		Logger: zap.NewNop(),
+		WorkerConfig: worker.Config{
+			Logger:        zap.NewNop(),
+			HeaderTimeout: 100 * time.Millisecond,
+		},
+		TLSConfig:     &tls.Config{Certificates: origin.TLS.Certificates},
+		MaxConnsPerIP: 1,
+	})
+	defer s.Close()
+	go func() {
+		_ = s.ServeTLS(l)
+	}()
+
+	// Clients never starting the handshake give their slot back
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(err)
+	defer c.Close()
+	require.NoError(c.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = ioutil.ReadAll(c)
+	require.NoError(err)
+	require.Eventually(func() bool {
+		return len(s.ConnCounts().IPs) <= 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestServerPoolMetrics(t *testing.T) {
+	require := require.New(t)
+	m := metrics.NewProxy(nil)
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		m.Registry.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		return rec.Body.String()
+	}
+	newServer := func(size int) *Server {
+		return New(Config{
+			Logger:       zap.NewNop(),
+			PoolSize:     size,
+			WorkerConfig: worker.Config{Logger: zap.NewNop(), Metrics: m},
+		})
+	}
+
+	// Servers sharing the metrics add up their pools
+	s1, s2 := newServer(2), newServer(3)
+	defer s2.Close()
+	out := scrape()
+	require.Equal(1, strings.Count(out, "# TYPE gilgamesh_worker_pool_size gauge"))
+	require.Contains(out, "gilgamesh_worker_pool_size 5\n")
+	s1.Close()
+	require.Contains(scrape(), "gilgamesh_worker_pool_size 3\n")
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	require := require.New(t)
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(err)
+	_, other, err := net.ParseCIDR("192.0.2.0/24")
+	require.NoError(err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(err)
+	defer client.Close()
+	server, err := l.Accept()
+	require.NoError(err)
+	defer server.Close()
+
+	_, err = readProxyHeader(server, []*net.IPNet{other})
+	require.Equal(ErrUntrustedProxy, err)
+
+	_, err = io.WriteString(client, "PROXY TCP4 192.0.2.1 127.0.0.1 56324 80\r\nhello")
+	require.NoError(err)
+	c, err := readProxyHeader(server, []*net.IPNet{loopback})
+	require.NoError(err)
+	require.Equal("192.0.2.1:56324", c.RemoteAddr().String())
+	b := make([]byte, 5)
+	_, err = io.ReadFull(c, b)
+	require.NoError(err)
+	require.Equal("hello", string(b))
+}
+
+func TestServerHTTP2(t *testing.T) {
+	require := require.New(t)
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	defer origin.Close()
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	defer plain.Close()
+
+	password, err := auth.CreatePassword([]byte("password"))
+	require.NoError(err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer l.Close()
+	s := New(Config{
+		Logger: zap.NewNop(),
+		WorkerConfig: worker.Config{
+			Logger:      zap.NewNop(),
+			Credentials: auth.Credentials{"user": password},
+		},
+		TLSConfig: &tls.Config{Certificates: origin.TLS.Certificates},
+	})
+	defer s.Close()
+	go func() {
+		_ = s.ServeTLS(l)
+	}()
+
+	transport := &http.Transport{
+		ForceAttemptHTTP2: true,
+		DialTLSContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return tls.Dial("tcp", l.Addr().String(), &tls.Config{
+				InsecureSkipVerify: true, //nolint:gosec
+				NextProtos:         []string{"h2"},
+			})
+		},
+	}
+	defer transport.CloseIdleConnections()
+	authorization := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:password"))
+
+	// Proxied plain request
+	req, err := http.NewRequest(http.MethodGet, "https://"+plain.Listener.Addr().String()+"/plain", nil)
+	require.NoError(err)
+	req.Header.Set("Proxy-Authorization", authorization)
+	res, err := transport.RoundTrip(req)
+	require.NoError(err)
+	require.Equal(2, res.ProtoMajor)
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(err)
+	require.Equal("/plain", string(body))
+
+	// Missing credentials
+	req.Header.Del("Proxy-Authorization")
+	res, err = transport.RoundTrip(req)
+	require.NoError(err)
+	require.Equal(http.StatusProxyAuthRequired, res.StatusCode)
+	require.NotEmpty(res.Header.Get("Proxy-Authenticate"))
+
+	// CONNECT streams multiplexed over the same connection
+	for i := 0; i < 3; i++ {
+		pr, pw := io.Pipe()
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Scheme: "https", Host: origin.Listener.Addr().String()},
+			Host:   origin.Listener.Addr().String(),
+			Header: http.Header{"Proxy-Authorization": {authorization}},
+			Body:   pr,
+		}
+		res, err := transport.RoundTrip(req)
+		require.NoError(err)
+		require.Equal(http.StatusOK, res.StatusCode)
+
+		tc := tls.Client(&streamConn{Reader: res.Body, Writer: pw}, &tls.Config{
+			InsecureSkipVerify: true, //nolint:gosec
+		})
+		treq, err := http.NewRequest(http.MethodGet, "https://example.com/tunnel", nil)
+		require.NoError(err)
+		require.NoError(treq.Write(tc))
+		tres, err := http.ReadResponse(bufio.NewReader(tc), treq)
+		require.NoError(err)
+		body, err := ioutil.ReadAll(tres.Body)
+		require.NoError(err)
+		require.Equal("/tunnel", string(body))
+		_ = pw.Close()
+		_ = res.Body.Close()
+	}
+}
+
+// streamConn turns the bodies of a CONNECT stream into a connection.
+type streamConn struct {
+	net.Conn
+	io.Reader
+	io.Writer
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	return c.Reader.Read(b)
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	return c.Writer.Write(b)
+}
+
+func TestServerShutdown(t *testing.T) {
+	require := require.New(t)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer origin.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	s := New(Config{
+		Logger:       zap.NewNop(),
+		WorkerConfig: worker.Config{Logger: zap.NewNop()},
+	})
+	defer s.Close()
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(l)
+	}()
+
+	// Keep-alive connection left idle after its request
+	idle, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(err)
+	defer idle.Close()
+	req, err := http.NewRequest(http.MethodGet, origin.URL, nil)
+	require.NoError(err)
+	require.NoError(req.WriteProxy(idle))
+	res, err := http.ReadResponse(bufio.NewReader(idle), req)
+	require.NoError(err)
+	require.Equal(http.StatusNoContent, res.StatusCode)
+
+	// Tunnel still open when the shutdown starts
+	tunnel, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(err)
+	defer tunnel.Close()
+	req = &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: origin.Listener.Addr().String()},
+		Host:   origin.Listener.Addr().String(),
+	}
+	require.NoError(req.Write(tunnel))
+	tr := bufio.NewReader(tunnel)
+	res, err = http.ReadResponse(tr, req)
+	require.NoError(err)
+	require.Equal(http.StatusOK, res.StatusCode)
+
+	type result struct {
+		cut int
+		err error
+	}
+	shutdown := make(chan result, 1)
+	go func() {
+		cut, err := s.Shutdown(context.Background())
+		shutdown <- result{cut, err}
+	}()
+	require.Equal(ErrServerAlreadyStopped, <-served)
+	_, err = net.Dial("tcp", l.Addr().String())
+	require.Error(err)
+	// Idle connections are closed right away
+	_, err = ioutil.ReadAll(idle)
+	require.NoError(err)
+
+	// The tunnel is left to finish
+	treq, err := http.NewRequest(http.MethodGet, origin.URL, nil)
+	require.NoError(err)
+	treq.Close = true
+	require.NoError(treq.Write(tunnel))
+	tres, err := http.ReadResponse(tr, treq)
+	require.NoError(err)
+	require.Equal(http.StatusNoContent, tres.StatusCode)
+	require.NoError(tunnel.Close())
+	r := <-shutdown
+	require.NoError(r.err)
+	require.Zero(r.cut)
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	require := require.New(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	s := New(Config{
+		Logger:       zap.NewNop(),
+		WorkerConfig: worker.Config{Logger: zap.NewNop()},
+	})
+	defer s.Close()
+	go func() {
+		_ = s.Serve(l)
+	}()
+
+	// Connections which never send a request are not idle
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(err)
+	defer c.Close()
+	require.Eventually(func() bool {
+		return s.ConnCounts().IPs["127.0.0.1"] == 1
+	}, time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	cut, err := s.Shutdown(ctx)
+	require.Equal(context.DeadlineExceeded, err)
+	require.Equal(1, cut)
+	_, err = ioutil.ReadAll(c)
+	require.NoError(err)
+}
+
+func TestServerShutdownTunnel(t *testing.T) {
+	require := require.New(t)
+	// Destination which never sends anything nor closes the tunnel
+	dst, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer dst.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if c, err := dst.Accept(); err == nil {
+			accepted <- c
+		}
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	s := New(Config{
+		Logger:       zap.NewNop(),
+		WorkerConfig: worker.Config{Logger: zap.NewNop()},
+	})
+	defer s.Close()
+	go func() {
+		_ = s.Serve(l)
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(err)
+	defer c.Close()
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: dst.Addr().String()},
+		Host:   dst.Addr().String(),
+	}
+	require.NoError(req.Write(c))
+	res, err := http.ReadResponse(bufio.NewReader(c), req)
+	require.NoError(err)
+	require.Equal(http.StatusOK, res.StatusCode)
+	t1 := <-accepted
+	defer t1.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	cut, err := s.Shutdown(ctx)
+	require.Equal(context.DeadlineExceeded, err)
+	require.Equal(1, cut)
+	// The tunnel is ended on both sides before Shutdown returns
+	require.Less(int64(time.Since(start)), int64(closeWaitTimeout))
+	require.NoError(t1.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = ioutil.ReadAll(t1)
+	require.NoError(err)
+}
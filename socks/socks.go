@@ -0,0 +1,195 @@
+package socks
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	Version4 = 0x04
+	Version5 = 0x05
+)
+
+// Authentication methods
+const (
+	MethodNoAuth       = 0x00
+	MethodUserPass     = 0x02
+	MethodNoAcceptable = 0xff
+)
+
+// Username/password sub-negotiation as described in RFC 1929
+const (
+	UserPassVersion       = 0x01
+	UserPassStatusSuccess = 0x00
+	UserPassStatusFailure = 0x01
+)
+
+const (
+	CmdConnect      = 0x01
+	CmdBind         = 0x02
+	CmdUDPAssociate = 0x03
+)
+
+const (
+	AtypIPv4   = 0x01
+	AtypDomain = 0x03
+	AtypIPv6   = 0x04
+)
+
+// SOCKS4 reply codes
+const (
+	Reply4Granted        = 0x5a
+	Reply4Rejected       = 0x5b
+	Reply4NoIdentd       = 0x5c
+	Reply4UserIDMismatch = 0x5d
+)
+
+type Reply byte
+
+const (
+	ReplySucceeded Reply = iota
+	ReplyGeneralFailure
+	ReplyNotAllowed
+	ReplyNetworkUnreachable
+	ReplyHostUnreachable
+	ReplyConnectionRefused
+	ReplyTTLExpired
+	ReplyCommandNotSupported
+	ReplyAddressNotSupported
+)
+
+var replyText = map[Reply]string{
+	ReplySucceeded:           "succeeded",
+	ReplyGeneralFailure:      "general SOCKS server failure",
+	ReplyNotAllowed:          "connection not allowed by ruleset",
+	ReplyNetworkUnreachable:  "network unreachable",
+	ReplyHostUnreachable:     "host unreachable",
+	ReplyConnectionRefused:   "connection refused",
+	ReplyTTLExpired:          "TTL expired",
+	ReplyCommandNotSupported: "command not supported",
+	ReplyAddressNotSupported: "address type not supported",
+}
+
+func (r Reply) String() string {
+	if text, ok := replyText[r]; ok {
+		return text
+	}
+	return fmt.Sprintf("unknown reply %#02x", byte(r))
+}
+
+var (
+	ErrUnsupportedVersion     = errors.New("unsupported SOCKS version")
+	ErrUnsupportedAddressType = errors.New("unsupported SOCKS address type")
+	ErrDomainTooLong          = errors.New("domain name too long")
+)
+
+// Addr is a destination address as carried in SOCKS requests and replies.
+// Either IP or Name is set, Name being used for addresses resolved remotely.
+type Addr struct {
+	IP   net.IP
+	Name string
+	Port int
+}
+
+func ParseAddr(hostport string) (Addr, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return Addr{}, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return Addr{}, err
+	}
+	a := Addr{Port: int(p)}
+	if ip := net.ParseIP(host); ip != nil {
+		a.IP = ip
+	} else {
+		a.Name = host
+	}
+	return a, nil
+}
+
+// AddrFromNet converts TCP and UDP addresses, returning zero address otherwise.
+func AddrFromNet(na net.Addr) Addr {
+	switch v := na.(type) {
+	case *net.TCPAddr:
+		return Addr{IP: v.IP, Port: v.Port}
+	case *net.UDPAddr:
+		return Addr{IP: v.IP, Port: v.Port}
+	}
+	return Addr{IP: net.IPv4zero}
+}
+
+func (a Addr) Host() string {
+	if a.Name != "" {
+		return a.Name
+	}
+	return a.IP.String()
+}
+
+func (a Addr) String() string {
+	return net.JoinHostPort(a.Host(), strconv.Itoa(a.Port))
+}
+
+// Append encodes the address type, address and port into the buffer.
+func (a Addr) Append(b []byte) ([]byte, error) {
+	switch {
+	case a.Name != "":
+		if len(a.Name) > 255 {
+			return nil, ErrDomainTooLong
+		}
+		b = append(b, AtypDomain, byte(len(a.Name)))
+		b = append(b, a.Name...)
+	case a.IP.To4() != nil:
+		b = append(b, AtypIPv4)
+		b = append(b, a.IP.To4()...)
+	case a.IP.To16() != nil:
+		b = append(b, AtypIPv6)
+		b = append(b, a.IP.To16()...)
+	default:
+		// Unspecified address
+		b = append(b, AtypIPv4, 0, 0, 0, 0)
+	}
+	return append(b, byte(a.Port>>8), byte(a.Port)), nil
+}
+
+// ReadAddr decodes the address type, address and port from the reader.
+func ReadAddr(r io.Reader) (Addr, error) {
+	var a Addr
+	var b [256]byte
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
+		return a, err
+	}
+	switch b[0] {
+	case AtypIPv4:
+		if _, err := io.ReadFull(r, b[:net.IPv4len]); err != nil {
+			return a, err
+		}
+		a.IP = net.IP(append([]byte(nil), b[:net.IPv4len]...))
+	case AtypIPv6:
+		if _, err := io.ReadFull(r, b[:net.IPv6len]); err != nil {
+			return a, err
+		}
+		a.IP = net.IP(append([]byte(nil), b[:net.IPv6len]...))
+	case AtypDomain:
+		if _, err := io.ReadFull(r, b[:1]); err != nil {
+			return a, err
+		}
+		n := int(b[0])
+		if _, err := io.ReadFull(r, b[:n]); err != nil {
+			return a, err
+		}
+		a.Name = string(b[:n])
+	default:
+		return a, ErrUnsupportedAddressType
+	}
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return a, err
+	}
+	a.Port = int(binary.BigEndian.Uint16(b[:2]))
+	return a, nil
+}
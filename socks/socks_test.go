@@ -0,0 +1,57 @@
+package socks
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddr(t *testing.T) {
+	require := require.New(t)
+	for _, hostport := range []string{
+		"127.0.0.1:80",
+		"[::1]:443",
+		"example.com:8080",
+	} {
+		a, err := ParseAddr(hostport)
+		require.NoError(err)
+		require.Equal(hostport, a.String())
+
+		b, err := a.Append(nil)
+		require.NoError(err)
+		decoded, err := ReadAddr(bytes.NewReader(b))
+		require.NoError(err)
+		require.Equal(hostport, decoded.String())
+	}
+
+	_, err := ParseAddr("example.com")
+	require.Error(err)
+	_, err = ParseAddr("example.com:65536")
+	require.Error(err)
+}
+
+func TestAddrErrors(t *testing.T) {
+	require := require.New(t)
+	_, err := ReadAddr(bytes.NewReader([]byte{0x02, 0, 0}))
+	require.Equal(ErrUnsupportedAddressType, err)
+
+	long := Addr{Name: string(make([]byte, 256)), Port: 80}
+	_, err = long.Append(nil)
+	require.Equal(ErrDomainTooLong, err)
+}
+
+func TestAddrFromNet(t *testing.T) {
+	require := require.New(t)
+	a := AddrFromNet(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 53})
+	require.Equal("10.0.0.1:53", a.String())
+	a = AddrFromNet(nil)
+	require.Equal("0.0.0.0:0", a.String())
+}
+
+func TestReply(t *testing.T) {
+	require := require.New(t)
+	require.Equal("connection refused", ReplyConnectionRefused.String())
+	require.Equal("unknown reply 0x42", Reply(0x42).String())
+}
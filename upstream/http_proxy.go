@@ -0,0 +1,121 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+const authHeaderName = "Proxy-Authorization"
+
+// HTTPProxy reaches destinations through a parent HTTP proxy, using CONNECT
+// for tunnels and absolute-form requests for plain HTTP.
+type HTTPProxy struct {
+	address       string
+	authorization string
+	dialer        *net.Dialer
+	tlsConfig     *tls.Config
+}
+
+func NewHTTPProxy(u *url.URL, cfg Config) (*HTTPProxy, error) {
+	p := &HTTPProxy{
+		dialer: cfg.Dialer,
+	}
+	if p.dialer == nil {
+		p.dialer = new(net.Dialer)
+	}
+	if u.Scheme == "https" {
+		p.address = defaultPort(u, "443")
+		tc := cfg.TLSConfig
+		if tc == nil {
+			tc = &tls.Config{}
+		} else {
+			tc = tc.Clone()
+		}
+		if tc.ServerName == "" {
+			tc.ServerName = u.Hostname()
+		}
+		p.tlsConfig = tc
+	} else {
+		p.address = defaultPort(u, "80")
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		creds := u.User.Username() + ":" + password
+		p.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(creds))
+	}
+	return p, nil
+}
+
+func (p *HTTPProxy) Address() string {
+	return p.address
+}
+
+func (p *HTTPProxy) String() string {
+	return p.address
+}
+
+func (p *HTTPProxy) DialForward(ctx context.Context) (net.Conn, error) {
+	return dialContext(ctx, p.dialer, p.address, p.tlsConfig)
+}
+
+func (p *HTTPProxy) PrepareForward(req *http.Request) {
+	if p.authorization != "" {
+		req.Header.Set(authHeaderName, p.authorization)
+	}
+}
+
+// DialContext opens a tunnel to the address by issuing CONNECT to the proxy.
+func (p *HTTPProxy) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	c, err := p.DialForward(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.connect(ctx, c, address); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (p *HTTPProxy) connect(ctx context.Context, c net.Conn, address string) (err error) {
+	if err := setDeadline(ctx, c); err != nil {
+		return err
+	}
+	defer func() {
+		if derr := c.SetDeadline(noDeadline); err == nil {
+			err = derr
+		}
+	}()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	p.PrepareForward(req)
+	if err := req.Write(c); err != nil {
+		return err
+	}
+
+	// Read byte by byte so that no tunneled data ends up in our buffer
+	br := bufio.NewReaderSize(byteReader{c}, 16)
+	// The response body is the tunnel itself, so it must be left untouched
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return &Error{
+			Proxy:      p.address,
+			StatusCode: res.StatusCode,
+			Status:     res.Status,
+		}
+	}
+	return nil
+}
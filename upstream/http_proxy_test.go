@@ -0,0 +1,101 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPProxy(t *testing.T) {
+	require := require.New(t)
+	l := startParentProxy(t, "user:password")
+	defer l.Close()
+
+	d, err := Parse("http://user:password@"+l.Addr().String(), Config{})
+	require.NoError(err)
+	p, ok := d.(*HTTPProxy)
+	require.True(ok)
+	require.Equal(l.Addr().String(), p.Address())
+
+	c, err := p.DialContext(context.Background(), "tcp", "example.com:443")
+	require.NoError(err)
+	defer c.Close()
+	expected := []byte("message to be echoed")
+	_, err = c.Write(expected)
+	require.NoError(err)
+	b := make([]byte, len(expected))
+	_, err = io.ReadFull(c, b)
+	require.NoError(err)
+	require.Equal(expected, b)
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	require.NoError(err)
+	p.PrepareForward(req)
+	require.Equal(basicAuth("user:password"), req.Header.Get(authHeaderName))
+}
+
+func TestHTTPProxyAuthFailure(t *testing.T) {
+	require := require.New(t)
+	l := startParentProxy(t, "user:password")
+	defer l.Close()
+
+	d, err := Parse("http://"+l.Addr().String(), Config{})
+	require.NoError(err)
+	_, err = d.DialContext(context.Background(), "tcp", "example.com:443")
+	require.Error(err)
+	ue, ok := err.(*Error)
+	require.True(ok)
+	require.Equal(http.StatusProxyAuthRequired, ue.StatusCode)
+	require.Equal(l.Addr().String(), ue.Proxy)
+}
+
+func TestParse(t *testing.T) {
+	require := require.New(t)
+	d, err := Parse("https://proxy.example.com", Config{})
+	require.NoError(err)
+	require.Equal("proxy.example.com:443", d.(*HTTPProxy).Address())
+
+	_, err = Parse("ftp://proxy.example.com", Config{})
+	require.Error(err)
+}
+
+// startParentProxy serves CONNECT requests by echoing the tunneled data back.
+func startParentProxy(t *testing.T, creds string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				if req.Method != http.MethodConnect || req.Header.Get(authHeaderName) != basicAuth(creds) {
+					_, _ = io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				if _, err := io.WriteString(c, "HTTP/1.1 200 OK\r\n\r\n"); err != nil {
+					return
+				}
+				_, _ = io.Copy(c, br)
+			}()
+		}
+	}()
+	return l
+}
+
+func basicAuth(creds string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(creds))
+}
@@ -0,0 +1,163 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+
+	"github.com/Frizz925/gilgamesh/socks"
+)
+
+var ErrSOCKSAuthFailed = errors.New("SOCKS5 authentication failed")
+
+// SOCKS5Proxy reaches destinations through a SOCKS5 server. Names are sent
+// to the server for remote resolution with the socks5h scheme.
+type SOCKS5Proxy struct {
+	address   string
+	username  string
+	password  string
+	remoteDNS bool
+	dialer    *net.Dialer
+	resolver  *net.Resolver
+}
+
+func NewSOCKS5Proxy(u *url.URL, cfg Config) (*SOCKS5Proxy, error) {
+	p := &SOCKS5Proxy{
+		address:   defaultPort(u, "1080"),
+		remoteDNS: u.Scheme == "socks5h",
+		dialer:    cfg.Dialer,
+		resolver:  net.DefaultResolver,
+	}
+	if p.dialer == nil {
+		p.dialer = new(net.Dialer)
+	}
+	if p.dialer.Resolver != nil {
+		p.resolver = p.dialer.Resolver
+	}
+	if u.User != nil {
+		p.username = u.User.Username()
+		p.password, _ = u.User.Password()
+		if len(p.username) > 255 || len(p.password) > 255 {
+			return nil, errors.New("SOCKS5 credentials too long")
+		}
+	}
+	return p, nil
+}
+
+func (p *SOCKS5Proxy) String() string {
+	return p.address
+}
+
+func (p *SOCKS5Proxy) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network for SOCKS5: %s", network)
+	}
+	addr, err := socks.ParseAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	if addr.Name != "" && !p.remoteDNS {
+		ips, err := p.resolver.LookupIPAddr(ctx, addr.Name)
+		if err != nil {
+			return nil, err
+		}
+		addr.IP, addr.Name = ips[0].IP, ""
+	}
+
+	c, err := p.dialer.DialContext(ctx, "tcp", p.address)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.connect(ctx, c, addr); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (p *SOCKS5Proxy) connect(ctx context.Context, c net.Conn, addr socks.Addr) (err error) {
+	if err := setDeadline(ctx, c); err != nil {
+		return err
+	}
+	defer func() {
+		if derr := c.SetDeadline(noDeadline); err == nil {
+			err = derr
+		}
+	}()
+
+	if err := p.authenticate(c); err != nil {
+		return err
+	}
+
+	b, err := addr.Append([]byte{socks.Version5, socks.CmdConnect, 0})
+	if err != nil {
+		return err
+	}
+	if _, err := c.Write(b); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c, b[:3]); err != nil {
+		return err
+	}
+	if b[0] != socks.Version5 {
+		return socks.ErrUnsupportedVersion
+	}
+	if reply := socks.Reply(b[1]); reply != socks.ReplySucceeded {
+		return &Error{
+			Proxy:      p.address,
+			StatusCode: int(reply),
+			Status:     fmt.Sprintf("%d %s", reply, reply),
+		}
+	}
+	// The bound address is of no use to us
+	_, err = socks.ReadAddr(c)
+	return err
+}
+
+func (p *SOCKS5Proxy) authenticate(c net.Conn) error {
+	methods := []byte{socks.Version5, 1, socks.MethodNoAuth}
+	if p.username != "" {
+		methods = []byte{socks.Version5, 2, socks.MethodNoAuth, socks.MethodUserPass}
+	}
+	if _, err := c.Write(methods); err != nil {
+		return err
+	}
+	var b [2]byte
+	if _, err := io.ReadFull(c, b[:]); err != nil {
+		return err
+	}
+	if b[0] != socks.Version5 {
+		return socks.ErrUnsupportedVersion
+	}
+	switch b[1] {
+	case socks.MethodNoAuth:
+		return nil
+	case socks.MethodUserPass:
+		if p.username == "" {
+			return ErrSOCKSAuthFailed
+		}
+	default:
+		return ErrSOCKSAuthFailed
+	}
+
+	req := make([]byte, 0, 3+len(p.username)+len(p.password))
+	req = append(req, socks.UserPassVersion, byte(len(p.username)))
+	req = append(req, p.username...)
+	req = append(req, byte(len(p.password)))
+	req = append(req, p.password...)
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c, b[:]); err != nil {
+		return err
+	}
+	if b[1] != socks.UserPassStatusSuccess {
+		return ErrSOCKSAuthFailed
+	}
+	return nil
+}
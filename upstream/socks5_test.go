@@ -0,0 +1,147 @@
+package upstream
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/Frizz925/gilgamesh/socks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSOCKS5Proxy(t *testing.T) {
+	require := require.New(t)
+	l, targets := startSOCKS5Server(t, "user", "password")
+	defer l.Close()
+
+	d, err := Parse("socks5h://user:password@"+l.Addr().String(), Config{})
+	require.NoError(err)
+	c, err := d.DialContext(context.Background(), "tcp", "example.com:443")
+	require.NoError(err)
+	defer c.Close()
+	require.Equal("example.com:443", <-targets)
+
+	expected := []byte("message to be echoed")
+	_, err = c.Write(expected)
+	require.NoError(err)
+	b := make([]byte, len(expected))
+	_, err = io.ReadFull(c, b)
+	require.NoError(err)
+	require.Equal(expected, b)
+}
+
+func TestSOCKS5ProxyLocalDNS(t *testing.T) {
+	require := require.New(t)
+	l, targets := startSOCKS5Server(t, "", "")
+	defer l.Close()
+
+	d, err := Parse("socks5://"+l.Addr().String(), Config{})
+	require.NoError(err)
+	c, err := d.DialContext(context.Background(), "tcp", "localhost:80")
+	require.NoError(err)
+	defer c.Close()
+	host, _, err := net.SplitHostPort(<-targets)
+	require.NoError(err)
+	require.NotNil(net.ParseIP(host))
+}
+
+func TestSOCKS5ProxyAuthFailure(t *testing.T) {
+	require := require.New(t)
+	l, _ := startSOCKS5Server(t, "user", "password")
+	defer l.Close()
+
+	d, err := Parse("socks5h://user:invalid@"+l.Addr().String(), Config{})
+	require.NoError(err)
+	_, err = d.DialContext(context.Background(), "tcp", "example.com:443")
+	require.Equal(ErrSOCKSAuthFailed, err)
+
+	d, err = Parse("socks5h://"+l.Addr().String(), Config{})
+	require.NoError(err)
+	_, err = d.DialContext(context.Background(), "tcp", "example.com:443")
+	require.Equal(ErrSOCKSAuthFailed, err)
+
+	_, err = d.DialContext(context.Background(), "udp", "example.com:53")
+	require.Error(err)
+}
+
+// startSOCKS5Server echoes tunneled data and reports the requested targets.
+func startSOCKS5Server(t *testing.T, username, password string) (net.Listener, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	targets := make(chan string, 1)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				if !serveSOCKS5(c, username, password, targets) {
+					return
+				}
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	return l, targets
+}
+
+func serveSOCKS5(c net.Conn, username, password string, targets chan<- string) bool {
+	b := make([]byte, 256)
+	if _, err := io.ReadFull(c, b[:2]); err != nil {
+		return false
+	}
+	n := int(b[1])
+	if _, err := io.ReadFull(c, b[:n]); err != nil {
+		return false
+	}
+	method := byte(socks.MethodNoAuth)
+	if username != "" {
+		method = socks.MethodNoAcceptable
+		for _, m := range b[:n] {
+			if m == socks.MethodUserPass {
+				method = socks.MethodUserPass
+			}
+		}
+	}
+	if _, err := c.Write([]byte{socks.Version5, method}); err != nil || method == socks.MethodNoAcceptable {
+		return false
+	}
+	if method == socks.MethodUserPass {
+		// Skip the sub-negotiation version
+		if _, err := io.ReadFull(c, b[:1]); err != nil {
+			return false
+		}
+		var creds [2]string
+		for i := range creds {
+			if _, err := io.ReadFull(c, b[:1]); err != nil {
+				return false
+			}
+			n := int(b[0])
+			if _, err := io.ReadFull(c, b[:n]); err != nil {
+				return false
+			}
+			creds[i] = string(b[:n])
+		}
+		status := byte(socks.UserPassStatusSuccess)
+		if creds[0] != username || creds[1] != password {
+			status = socks.UserPassStatusFailure
+		}
+		if _, err := c.Write([]byte{socks.UserPassVersion, status}); err != nil || status != socks.UserPassStatusSuccess {
+			return false
+		}
+	}
+	if _, err := io.ReadFull(c, b[:3]); err != nil {
+		return false
+	}
+	addr, err := socks.ReadAddr(c)
+	if err != nil {
+		return false
+	}
+	targets <- addr.String()
+	reply, _ := socks.AddrFromNet(c.LocalAddr()).Append([]byte{socks.Version5, 0, 0})
+	_, err = c.Write(reply)
+	return err == nil
+}
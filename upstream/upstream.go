@@ -0,0 +1,115 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var noDeadline time.Time
+
+// Dialer is the interface used by workers to reach destinations.
+// *net.Dialer satisfies it for direct connections.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Forwarder is implemented by dialers which can also relay plain HTTP
+// requests written in absolute-form, such as parent HTTP proxies.
+type Forwarder interface {
+	Dialer
+	// Address of the proxy which plain HTTP requests are sent to
+	Address() string
+	// DialForward connects to the proxy for sending absolute-form requests
+	DialForward(ctx context.Context) (net.Conn, error)
+	// PrepareForward adds the headers the proxy expects to the request
+	PrepareForward(req *http.Request)
+}
+
+type Config struct {
+	// Dialer used to reach the upstream itself
+	Dialer *net.Dialer
+	// TLS config for upstreams using an encrypted transport
+	TLSConfig *tls.Config
+}
+
+// Error describes a failure reported by an upstream proxy.
+type Error struct {
+	Proxy      string
+	StatusCode int
+	Status     string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("upstream proxy %s responded with %s", e.Proxy, e.Status)
+}
+
+// Parse creates the upstream dialer described by the given URL.
+func Parse(rawurl string, cfg Config) (Dialer, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return NewHTTPProxy(u, cfg)
+	case "socks5", "socks5h":
+		return NewSOCKS5Proxy(u, cfg)
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme: %s", u.Scheme)
+	}
+}
+
+func dialContext(ctx context.Context, d *net.Dialer, addr string, tc *tls.Config) (net.Conn, error) {
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil || tc == nil {
+		return c, err
+	}
+	if err := setDeadline(ctx, c); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	tlsConn := tls.Client(c, tc)
+	if err := tlsConn.Handshake(); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	if err := c.SetDeadline(noDeadline); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Apply the context deadline to the handshake with the upstream
+func setDeadline(ctx context.Context, c net.Conn) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		return c.SetDeadline(deadline)
+	}
+	return nil
+}
+
+func defaultPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// byteReader limits reads to a single byte so that handshake parsing never
+// consumes data belonging to the tunnel behind it.
+type byteReader struct {
+	r io.Reader
+}
+
+func (br byteReader) Read(b []byte) (int, error) {
+	if len(b) > 1 {
+		b = b[:1]
+	}
+	return br.r.Read(b)
+}
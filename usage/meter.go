@@ -0,0 +1,85 @@
+package usage
+
+import (
+	"sync"
+	"time"
+)
+
+const DefaultFlushInterval = time.Minute
+
+// Meter adds up the bytes relayed for each user and destination in memory
+// until they are flushed to the store. It is shared by every worker.
+type Meter struct {
+	store *Store
+
+	mu      sync.Mutex
+	pending map[meterKey]*Record
+}
+
+type meterKey struct {
+	period time.Time
+	user   string
+	dst    string
+}
+
+func NewMeter(store *Store) *Meter {
+	return &Meter{
+		store:   store,
+		pending: make(map[meterKey]*Record),
+	}
+}
+
+// Add counts the bytes uploaded by the user to the destination and the ones
+// downloaded from it.
+func (m *Meter) Add(user, dst string, upload, download int64) {
+	if m == nil || (upload <= 0 && download <= 0) {
+		return
+	}
+	k := meterKey{
+		period: time.Now().UTC().Truncate(Period),
+		user:   user,
+		dst:    dst,
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.pending[k]
+	if !ok {
+		r = &Record{Time: k.period, User: user, Destination: dst}
+		m.pending[k] = r
+	}
+	r.Upload += upload
+	r.Download += download
+}
+
+// Flush appends the bytes counted since the last flush to the store, keeping
+// them for the next flush if it fails.
+func (m *Meter) Flush() error {
+	m.mu.Lock()
+	pending := m.pending
+	m.pending = make(map[meterKey]*Record)
+	m.mu.Unlock()
+
+	records := make([]Record, 0, len(pending))
+	for _, r := range pending {
+		records = append(records, *r)
+	}
+	if err := m.store.Append(records); err != nil {
+		for _, r := range records {
+			m.restore(r)
+		}
+		return err
+	}
+	return nil
+}
+
+func (m *Meter) restore(r Record) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := meterKey{period: r.Time, user: r.User, dst: r.Destination}
+	if p, ok := m.pending[k]; ok {
+		p.Upload += r.Upload
+		p.Download += r.Download
+		return
+	}
+	m.pending[k] = &r
+}
@@ -0,0 +1,218 @@
+package usage
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type QuotaConfig struct {
+	// Bytes each user may relay per period, zero meaning unlimited
+	Default int64
+	// Limits overriding the default one for the given users
+	Users map[string]int64
+	// Day of the month, at midnight UTC, the usage is reset on, the first if
+	// zero. Days past the 28th are not allowed.
+	ResetDay int
+	// File the usage of the current period is saved to, kept in memory only
+	// if empty
+	File string
+}
+
+// Quota caps the bytes relayed for each user, both ways, within a monthly
+// period. Usage is counted in memory and saved to the file on Save.
+type Quota struct {
+	defaults int64
+	users    map[string]int64
+	resetDay int
+	file     string
+
+	mu     sync.Mutex
+	period time.Time
+	used   map[string]*UserQuota
+}
+
+// UserQuota counts the bytes of a single user. A nil quota is unlimited.
+type UserQuota struct {
+	limit int64
+	used  int64
+}
+
+// QuotaStatus is a snapshot of the usage of a user.
+type QuotaStatus struct {
+	Used  int64
+	Limit int64
+}
+
+type quotaState struct {
+	Period time.Time        `json:"period"`
+	Used   map[string]int64 `json:"used"`
+}
+
+// NewQuota returns a quota restoring the usage saved to its file if it is
+// still within the current period.
+func NewQuota(cfg QuotaConfig) (*Quota, error) {
+	if cfg.ResetDay <= 0 {
+		cfg.ResetDay = 1
+	}
+	if cfg.ResetDay > 28 {
+		return nil, errors.New("quota reset day must be within 1 and 28")
+	}
+	q := &Quota{
+		defaults: cfg.Default,
+		users:    cfg.Users,
+		resetDay: cfg.ResetDay,
+		file:     cfg.File,
+		used:     make(map[string]*UserQuota),
+	}
+	q.period = q.periodOf(time.Now())
+	if q.file == "" {
+		return q, nil
+	}
+	b, err := ioutil.ReadFile(q.file)
+	if os.IsNotExist(err) {
+		return q, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var state quotaState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, err
+	}
+	if !state.Period.Equal(q.period) {
+		return q, nil
+	}
+	for user, used := range state.Used {
+		if uq := q.userLocked(user); uq != nil {
+			uq.used = used
+		}
+	}
+	return q, nil
+}
+
+// User returns the quota of the user, nil if the user is unlimited.
+func (q *Quota) User(user string) *UserQuota {
+	if q == nil || user == "" {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.resetLocked(time.Now())
+	return q.userLocked(user)
+}
+
+// Reset returns when the usage is next reset.
+func (q *Quota) Reset() time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.period.AddDate(0, 1, 0)
+}
+
+// Stats returns the usage of the users who have relayed any bytes within
+// the current period.
+func (q *Quota) Stats() map[string]QuotaStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.resetLocked(time.Now())
+	stats := make(map[string]QuotaStatus, len(q.used))
+	for user, uq := range q.used {
+		if used := atomic.LoadInt64(&uq.used); used > 0 {
+			stats[user] = QuotaStatus{Used: used, Limit: uq.limit}
+		}
+	}
+	return stats
+}
+
+// Save writes the usage of the current period to the file, replacing it
+// atomically.
+func (q *Quota) Save() error {
+	if q.file == "" {
+		return nil
+	}
+	q.mu.Lock()
+	q.resetLocked(time.Now())
+	state := quotaState{Period: q.period, Used: make(map[string]int64, len(q.used))}
+	for user, uq := range q.used {
+		if used := atomic.LoadInt64(&uq.used); used > 0 {
+			state.Used[user] = used
+		}
+	}
+	q.mu.Unlock()
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(q.file), filepath.Base(q.file)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), q.file)
+}
+
+func (q *Quota) userLocked(user string) *UserQuota {
+	if uq, ok := q.used[user]; ok {
+		return uq
+	}
+	limit, ok := q.users[user]
+	if !ok {
+		limit = q.defaults
+	}
+	if limit <= 0 {
+		return nil
+	}
+	uq := &UserQuota{limit: limit}
+	q.used[user] = uq
+	return uq
+}
+
+// resetLocked starts a new period once the current one is over. The quotas
+// of users are reset in place, as live connections keep counting on them.
+func (q *Quota) resetLocked(now time.Time) {
+	period := q.periodOf(now)
+	if !period.After(q.period) {
+		return
+	}
+	q.period = period
+	for _, uq := range q.used {
+		atomic.StoreInt64(&uq.used, 0)
+	}
+}
+
+// periodOf returns the start of the period the time falls in.
+func (q *Quota) periodOf(t time.Time) time.Time {
+	t = t.UTC()
+	start := time.Date(t.Year(), t.Month(), q.resetDay, 0, 0, 0, 0, time.UTC)
+	if start.After(t) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start
+}
+
+// Add counts bytes relayed for the user, reporting whether the user is still
+// within the quota.
+func (uq *UserQuota) Add(n int64) bool {
+	if uq == nil {
+		return true
+	}
+	return atomic.AddInt64(&uq.used, n) <= uq.limit
+}
+
+// Exceeded reports whether the user has gone over the quota.
+func (uq *UserQuota) Exceeded() bool {
+	return uq != nil && atomic.LoadInt64(&uq.used) > uq.limit
+}
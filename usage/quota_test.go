@@ -0,0 +1,92 @@
+package usage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuota(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "quota")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	cfg := QuotaConfig{
+		Default: 100,
+		Users:   map[string]int64{"bob": 0},
+		File:    filepath.Join(dir, "quota.json"),
+	}
+	q, err := NewQuota(cfg)
+	require.NoError(err)
+
+	alice := q.User("alice")
+	require.Same(alice, q.User("alice"))
+	require.True(alice.Add(60))
+	require.True(alice.Add(40))
+	require.False(alice.Exceeded())
+	require.False(alice.Add(1))
+	require.True(alice.Exceeded())
+	// Users given no quota and anonymous ones are unlimited
+	require.Nil(q.User("bob"))
+	require.Nil(q.User(""))
+	require.Equal(map[string]QuotaStatus{"alice": {Used: 101, Limit: 100}}, q.Stats())
+
+	// Usage survives restarts within the same period
+	require.NoError(q.Save())
+	q, err = NewQuota(cfg)
+	require.NoError(err)
+	require.True(q.User("alice").Exceeded())
+	require.Equal(q.periodOf(time.Now()).AddDate(0, 1, 0), q.Reset())
+
+	// Starting a new period resets the quotas in place
+	alice = q.User("alice")
+	next := q.Reset()
+	q.mu.Lock()
+	q.resetLocked(next)
+	q.mu.Unlock()
+	require.False(alice.Exceeded())
+	require.Empty(q.Stats())
+
+	_, err = NewQuota(QuotaConfig{ResetDay: 31})
+	require.Error(err)
+}
+
+func TestQuotaPeriod(t *testing.T) {
+	require := require.New(t)
+	q, err := NewQuota(QuotaConfig{ResetDay: 15})
+	require.NoError(err)
+	for at, expected := range map[string]string{
+		"2026-10-17T12:00:00Z": "2026-10-15T00:00:00Z",
+		"2026-10-15T00:00:00Z": "2026-10-15T00:00:00Z",
+		"2026-10-14T23:59:59Z": "2026-09-15T00:00:00Z",
+		"2026-01-01T00:00:00Z": "2025-12-15T00:00:00Z",
+	} {
+		tm, err := time.Parse(time.RFC3339, at)
+		require.NoError(err)
+		require.Equal(expected, q.periodOf(tm).Format(time.RFC3339), at)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	require := require.New(t)
+	for s, expected := range map[string]int64{
+		"1024":    1024,
+		"50GiB":   50 << 30,
+		"1.5 TB":  1.5e12,
+		"10mb":    10e6,
+		"512 KiB": 512 << 10,
+		"7B":      7,
+	} {
+		v, err := ParseSize(s)
+		require.NoError(err, s)
+		require.Equal(expected, v, s)
+	}
+	for _, s := range []string{"", "GiB", "-1GB", "10 PB"} {
+		_, err := ParseSize(s)
+		require.Error(err, s)
+	}
+}
@@ -0,0 +1,122 @@
+package usage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Period of time the bytes are added up over
+const Period = time.Hour
+
+// Record holds the bytes relayed for a user to a destination within the
+// period starting at Time. The store may hold several records of the same
+// period, which add up.
+type Record struct {
+	Time        time.Time `json:"time"`
+	User        string    `json:"user"`
+	Destination string    `json:"dst"`
+	Upload      int64     `json:"upload"`
+	Download    int64     `json:"download"`
+}
+
+// Store keeps records in a file of JSON lines, only ever appending to it.
+type Store struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewStore(path string) *Store {
+	return &Store{path: path}
+}
+
+// Append writes the records to the end of the file in a single write, so a
+// crash never leaves part of a record behind another.
+func (s *Store) Append(records []Record) error {
+	if len(records) <= 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Read returns the records of the periods overlapping the time window, none
+// if the file does not exist yet.
+func (s *Store) Read(from, to time.Time) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []Record
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		var r Record
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("malformed usage record at line %d: %+v", line, err)
+		}
+		if r.Time.Before(to) && r.Time.Add(Period).After(from) {
+			records = append(records, r)
+		}
+	}
+	return records, sc.Err()
+}
+
+// Sum adds up the records of each user and destination, dropping the
+// destinations if byUser is set, sorted by user then destination.
+func Sum(records []Record, byUser bool) []Record {
+	type key struct{ user, dst string }
+	sums := make(map[key]*Record)
+	var keys []key
+	for _, r := range records {
+		k := key{r.User, r.Destination}
+		if byUser {
+			k.dst = ""
+		}
+		sum, ok := sums[k]
+		if !ok {
+			sum = &Record{User: k.user, Destination: k.dst}
+			sums[k] = sum
+			keys = append(keys, k)
+		}
+		sum.Upload += r.Upload
+		sum.Download += r.Download
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].user != keys[j].user {
+			return keys[i].user < keys[j].user
+		}
+		return keys[i].dst < keys[j].dst
+	})
+	result := make([]Record, len(keys))
+	for i, k := range keys {
+		result[i] = *sums[k]
+	}
+	return result
+}
@@ -0,0 +1,75 @@
+package usage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMeter(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "usage")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	store := NewStore(filepath.Join(dir, "usage.log"))
+	now := time.Now()
+
+	// Nothing has been recorded yet
+	records, err := store.Read(now.Add(-time.Hour), now)
+	require.NoError(err)
+	require.Empty(records)
+
+	m := NewMeter(store)
+	m.Add("alice", "example.com:443", 100, 1000)
+	m.Add("alice", "example.com:443", 10, 10)
+	m.Add("bob", "example.com:80", 5, 0)
+	m.Add("bob", "example.com:80", 0, 0)
+	require.NoError(m.Flush())
+	// Totals survive being flushed more than once, as after restarts
+	m = NewMeter(store)
+	m.Add("alice", "example.org:443", 1, 2)
+	require.NoError(m.Flush())
+	require.NoError(m.Flush())
+
+	records, err = store.Read(now.Add(-time.Minute), now.Add(time.Minute))
+	require.NoError(err)
+	require.Len(records, 3)
+	require.Equal([]Record{
+		{User: "alice", Destination: "example.com:443", Upload: 110, Download: 1010},
+		{User: "alice", Destination: "example.org:443", Upload: 1, Download: 2},
+		{User: "bob", Destination: "example.com:80", Upload: 5},
+	}, Sum(records, false))
+	require.Equal([]Record{
+		{User: "alice", Upload: 111, Download: 1012},
+		{User: "bob", Upload: 5},
+	}, Sum(records, true))
+
+	// Windows ending before the current period miss it
+	records, err = store.Read(now.Add(-3*time.Hour), now.Add(-2*time.Hour))
+	require.NoError(err)
+	require.Empty(records)
+}
+
+func TestMeterFlushError(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "usage")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "missing", "usage.log")
+
+	m := NewMeter(NewStore(path))
+	m.Add("alice", "example.com:443", 1, 2)
+	require.Error(m.Flush())
+	// Pending bytes are kept until the store is writable again
+	require.NoError(os.Mkdir(filepath.Dir(path), 0700))
+	require.NoError(m.Flush())
+	now := time.Now()
+	records, err := NewStore(path).Read(now.Add(-time.Minute), now)
+	require.NoError(err)
+	require.Len(records, 1)
+	require.Equal(int64(1), records[0].Upload)
+}
@@ -0,0 +1,76 @@
+package worker
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Frizz925/gilgamesh/accesslog"
+	"github.com/Frizz925/gilgamesh/acl"
+	"github.com/Frizz925/gilgamesh/socks"
+	"go.uber.org/zap"
+)
+
+// newAccess starts the access log record of a request received from c.
+func newAccess(c net.Conn, protocol, method, target string) *accesslog.Entry {
+	e := &accesslog.Entry{
+		Time:     time.Now(),
+		Protocol: protocol,
+		Method:   method,
+		Target:   target,
+	}
+	if c != nil {
+		e.Client = c.RemoteAddr().String()
+	}
+	return e
+}
+
+// logAccess completes the record of a request just served with its status
+// and writes it to the access log.
+func (w *Worker) logAccess(log *zap.Logger, e *accesslog.Entry, status string) {
+	if e == nil || w.accessLog == nil {
+		return
+	}
+	e.Status = status
+	e.Duration = time.Since(e.Time)
+	if err := w.accessLog.Log(*e); err != nil {
+		log.Error("Failed to write access log", zap.Error(err))
+	}
+}
+
+// setUpstream records the address connected to on behalf of the request,
+// which is the one of the parent proxy if dialed through it.
+func setUpstream(e *accesslog.Entry, t net.Conn, parent bool) {
+	if e != nil {
+		e.Upstream = t.RemoteAddr().String()
+		e.Parent = parent
+	}
+}
+
+// requestTarget returns the address of tunnels and the absolute URL of
+// requests to be forwarded.
+func requestTarget(req *http.Request) string {
+	if req.Method == http.MethodConnect && req.Header.Get(":protocol") == "" {
+		return req.Host
+	}
+	u := *req.URL
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+	if u.Host == "" {
+		u.Host = req.Host
+	}
+	return u.String()
+}
+
+func socksMethod(cmd byte) string {
+	switch cmd {
+	case socks.CmdConnect:
+		return acl.MethodConnect
+	case socks.CmdBind:
+		return acl.MethodBind
+	case socks.CmdUDPAssociate:
+		return acl.MethodUDP
+	}
+	return "UNKNOWN"
+}
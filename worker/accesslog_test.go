@@ -0,0 +1,101 @@
+package worker
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Frizz925/gilgamesh/accesslog"
+	"github.com/Frizz925/gilgamesh/acl"
+)
+
+type accessRecord struct {
+	Client   string `json:"client"`
+	Protocol string `json:"protocol"`
+	Method   string `json:"method"`
+	Target   string `json:"target"`
+	Status   string `json:"status"`
+	BytesIn  int64  `json:"bytes_in"`
+	BytesOut int64  `json:"bytes_out"`
+	Upstream string `json:"upstream"`
+}
+
+func (suite *WorkerTestSuite) TestAccessLog() {
+	require := suite.Require()
+	dir, err := ioutil.TempDir("", "accesslog")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "access.log")
+	al, err := accesslog.New(accesslog.Config{File: filename})
+	require.NoError(err)
+	defer al.Close()
+	w := New(Config{
+		Logger:    suite.logger,
+		AccessLog: al,
+		Ports:     PortPolicy{ConnectPorts: []acl.PortRange{{From: 443, To: 443}}},
+	})
+	done := make(chan struct{})
+	go func() {
+		w.ServeConn(suite.pipe.server)
+		close(done)
+	}()
+
+	c := suite.pipe.client
+	br, bw := bufio.NewReader(c), bufio.NewWriter(c)
+	body := "hello"
+	req, err := http.NewRequest(http.MethodPost, suite.url.String(), strings.NewReader(body))
+	require.NoError(err)
+	require.NoError(req.WriteProxy(bw))
+	require.NoError(bw.Flush())
+	res, err := http.ReadResponse(br, req)
+	require.NoError(err)
+	require.Equal(http.StatusOK, res.StatusCode)
+	_, err = ioutil.ReadAll(res.Body)
+	require.NoError(err)
+	require.NoError(res.Body.Close())
+
+	// Tunnels to ports other than 443 are refused
+	req = &http.Request{
+		Method: http.MethodConnect,
+		URL:    suite.url,
+		Host:   suite.url.Host,
+	}
+	require.NoError(req.Write(bw))
+	require.NoError(bw.Flush())
+	res, err = http.ReadResponse(br, req)
+	require.NoError(err)
+	require.Equal(http.StatusMethodNotAllowed, res.StatusCode)
+	<-done
+
+	b, err := ioutil.ReadFile(filename)
+	require.NoError(err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	require.Len(lines, 2)
+	var records [2]accessRecord
+	for i, line := range lines {
+		require.NoError(json.Unmarshal([]byte(line), &records[i]))
+		require.Equal(c.LocalAddr().String(), records[i].Client)
+		require.Equal("HTTP/1.1", records[i].Protocol)
+	}
+
+	forward := records[0]
+	require.Equal(http.MethodPost, forward.Method)
+	require.Equal(suite.url.String(), forward.Target)
+	require.Equal("200", forward.Status)
+	require.Equal(int64(len(body)), forward.BytesIn)
+	// The address actually dialed rather than the one requested
+	_, port, err := net.SplitHostPort(forward.Upstream)
+	require.NoError(err)
+	require.Equal(suite.url.Port(), port)
+
+	tunnel := records[1]
+	require.Equal(http.MethodConnect, tunnel.Method)
+	require.Equal(suite.url.Host, tunnel.Target)
+	require.Equal("405", tunnel.Status)
+	require.Empty(tunnel.Upstream)
+}
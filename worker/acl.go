@@ -0,0 +1,96 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/Frizz925/gilgamesh/acl"
+	"go.uber.org/zap"
+)
+
+// checkAccess evaluates the ACL against the destination the client at c asks
+// to reach, logging the reason of any denial. Names are looked up within the
+// dial timeout.
+func (w *Worker) checkAccess(log *zap.Logger, c net.Conn, req acl.Request) bool {
+	if w.acl == nil {
+		return true
+	}
+	if c != nil {
+		req.Source = addrIP(c.RemoteAddr())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), w.dialTimeout)
+	defer cancel()
+	d := w.acl.Check(ctx, req)
+	if !d.Allowed {
+		log.Warn("Access denied", zap.String("reason", d.Reason))
+	}
+	return d.Allowed
+}
+
+// checkUpstreamGuard checks the addresses the destination resolves to
+// against the guard before it is dialed through the upstream, whose own
+// connections cannot be checked. Destinations failing to resolve are denied.
+func (w *Worker) checkUpstreamGuard(hostport string) error {
+	if w.upstreamGuard == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return err
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), w.dialTimeout)
+		defer cancel()
+		addrs, err := w.resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return &net.OpError{Op: "dial", Net: "tcp", Err: err}
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	for _, ip := range ips {
+		if err := w.upstreamGuard.Check(ip); err != nil {
+			return &net.OpError{Op: "dial", Net: "tcp", Err: err}
+		}
+	}
+	return nil
+}
+
+// dialStatus returns the status code answering a request whose destination
+// could not be dialed.
+func dialStatus(err error) int {
+	var be *acl.BlockedError
+	if errors.As(err, &be) {
+		return http.StatusForbidden
+	}
+	if isDialTimeout(err) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func newACLRequest(user, method, hostport string) acl.Request {
+	req := acl.Request{User: user, Method: method, Host: hostport}
+	if host, port, err := net.SplitHostPort(hostport); err == nil {
+		req.Host = host
+		req.Port, _ = strconv.Atoi(port)
+	}
+	return req
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		return v.IP
+	case *net.UDPAddr:
+		return v.IP
+	}
+	return nil
+}
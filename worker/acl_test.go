@@ -0,0 +1,39 @@
+package worker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Frizz925/gilgamesh/acl"
+	"github.com/Frizz925/gilgamesh/dns"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestCheckAccessLookupTimeout(t *testing.T) {
+	require := require.New(t)
+	// DNS server never answering
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(err)
+	defer silent.Close()
+	resolver := dns.New(dns.Config{
+		Servers: []dns.Server{{Network: "udp", Address: silent.LocalAddr().String()}},
+		Timeout: 10 * time.Second,
+	})
+	_, private, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(err)
+	w := New(Config{
+		Logger: zap.NewNop(),
+		ACL: acl.New(acl.Config{
+			Rules:    []acl.Rule{{Action: acl.Deny, Networks: []*net.IPNet{private}}},
+			Resolver: resolver,
+		}),
+		DialTimeout: 100 * time.Millisecond,
+	})
+
+	// Destinations failing to resolve in time are denied
+	start := time.Now()
+	require.False(w.checkAccess(w.logger, nil, newACLRequest("", acl.MethodConnect, "hung.test:443")))
+	require.Less(int64(time.Since(start)), int64(time.Second))
+}
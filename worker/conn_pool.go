@@ -0,0 +1,174 @@
+package worker
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Frizz925/gilgamesh/utils"
+)
+
+const (
+	DefaultMaxIdleConnsPerHost = 2
+	DefaultIdleConnTimeout     = 90 * time.Second
+)
+
+// Read deadline used to probe whether an idle connection is still usable
+const healthCheckTimeout = time.Millisecond
+
+type ConnPoolConfig struct {
+	// Maximum number of idle connections across all hosts, zero means no limit
+	MaxIdleConns int
+	// Maximum number of idle connections kept for each host:port
+	MaxIdleConnsPerHost int
+	// How long a connection may stay idle before it is closed
+	IdleConnTimeout time.Duration
+	// Probe idle connections before handing them out again
+	HealthCheck bool
+}
+
+// ConnPool keeps idle upstream connections around so that they can be shared
+// between workers forwarding plain HTTP requests to the same destination.
+type ConnPool struct {
+	noCopy utils.NoCopy //nolint:unused,structcheck
+
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+	healthCheck         bool
+
+	idle   map[string][]*idleConn
+	count  int
+	closed bool
+	mu     sync.Mutex
+}
+
+type idleConn struct {
+	net.Conn
+	hostport string
+	timer    *time.Timer
+}
+
+func NewConnPool(cfg ConnPoolConfig) *ConnPool {
+	if cfg.MaxIdleConnsPerHost <= 0 {
+		cfg.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	}
+	if cfg.IdleConnTimeout <= 0 {
+		cfg.IdleConnTimeout = DefaultIdleConnTimeout
+	}
+	return &ConnPool{
+		maxIdleConns:        cfg.MaxIdleConns,
+		maxIdleConnsPerHost: cfg.MaxIdleConnsPerHost,
+		idleConnTimeout:     cfg.IdleConnTimeout,
+		healthCheck:         cfg.HealthCheck,
+		idle:                make(map[string][]*idleConn),
+	}
+}
+
+// Get returns an idle connection to the given destination, or nil if there is
+// no usable one in the pool.
+func (p *ConnPool) Get(hostport string) net.Conn {
+	for {
+		p.mu.Lock()
+		conns := p.idle[hostport]
+		if len(conns) <= 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		// Most recently used connections are the most likely to be alive
+		ic := conns[len(conns)-1]
+		p.removeLocked(ic)
+		p.mu.Unlock()
+
+		ic.timer.Stop()
+		if !p.healthCheck || isHealthy(ic.Conn) {
+			return ic.Conn
+		}
+		_ = ic.Conn.Close()
+	}
+}
+
+// Put returns a connection to the pool. The connection is closed instead if
+// the pool has no more room for it.
+func (p *ConnPool) Put(hostport string, c net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed ||
+		len(p.idle[hostport]) >= p.maxIdleConnsPerHost ||
+		(p.maxIdleConns > 0 && p.count >= p.maxIdleConns) {
+		_ = c.Close()
+		return false
+	}
+	ic := &idleConn{Conn: c, hostport: hostport}
+	ic.timer = time.AfterFunc(p.idleConnTimeout, func() {
+		p.expire(ic)
+	})
+	p.idle[hostport] = append(p.idle[hostport], ic)
+	p.count++
+	return true
+}
+
+// Len returns the number of idle connections in the pool.
+func (p *ConnPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.count
+}
+
+func (p *ConnPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conns := range p.idle {
+		for _, ic := range conns {
+			ic.timer.Stop()
+			_ = ic.Conn.Close()
+		}
+	}
+	p.idle = make(map[string][]*idleConn)
+	p.count = 0
+	p.closed = true
+}
+
+func (p *ConnPool) expire(ic *idleConn) {
+	p.mu.Lock()
+	removed := p.removeLocked(ic)
+	p.mu.Unlock()
+	if removed {
+		_ = ic.Conn.Close()
+	}
+}
+
+func (p *ConnPool) removeLocked(ic *idleConn) bool {
+	conns := p.idle[ic.hostport]
+	for i, v := range conns {
+		if v != ic {
+			continue
+		}
+		copy(conns[i:], conns[i+1:])
+		conns[len(conns)-1] = nil
+		conns = conns[:len(conns)-1]
+		if len(conns) > 0 {
+			p.idle[ic.hostport] = conns
+		} else {
+			delete(p.idle, ic.hostport)
+		}
+		p.count--
+		return true
+	}
+	return false
+}
+
+// isHealthy reports whether the idle connection has neither been closed by
+// the remote nor received unsolicited data while sitting in the pool.
+func isHealthy(c net.Conn) bool {
+	if err := c.SetReadDeadline(time.Now().Add(healthCheckTimeout)); err != nil {
+		return false
+	}
+	var b [1]byte
+	_, err := c.Read(b[:])
+	if err := c.SetReadDeadline(time.Time{}); err != nil {
+		return false
+	}
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,79 @@
+package worker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnPool(t *testing.T) {
+	require := require.New(t)
+	p := NewConnPool(ConnPoolConfig{MaxIdleConnsPerHost: 1})
+	defer p.Close()
+
+	require.Nil(p.Get("example.com:80"))
+	c1, _ := net.Pipe()
+	c2, _ := net.Pipe()
+	require.True(p.Put("example.com:80", c1))
+	require.False(p.Put("example.com:80", c2))
+	require.Equal(1, p.Len())
+
+	require.Nil(p.Get("example.org:80"))
+	require.Equal(c1, p.Get("example.com:80"))
+	require.Equal(0, p.Len())
+}
+
+func TestConnPoolMaxIdleConns(t *testing.T) {
+	require := require.New(t)
+	p := NewConnPool(ConnPoolConfig{MaxIdleConns: 1})
+	defer p.Close()
+
+	c1, _ := net.Pipe()
+	c2, _ := net.Pipe()
+	require.True(p.Put("example.com:80", c1))
+	require.False(p.Put("example.org:80", c2))
+	require.Equal(1, p.Len())
+}
+
+func TestConnPoolIdleTimeout(t *testing.T) {
+	require := require.New(t)
+	p := NewConnPool(ConnPoolConfig{IdleConnTimeout: time.Millisecond})
+	defer p.Close()
+
+	c, _ := net.Pipe()
+	require.True(p.Put("example.com:80", c))
+	require.Eventually(func() bool {
+		return p.Len() == 0
+	}, time.Second, time.Millisecond)
+	require.Nil(p.Get("example.com:80"))
+}
+
+func TestConnPoolHealthCheck(t *testing.T) {
+	require := require.New(t)
+	p := NewConnPool(ConnPoolConfig{HealthCheck: true})
+	defer p.Close()
+
+	alive, alivePeer := net.Pipe()
+	defer alivePeer.Close()
+	dead, deadPeer := net.Pipe()
+	require.NoError(deadPeer.Close())
+
+	require.True(p.Put("example.com:80", alive))
+	require.True(p.Put("example.com:80", dead))
+	require.Equal(alive, p.Get("example.com:80"))
+	require.Equal(0, p.Len())
+}
+
+func TestConnPoolClose(t *testing.T) {
+	require := require.New(t)
+	p := NewConnPool(ConnPoolConfig{})
+	c, _ := net.Pipe()
+	require.True(p.Put("example.com:80", c))
+	p.Close()
+	require.Equal(0, p.Len())
+
+	c, _ = net.Pipe()
+	require.False(p.Put("example.com:80", c))
+}
@@ -0,0 +1,31 @@
+package worker
+
+import "go.uber.org/zap"
+
+const reasonUserConns = "user connection limit"
+
+// holdUser counts the peer connection as one of the user's, uncounting it
+// from the user it was counted under before. Anonymous connections are left
+// to the limit of their client address.
+func (w *Worker) holdUser(log *zap.Logger, user string) bool {
+	if user == w.heldUser {
+		return true
+	}
+	w.releaseUser()
+	if user == "" {
+		return true
+	}
+	if !w.userConns.Acquire(user) {
+		log.Warn("Too many connections", zap.String("reason", reasonUserConns))
+		return false
+	}
+	w.heldUser = user
+	return true
+}
+
+func (w *Worker) releaseUser() {
+	if w.heldUser != "" {
+		w.userConns.Release(w.heldUser)
+		w.heldUser = ""
+	}
+}
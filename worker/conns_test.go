@@ -0,0 +1,32 @@
+package worker
+
+import (
+	"net/http"
+
+	"github.com/Frizz925/gilgamesh/auth"
+	"github.com/Frizz925/gilgamesh/ratelimit"
+)
+
+func (suite *WorkerTestSuite) TestUserConnsExceeded() {
+	require := suite.Require()
+	pw, err := auth.CreatePassword([]byte(suite.password))
+	require.NoError(err)
+	// Another connection of the user is already open
+	conns := ratelimit.NewConnLimit(1)
+	require.True(conns.Acquire(suite.username))
+	w := New(Config{
+		Logger:      suite.logger,
+		Credentials: auth.Credentials{suite.username: pw},
+		UserConns:   conns,
+	})
+	go w.ServeConn(suite.pipe.server)
+
+	res, err := suite.client.Do(&http.Request{
+		URL:    suite.url,
+		Header: createAuthHeader(suite.username, suite.password),
+	})
+	require.NoError(err)
+	require.Equal(http.StatusTooManyRequests, res.StatusCode)
+	require.NoError(res.Body.Close())
+	require.Equal(1, conns.Counts()[suite.username])
+}
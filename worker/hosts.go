@@ -0,0 +1,105 @@
+package worker
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// HostRule redirects a destination name, or name:port, to another address.
+// The port of the destination is kept when the address has none.
+type HostRule struct {
+	From string
+	To   string
+}
+
+// Hosts overrides the address of destinations before they are dialed. It can
+// be updated while in use by any number of workers.
+type Hosts struct {
+	rules atomic.Value
+}
+
+func NewHosts(rules []HostRule) (*Hosts, error) {
+	h := &Hosts{}
+	if err := h.Update(rules); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Update replaces every rule, keeping the current ones if any is invalid.
+func (h *Hosts) Update(rules []HostRule) error {
+	m := make(map[string]string, len(rules))
+	for _, rule := range rules {
+		from, err := normalizeHostRule(rule.From)
+		if err != nil {
+			return err
+		}
+		if _, err := normalizeHostRule(rule.To); err != nil {
+			return err
+		}
+		m[from] = rule.To
+	}
+	h.rules.Store(m)
+	return nil
+}
+
+// Rewrite returns the address the destination is redirected to, rules naming
+// the port taking precedence over the ones naming the host alone.
+func (h *Hosts) Rewrite(hostport string) (string, bool) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport, false
+	}
+	m := h.rules.Load().(map[string]string)
+	host = normalizeHostName(host)
+	to, ok := m[net.JoinHostPort(host, port)]
+	if !ok {
+		if to, ok = m[host]; !ok {
+			return hostport, false
+		}
+	}
+	if _, _, err := net.SplitHostPort(to); err == nil {
+		return to, true
+	}
+	return net.JoinHostPort(strings.Trim(to, "[]"), port), true
+}
+
+// rewriteDestination returns the address the destination is actually dialed
+// at, logging any rewrite.
+func (w *Worker) rewriteDestination(log *zap.Logger, hostport string) string {
+	if w.hosts == nil {
+		return hostport
+	}
+	target, ok := w.hosts.Rewrite(hostport)
+	if ok {
+		log.Info("Rewriting destination", zap.String("actual_dst", target))
+	}
+	return target
+}
+
+func normalizeHostRule(s string) (string, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		host, port = strings.Trim(s, "[]"), ""
+	}
+	if host == "" {
+		return "", fmt.Errorf("invalid host rule address: %s", s)
+	}
+	host = normalizeHostName(host)
+	if port == "" {
+		return host, nil
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("invalid host rule port: %s", s)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func normalizeHostName(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
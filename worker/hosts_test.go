@@ -0,0 +1,40 @@
+package worker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHosts(t *testing.T) {
+	require := require.New(t)
+	h, err := NewHosts([]HostRule{
+		{From: "api.example.com", To: "192.0.2.10"},
+		{From: "api.example.com:8080", To: "127.0.0.1:9000"},
+		{From: "Sidecar.Example.com.", To: "[::1]:8443"},
+		{From: "[2001:db8::1]", To: "2001:db8::2"},
+	})
+	require.NoError(err)
+
+	for hostport, expected := range map[string]string{
+		"api.example.com:443":    "192.0.2.10:443",
+		"API.example.com:8080":   "127.0.0.1:9000",
+		"sidecar.example.com:80": "[::1]:8443",
+		"[2001:db8::1]:443":      "[2001:db8::2]:443",
+		"www.example.com:443":    "www.example.com:443",
+	} {
+		actual, ok := h.Rewrite(hostport)
+		require.Equal(expected, actual, hostport)
+		require.Equal(expected != hostport, ok, hostport)
+	}
+
+	// Invalid rules leave the current ones in place
+	require.Error(h.Update([]HostRule{{From: "example.com:http", To: "192.0.2.1"}}))
+	require.Error(h.Update([]HostRule{{From: "example.com", To: ""}}))
+	actual, _ := h.Rewrite("api.example.com:443")
+	require.Equal("192.0.2.10:443", actual)
+
+	require.NoError(h.Update(nil))
+	_, ok := h.Rewrite("api.example.com:443")
+	require.False(ok)
+}
@@ -0,0 +1,405 @@
+package worker
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Frizz925/gilgamesh/utils"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+// ALPN protocol identifier of HTTP/2 over TLS
+const HTTP2Proto = "h2"
+
+var errListenerClosed = errors.New("listener closed")
+
+// ServeHTTP2 serves a TLS connection which negotiated HTTP/2, multiplexing
+// any number of tunnels and proxied requests over it. Streams are served
+// concurrently, so they only ever use the configuration of the worker.
+func (w *Worker) ServeHTTP2(c net.Conn) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	log := w.logger.With(
+		zap.String("src", c.RemoteAddr().String()),
+		zap.String("listener", c.LocalAddr().String()),
+		zap.String("protocol", "h2"),
+	)
+	log.Info("Serving new connection")
+	defer log.Info("Closed connection")
+	// Idle whenever no stream is open
+	w.idle.Set(true)
+	defer w.idle.Set(false)
+
+	l := newConnListener(c)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			w.serveStream(log, c, rw, req)
+		}),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				_ = l.Close()
+			}
+		},
+		ReadHeaderTimeout: w.headerTimeout,
+		IdleTimeout:       w.idleTimeout,
+		ErrorLog:          zap.NewStdLog(log),
+	}
+	_ = srv.Serve(l)
+}
+
+// serveStream handles a single request stream, either a tunnel opened with
+// CONNECT or a plain request to be forwarded.
+func (w *Worker) serveStream(log *zap.Logger, c net.Conn, rw http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	atomic.AddInt32(&w.streams, 1)
+	defer atomic.AddInt32(&w.streams, -1)
+	sw := &statusWriter{ResponseWriter: rw}
+	access := newAccess(c, req.Proto, req.Method, requestTarget(req))
+	defer func() {
+		w.logAccess(log, access, sw.outcome())
+		w.countOutcome("h2", sw.outcome())
+	}()
+	rw = sw
+	if d := w.checkIPRequestRate(log, c); d > 0 {
+		rw.Header().Set("Retry-After", retryAfter(d))
+		writeStreamStatus(rw, http.StatusTooManyRequests)
+		return
+	}
+	log, user, code := w.authorizeRequest(log, req)
+	if code > 0 {
+		writeStreamStatus(rw, code)
+		return
+	}
+	access.User = user
+	// Streams are counted as connections of their own
+	if user != "" {
+		if !w.userConns.Acquire(user) {
+			log.Warn("Too many connections", zap.String("reason", reasonUserConns))
+			writeStreamStatus(rw, http.StatusTooManyRequests)
+			return
+		}
+		defer w.userConns.Release(user)
+	}
+	if d := w.checkUserRequestRate(log, user); d > 0 {
+		rw.Header().Set("Retry-After", retryAfter(d))
+		writeStreamStatus(rw, http.StatusTooManyRequests)
+		return
+	}
+	quota := w.quota.User(user)
+	if !checkQuota(log, quota) {
+		rw.Header().Set("Proxy-Status", quotaProxyStatus)
+		writeStreamStatus(rw, http.StatusForbidden)
+		return
+	}
+	bandwidth := w.bandwidthOf(user)
+
+	// Extended CONNECT as described in RFC 8441
+	protocol := req.Header.Get(":protocol")
+	if req.Method == http.MethodConnect && protocol == "" {
+		log = log.With(zap.String("dst", req.Host))
+		if !w.checkAccess(log, c, newACLRequest(user, req.Method, req.Host)) {
+			writeStreamStatus(rw, http.StatusForbidden)
+			return
+		}
+		if code := w.checkPort(log, user, req.Method, req.Host); code > 0 {
+			writeStreamStatus(rw, code)
+			return
+		}
+		w.serveStreamConnect(log, c, rw, req, bandwidth, traffic{user: user, dst: req.Host, quota: quota, access: access})
+		return
+	}
+	if req.Host == "" {
+		log.Error("Unknown request target host", zap.String("url", req.URL.String()))
+		writeStreamStatus(rw, http.StatusBadRequest)
+		return
+	}
+	hostport := req.Host
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		hostport = net.JoinHostPort(hostport, "80")
+	}
+	log = log.With(zap.String("dst", hostport))
+	if !w.checkAccess(log, c, newACLRequest(user, req.Method, hostport)) {
+		writeStreamStatus(rw, http.StatusForbidden)
+		return
+	}
+	if code := w.checkPort(log, user, req.Method, hostport); code > 0 {
+		writeStreamStatus(rw, code)
+		return
+	}
+	w.serveStreamForward(log, c, rw, req, hostport, protocol, bandwidth, traffic{user: user, dst: hostport, quota: quota, access: access})
+}
+
+func (w *Worker) serveStreamConnect(log *zap.Logger, c net.Conn, rw http.ResponseWriter, req *http.Request, bandwidth bandwidth, traffic traffic) {
+	log.Info("Opening proxy connection")
+	t, err := w.dialTunnel(log, c, req.Host)
+	if err != nil {
+		log.Error("Failed to establish tunnel", w.dialErrorFields(err)...)
+		writeStreamStatus(rw, dialStatus(err))
+		return
+	}
+	defer t.Close()
+	setUpstream(traffic.access, t, w.parent)
+	rw.WriteHeader(http.StatusOK)
+	w.relayStream(log, rw, req, t, t, bandwidth, traffic)
+}
+
+// serveStreamForward sends the request to the destination over plain
+// HTTP/1.1, since secure destinations are reached through CONNECT instead.
+// Extended CONNECT requests are turned into the matching protocol upgrade.
+func (w *Worker) serveStreamForward(log *zap.Logger, c net.Conn, rw http.ResponseWriter, req *http.Request, hostport, protocol string, bandwidth bandwidth, traffic traffic) {
+	outreq := req.Clone(context.Background())
+	outreq.Proto, outreq.ProtoMajor, outreq.ProtoMinor = "HTTP/1.1", 1, 1
+	outreq.URL.Scheme = "http"
+	outreq.URL.Host = req.Host
+	outreq.RequestURI = ""
+	outreq.Close = false
+	removeHopHeaders(outreq.Header)
+	outreq.Header.Del(":protocol")
+	if protocol != "" {
+		outreq.Method = http.MethodGet
+		outreq.Body, outreq.ContentLength = nil, 0
+		outreq.Header.Set("Connection", "Upgrade")
+		outreq.Header.Set("Upgrade", protocol)
+		if protocol == "websocket" && outreq.Header.Get("Sec-WebSocket-Key") == "" {
+			outreq.Header.Set("Sec-WebSocket-Key", newWebSocketKey())
+		}
+	}
+	if _, ok := outreq.Header["User-Agent"]; !ok {
+		outreq.Header.Set("User-Agent", "")
+	}
+	var upload int64
+	outreq.Body = countBody(limitBody(outreq.Body, bandwidth.upload), &upload)
+
+	hostport = w.rewriteDestination(log, hostport)
+	if err := w.checkUpstreamGuard(hostport); err != nil {
+		log.Error("Failed to establish tunnel", w.dialErrorFields(err)...)
+		writeStreamStatus(rw, dialStatus(err))
+		return
+	}
+	t, private, _, err := w.dialUpstream(log, c, hostport, true)
+	if err != nil {
+		log.Error("Failed to establish tunnel", w.dialErrorFields(err)...)
+		writeStreamStatus(rw, dialStatus(err))
+		return
+	}
+	setUpstream(traffic.access, t, w.parent)
+	// The destination stalling ends the request like an idle tunnel
+	watch := w.watchForward(t)
+	reusable := false
+	defer func() {
+		if reason := watch.stop(); reason != "" {
+			reusable = false
+		}
+		if reusable && !private && w.connPool != nil {
+			w.connPool.Put(w.upstreamKey(hostport), t)
+		} else {
+			_ = t.Close()
+		}
+	}()
+	outreq.Body = watch.body(outreq.Body)
+
+	if w.forwarder != nil {
+		w.forwarder.PrepareForward(outreq)
+		err = outreq.WriteProxy(t)
+	} else {
+		err = outreq.Write(t)
+	}
+	if err != nil {
+		writeForwardError(log, rw, watch, err)
+		return
+	}
+	watch.touch()
+	tr := bufio.NewReaderSize(watch.reader(t), w.readBufferSize)
+	res, err := readFinalResponse(tr, outreq)
+	if err != nil {
+		writeForwardError(log, rw, watch, err)
+		return
+	}
+	defer res.Body.Close()
+
+	if protocol != "" && res.StatusCode == http.StatusSwitchingProtocols {
+		if watch.stop() != "" {
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+		w.relayStream(log, rw, req, t, tr, bandwidth, traffic)
+		return
+	}
+	removeHopHeaders(res.Header)
+	for k, vv := range res.Header {
+		rw.Header()[k] = vv
+	}
+	rw.WriteHeader(res.StatusCode)
+	download, err := io.Copy(newFlushWriter(rw), limitBody(res.Body, bandwidth.download))
+	upload = atomic.LoadInt64(&upload)
+	w.account(traffic, upload, download)
+	traffic.quota.Add(upload + download)
+	if err != nil {
+		if reason := watch.stop(); reason != "" {
+			log.Info("Forward timed out", zap.String("reason", reason))
+		} else {
+			log.Error("Failed to forward response", zap.Error(err))
+		}
+		return
+	}
+	reusable = protocol == "" && !res.Close && tr.Buffered() <= 0
+}
+
+// writeForwardError answers a stream whose request could not be forwarded,
+// with a gateway timeout if the watch ended it.
+func writeForwardError(log *zap.Logger, rw http.ResponseWriter, watch *tunnelWatch, err error) {
+	if reason := watch.stop(); reason != "" {
+		log.Info("Forward timed out", zap.String("reason", reason))
+		writeStreamStatus(rw, http.StatusGatewayTimeout)
+		return
+	}
+	log.Error("Failed to forward request", zap.Error(err))
+	writeStreamStatus(rw, http.StatusBadGateway)
+}
+
+// relayStream copies bytes in both directions between the stream and the
+// tunnel, half-closing the tunnel once the client ends the stream.
+func (w *Worker) relayStream(log *zap.Logger, rw http.ResponseWriter, req *http.Request, t net.Conn, tr io.Reader, bandwidth bandwidth, traffic traffic) {
+	fw := newFlushWriter(rw)
+	fw.Flush()
+	watch := w.watchTunnel(t)
+	var done utils.AtomicBool
+	var upload, download int64
+	g := &errgroup.Group{}
+	// Stream -> Proxy -> Tunnel
+	g.Go(func() error {
+		var err error
+		upload, err = io.Copy(t, bandwidth.upload.Reader(w.quotaReader(watch.reader(req.Body), traffic.quota, watch)))
+		if err != nil {
+			_ = t.Close()
+			if done.Get() {
+				return nil
+			}
+			return err
+		}
+		if cw, ok := t.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		}
+		return nil
+	})
+	// Tunnel -> Proxy -> Stream
+	g.Go(func() error {
+		var err error
+		download, err = io.Copy(fw, bandwidth.download.Reader(w.quotaReader(watch.reader(tr), traffic.quota, watch)))
+		done.Set(true)
+		_ = req.Body.Close()
+		return err
+	})
+	err := g.Wait()
+	w.account(traffic, upload, download)
+	if reason := watch.stop(); reason == reasonQuotaExceeded {
+		log.Warn("Tunnel closed", zap.String("reason", reason))
+	} else if reason == reasonShutdown {
+		log.Info("Tunnel closed", zap.String("reason", reason))
+	} else if reason != "" {
+		log.Info("Tunnel timed out", zap.String("reason", reason))
+	} else if err != nil {
+		log.Error("Tunnel error", zap.Error(err))
+	}
+}
+
+// readFinalResponse skips any interim responses sent ahead of the final one.
+// Switching protocols is final for requests asking to upgrade.
+func readFinalResponse(tr *bufio.Reader, req *http.Request) (*http.Response, error) {
+	for {
+		res, err := http.ReadResponse(tr, req)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode >= 200 || res.StatusCode == http.StatusSwitchingProtocols {
+			return res, nil
+		}
+	}
+}
+
+func writeStreamStatus(rw http.ResponseWriter, code int) {
+	if code == http.StatusProxyAuthRequired {
+		rw.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=\"%s\"", authRealm))
+	}
+	rw.WriteHeader(code)
+}
+
+func newWebSocketKey() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return base64.StdEncoding.EncodeToString(b[:])
+}
+
+// flushWriter flushes every write so tunneled and streamed bytes are not held
+// back by the stream buffers.
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func newFlushWriter(rw http.ResponseWriter) flushWriter {
+	f, _ := rw.(http.Flusher)
+	return flushWriter{w: rw, f: f}
+}
+
+func (fw flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	fw.Flush()
+	return n, err
+}
+
+func (fw flushWriter) Flush() {
+	if fw.f != nil {
+		fw.f.Flush()
+	}
+}
+
+// connListener hands a single connection over to http.Server, which takes
+// care of HTTP/2 once ALPN has selected it.
+type connListener struct {
+	conns chan net.Conn
+	addr  net.Addr
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnListener(c net.Conn) *connListener {
+	l := &connListener{
+		conns: make(chan net.Conn, 1),
+		addr:  c.LocalAddr(),
+		done:  make(chan struct{}),
+	}
+	l.conns <- c
+	return l
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
@@ -0,0 +1,90 @@
+package worker
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Frizz925/gilgamesh/acl"
+)
+
+// Outcome of requests answered by closing the connection
+const outcomeNone = "none"
+
+// Reasons of failed authentications
+const (
+	authMalformed        = "malformed"
+	authUnknownUser      = "unknown_user"
+	authPasswordMismatch = "password_mismatch"
+	authPasswordRequired = "password_required"
+)
+
+// recordOutcome counts the request just served over the protocol by the
+// response given to it, clearing the response for the next request.
+func (w *Worker) recordOutcome(protocol string) {
+	w.countOutcome(protocol, w.outcome)
+	w.outcome = ""
+}
+
+func (w *Worker) countOutcome(protocol, outcome string) {
+	if outcome == "" {
+		outcome = outcomeNone
+	}
+	w.metrics.Outcomes.With(protocol, outcome).Inc()
+}
+
+func (w *Worker) authFailed(reason string) {
+	w.metrics.AuthFailures.With(reason).Inc()
+}
+
+// observeDial records the time taken by a dial started at the given time.
+func (w *Worker) observeDial(start time.Time, err error) {
+	w.metrics.DialLatency.With(dialResult(err)).Observe(time.Since(start).Seconds())
+}
+
+func dialResult(err error) string {
+	var be *acl.BlockedError
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.As(err, &be):
+		return "blocked"
+	case isDialTimeout(err):
+		return "timeout"
+	}
+	return "error"
+}
+
+// statusWriter remembers the status code written to a stream.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.code == 0 {
+		sw.code = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.code == 0 {
+		sw.code = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sw *statusWriter) outcome() string {
+	if sw.code == 0 {
+		return ""
+	}
+	return strconv.Itoa(sw.code)
+}
@@ -0,0 +1,79 @@
+package worker
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/Frizz925/gilgamesh/auth"
+	"github.com/Frizz925/gilgamesh/metrics"
+)
+
+func (suite *WorkerTestSuite) TestMetrics() {
+	require := suite.Require()
+	m := metrics.NewProxy(nil)
+	w := New(Config{
+		Logger:  suite.logger,
+		Metrics: m,
+	})
+	done := make(chan struct{})
+	go func() {
+		w.ServeConn(suite.pipe.server)
+		close(done)
+	}()
+
+	// The upstream connection is dialed once and kept alive
+	for i := 0; i < 2; i++ {
+		res, err := suite.client.Get(suite.url.String())
+		require.NoError(err)
+		require.Equal(http.StatusOK, res.StatusCode)
+		require.NoError(res.Body.Close())
+	}
+	// Requests are counted once served
+	require.NoError(suite.pipe.client.Close())
+	<-done
+
+	out := scrapeMetrics(m)
+	require.Contains(out, `gilgamesh_requests_total{protocol="http",code="200"} 2`)
+	require.Contains(out, `gilgamesh_dial_duration_seconds_count{result="ok"} 1`)
+	require.Contains(out, `gilgamesh_bytes_total{direction="download"}`)
+	require.NotContains(out, `gilgamesh_auth_failures_total{`)
+}
+
+func (suite *WorkerTestSuite) TestMetricsAuthFailure() {
+	require := suite.Require()
+	pw, err := auth.CreatePassword([]byte(suite.password))
+	require.NoError(err)
+	m := metrics.NewProxy(nil)
+	w := New(Config{
+		Logger:      suite.logger,
+		Credentials: auth.Credentials{suite.username: pw},
+		Metrics:     m,
+	})
+	done := make(chan struct{})
+	go func() {
+		w.ServeConn(suite.pipe.server)
+		close(done)
+	}()
+
+	req, err := http.NewRequest(http.MethodGet, suite.url.String(), nil)
+	require.NoError(err)
+	creds := base64.URLEncoding.EncodeToString([]byte(suite.username + ":wrong"))
+	req.Header.Set(authHeaderName, authHeaderPrefix+creds)
+	res, err := suite.client.Do(req)
+	require.NoError(err)
+	require.Equal(http.StatusForbidden, res.StatusCode)
+	require.NoError(res.Body.Close())
+	<-done
+
+	out := scrapeMetrics(m)
+	require.Contains(out, `gilgamesh_auth_failures_total{reason="password_mismatch"} 1`)
+	require.Contains(out, `gilgamesh_requests_total{protocol="http",code="403"} 1`)
+	require.NotContains(out, `gilgamesh_dial_duration_seconds_count{`)
+}
+
+func scrapeMetrics(m *metrics.Proxy) string {
+	rec := httptest.NewRecorder()
+	m.Registry.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	return rec.Body.String()
+}
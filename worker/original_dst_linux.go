@@ -0,0 +1,74 @@
+//go:build linux
+// +build linux
+
+package worker
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// From linux/netfilter_ipv4.h, also used as IP6T_SO_ORIGINAL_DST
+const soOriginalDst = 80
+
+// originalDst recovers the destination of a connection redirected by
+// iptables REDIRECT. Connections intercepted by TPROXY have no NAT entry
+// and are bound to the original destination already.
+func originalDst(c net.Conn) (*net.TCPAddr, error) {
+	// Connections which came with a PROXY protocol header wrap the socket
+	if nc, ok := c.(interface{ NetConn() net.Conn }); ok {
+		c = nc.NetConn()
+	}
+	la, ok := c.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("not a TCP connection")
+	}
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("connection does not expose its socket")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var addr *net.TCPAddr
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if la.IP.To4() != nil {
+			// sockaddr_in fits in the 16 bytes of ipv6_mreq
+			var mreq *syscall.IPv6Mreq
+			mreq, serr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+			if serr == nil {
+				b := mreq.Multiaddr
+				addr = &net.TCPAddr{
+					IP:   net.IPv4(b[4], b[5], b[6], b[7]),
+					Port: int(b[2])<<8 | int(b[3]),
+				}
+			}
+			return
+		}
+		// sockaddr_in6 fits in ip6_mtuinfo
+		var info *syscall.IPv6MTUInfo
+		info, serr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+		if serr == nil {
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			addr = &net.TCPAddr{
+				IP:   net.IP(append([]byte(nil), info.Addr.Addr[:]...)),
+				Port: int(port[0])<<8 | int(port[1]),
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if errors.Is(serr, syscall.ENOENT) || errors.Is(serr, syscall.ENOPROTOOPT) {
+		return la, nil
+	}
+	if serr != nil {
+		return nil, serr
+	}
+	return addr, nil
+}
@@ -0,0 +1,31 @@
+//go:build linux
+// +build linux
+
+package worker
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Frizz925/gilgamesh/proxyproto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOriginalDstProxyProtocol(t *testing.T) {
+	require := require.New(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(err)
+	defer client.Close()
+	server, err := l.Accept()
+	require.NoError(err)
+	defer server.Close()
+
+	// Without any NAT entry the destination is the listener itself
+	src := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 56324}
+	dst, err := originalDst(proxyproto.NewConn(server, &proxyproto.Header{Source: src}))
+	require.NoError(err)
+	require.Equal(l.Addr().String(), dst.String())
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package worker
+
+import (
+	"errors"
+	"net"
+)
+
+func originalDst(_ net.Conn) (*net.TCPAddr, error) {
+	return nil, errors.New("transparent proxy is only supported on Linux")
+}
@@ -2,7 +2,9 @@ package worker
 
 import (
 	"sync"
+	"sync/atomic"
 
+	"github.com/Frizz925/gilgamesh/metrics"
 	"github.com/Frizz925/gilgamesh/utils"
 )
 
@@ -12,12 +14,17 @@ type Pool struct {
 	ch           chan *Worker
 	pool         *sync.Pool
 	preallocated bool
+	busy         int64
 }
 
 func NewPool(size int, cfg Config) *Pool {
 	p := &Pool{
 		preallocated: size > 0,
 	}
+	if cfg.Metrics == nil {
+		// Shared by the workers rather than each having its own
+		cfg.Metrics = metrics.NewProxy(nil)
+	}
 	if p.preallocated {
 		p.ch = make(chan *Worker, size)
 		for i := 0; i < size; i++ {
@@ -34,6 +41,7 @@ func NewPool(size int, cfg Config) *Pool {
 }
 
 func (p *Pool) Get() *Worker {
+	defer atomic.AddInt64(&p.busy, 1)
 	if !p.preallocated {
 		return p.pool.Get().(*Worker)
 	}
@@ -41,6 +49,7 @@ func (p *Pool) Get() *Worker {
 }
 
 func (p *Pool) Put(w *Worker) {
+	atomic.AddInt64(&p.busy, -1)
 	if !p.preallocated {
 		p.pool.Put(w)
 		return
@@ -52,6 +61,17 @@ func (p *Pool) Put(w *Worker) {
 	}
 }
 
+// Size returns the number of pre-allocated workers, zero if the pool grows
+// as needed.
+func (p *Pool) Size() int {
+	return cap(p.ch)
+}
+
+// Busy returns the number of workers taken out of the pool.
+func (p *Pool) Busy() int {
+	return int(atomic.LoadInt64(&p.busy))
+}
+
 func (p *Pool) Close() {
 	if !p.preallocated {
 		return
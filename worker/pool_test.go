@@ -23,16 +23,24 @@ func (suite *PoolTestSuite) SetupSuite() {
 }
 
 func (suite *PoolTestSuite) TestPreallocated() {
+	require := suite.Require()
 	p := NewPool(16, suite.config)
+	require.Equal(16, p.Size())
 	w := p.Get()
+	require.Equal(1, p.Busy())
 	p.Put(w)
+	require.Equal(0, p.Busy())
 	p.Close()
 }
 
 func (suite *PoolTestSuite) TestDynamic() {
+	require := suite.Require()
 	p := NewPool(0, suite.config)
+	require.Equal(0, p.Size())
 	w := p.Get()
+	require.Equal(1, p.Busy())
 	p.Put(w)
+	require.Equal(0, p.Busy())
 	p.Close()
 }
 
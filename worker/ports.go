@@ -0,0 +1,50 @@
+package worker
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/Frizz925/gilgamesh/acl"
+	"go.uber.org/zap"
+)
+
+// PortPolicy restricts the destination ports of tunnels and of forwarded
+// plain HTTP requests, a nil set allowing any port.
+type PortPolicy struct {
+	ConnectPorts []acl.PortRange
+	HTTPPorts    []acl.PortRange
+}
+
+// checkPort returns the status code answering a request of the user to a
+// destination port outside of its allowed set, zero otherwise. Tunnels are
+// answered with 405 and plain requests with 403, telling them apart from
+// each other and from the 403 of other denials.
+func (w *Worker) checkPort(log *zap.Logger, user, method, hostport string) int {
+	policy := w.ports
+	if v, ok := w.userPorts[user]; ok {
+		if v.ConnectPorts != nil {
+			policy.ConnectPorts = v.ConnectPorts
+		}
+		if v.HTTPPorts != nil {
+			policy.HTTPPorts = v.HTTPPorts
+		}
+	}
+	_, s, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return http.StatusBadRequest
+	}
+	port, _ := strconv.Atoi(s)
+	if method == http.MethodConnect {
+		if policy.ConnectPorts != nil && !acl.MatchPort(policy.ConnectPorts, port) {
+			log.Warn("Tunnel to disallowed port", zap.Int("port", port))
+			return http.StatusMethodNotAllowed
+		}
+		return 0
+	}
+	if policy.HTTPPorts != nil && !acl.MatchPort(policy.HTTPPorts, port) {
+		log.Warn("Request to disallowed port", zap.Int("port", port))
+		return http.StatusForbidden
+	}
+	return 0
+}
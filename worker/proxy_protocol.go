@@ -0,0 +1,87 @@
+package worker
+
+import (
+	"net"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/Frizz925/gilgamesh/proxyproto"
+	"github.com/Frizz925/gilgamesh/utils"
+)
+
+// ProxyProtocolRule makes connections to matching destinations start with a
+// PROXY protocol header carrying the address of the client.
+type ProxyProtocolRule struct {
+	// Shell patterns matched against the destination host
+	Hosts []string
+	// Networks matched against destinations given as IP addresses
+	Networks []*net.IPNet
+	// Any port matches if empty
+	Ports []int
+	// Either proxyproto.Version1 or proxyproto.Version2
+	Version byte
+}
+
+// Match reports whether the rule applies to the destination. Rules without
+// hosts nor networks apply to any host.
+func (r *ProxyProtocolRule) Match(host string, port int) bool {
+	if len(r.Ports) > 0 && !containsInt(r.Ports, port) {
+		return false
+	}
+	if len(r.Hosts) <= 0 && len(r.Networks) <= 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range r.Hosts {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, ipnet := range r.Networks {
+			if ipnet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// proxyProtocolVersion returns the header version to send to the destination,
+// zero if none. The first matching rule wins.
+func (w *Worker) proxyProtocolVersion(hostport string) byte {
+	if len(w.proxyProtocolRules) <= 0 {
+		return 0
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return 0
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return 0
+	}
+	for i := range w.proxyProtocolRules {
+		if r := &w.proxyProtocolRules[i]; r.Match(host, p) {
+			return r.Version
+		}
+	}
+	return 0
+}
+
+// sendProxyHeader writes the PROXY protocol header describing the client
+// connection to the freshly established tunnel.
+func sendProxyHeader(t, c net.Conn, version byte) error {
+	h := proxyproto.NewHeader(version, c.RemoteAddr(), c.LocalAddr())
+	return utils.WriteFull(t, h.Append(nil))
+}
+
+func containsInt(a []int, v int) bool {
+	for _, n := range a {
+		if n == v {
+			return true
+		}
+	}
+	return false
+}
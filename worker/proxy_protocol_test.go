@@ -0,0 +1,121 @@
+package worker
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/Frizz925/gilgamesh/proxyproto"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestProxyProtocolRuleMatch(t *testing.T) {
+	require := require.New(t)
+	_, ipnet, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(err)
+	r := ProxyProtocolRule{
+		Hosts:    []string{"*.internal"},
+		Networks: []*net.IPNet{ipnet},
+		Ports:    []int{80, 443},
+	}
+	require.True(r.Match("app.internal", 443))
+	require.True(r.Match("APP.Internal", 80))
+	require.True(r.Match("10.1.2.3", 443))
+	require.False(r.Match("app.internal", 8080))
+	require.False(r.Match("example.com", 443))
+	require.False(r.Match("192.0.2.1", 443))
+	require.True((&ProxyProtocolRule{}).Match("example.com", 22))
+}
+
+func TestProxyProtocolUpstream(t *testing.T) {
+	require := require.New(t)
+
+	// Origin replying with the client address found in the header
+	origin, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer origin.Close()
+	go func() {
+		for {
+			c, err := origin.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				h, err := proxyproto.ReadHeader(c)
+				if err != nil {
+					return
+				}
+				rb := bufio.NewReader(c)
+				for {
+					req, err := http.ReadRequest(rb)
+					if err != nil {
+						return
+					}
+					body := h.Source.String()
+					_, _ = fmt.Fprintf(c, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+					_ = req.Body.Close()
+				}
+			}()
+		}
+	}()
+
+	pool := NewConnPool(ConnPoolConfig{})
+	defer pool.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer l.Close()
+	cfg := Config{
+		Logger:   zap.NewNop(),
+		ConnPool: pool,
+		ProxyProtocolRules: []ProxyProtocolRule{
+			{Hosts: []string{"127.0.0.1"}, Version: proxyproto.Version2},
+		},
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				New(cfg).ServeConn(c)
+				done <- struct{}{}
+			}()
+		}
+	}()
+
+	for _, method := range []string{http.MethodConnect, http.MethodGet} {
+		c, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(err)
+		rb := bufio.NewReader(c)
+		req, err := http.NewRequest(method, "http://"+origin.Addr().String()+"/", nil)
+		require.NoError(err)
+		if method == http.MethodConnect {
+			req.Host = origin.Addr().String()
+			require.NoError(req.Write(c))
+			res, err := http.ReadResponse(rb, req)
+			require.NoError(err)
+			require.Equal(http.StatusOK, res.StatusCode)
+			req.Method = http.MethodGet
+			require.NoError(req.Write(c))
+		} else {
+			require.NoError(req.WriteProxy(c))
+		}
+		res, err := http.ReadResponse(rb, req)
+		require.NoError(err)
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(err)
+		require.Equal(c.LocalAddr().String(), string(body), method)
+		require.NoError(c.Close())
+	}
+	// Connections tied to a client are never pooled, the tunnel lasting
+	// until the origin closes it
+	<-done
+	require.Equal(0, pool.Len())
+}
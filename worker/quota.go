@@ -0,0 +1,56 @@
+package worker
+
+import (
+	"errors"
+	"io"
+
+	"github.com/Frizz925/gilgamesh/usage"
+	"go.uber.org/zap"
+)
+
+const reasonQuotaExceeded = "quota exceeded"
+
+// Proxy-Status header value telling clients over their quota why they are
+// denied, as described in RFC 9209
+const quotaProxyStatus = `gilgamesh; error=http_request_denied; details="quota exceeded"`
+
+var errQuotaExceeded = errors.New(reasonQuotaExceeded)
+
+// checkQuota reports whether the user is still within the data quota,
+// logging the denial otherwise.
+func checkQuota(log *zap.Logger, uq *usage.UserQuota) bool {
+	if uq.Exceeded() {
+		log.Warn("Access denied", zap.String("reason", reasonQuotaExceeded))
+		return false
+	}
+	return true
+}
+
+// countQuota counts bytes relayed through the tunnel against the quota,
+// ending the tunnel once the user goes over it if configured to.
+func (w *Worker) countQuota(uq *usage.UserQuota, watch *tunnelWatch, n int) {
+	if !uq.Add(int64(n)) && w.closeOverQuota {
+		watch.end(reasonQuotaExceeded)
+	}
+}
+
+// quotaReader counts the bytes read against the quota of a tunnel.
+type quotaReader struct {
+	r     io.Reader
+	w     *Worker
+	uq    *usage.UserQuota
+	watch *tunnelWatch
+}
+
+func (qr quotaReader) Read(b []byte) (int, error) {
+	n, err := qr.r.Read(b)
+	qr.w.countQuota(qr.uq, qr.watch, n)
+	return n, err
+}
+
+func (w *Worker) quotaReader(r io.Reader, uq *usage.UserQuota, watch *tunnelWatch) io.Reader {
+	if uq == nil {
+		return r
+	}
+	return quotaReader{r: r, w: w, uq: uq, watch: watch}
+}
@@ -0,0 +1,71 @@
+package worker
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Frizz925/gilgamesh/auth"
+	"github.com/Frizz925/gilgamesh/usage"
+)
+
+func (suite *WorkerTestSuite) TestQuotaExceeded() {
+	require := suite.Require()
+	quota := suite.setupQuotaWorker(false)
+	quota.User(suite.username).Add(101)
+
+	res, err := suite.client.Do(&http.Request{
+		URL:    suite.url,
+		Header: createAuthHeader(suite.username, suite.password),
+	})
+	require.NoError(err)
+	require.Equal(http.StatusForbidden, res.StatusCode)
+	require.Equal(quotaProxyStatus, res.Header.Get("Proxy-Status"))
+	require.NoError(res.Body.Close())
+}
+
+func (suite *WorkerTestSuite) TestQuotaCloseTunnel() {
+	require := suite.Require()
+	quota := suite.setupQuotaWorker(true)
+
+	c := suite.pipe.client
+	br, bw := bufio.NewReader(c), bufio.NewWriter(c)
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    suite.url,
+		Host:   suite.url.Host,
+		Header: createAuthHeader(suite.username, suite.password),
+	}
+	require.NoError(req.Write(bw))
+	require.NoError(bw.Flush())
+	res, err := http.ReadResponse(br, req)
+	require.NoError(err)
+	require.Equal(http.StatusOK, res.StatusCode)
+
+	// The tunnel is closed as soon as the quota is gone over
+	_, err = bw.WriteString(strings.Repeat("x", 200))
+	require.NoError(err)
+	require.NoError(bw.Flush())
+	require.NoError(c.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = ioutil.ReadAll(br)
+	require.NoError(err)
+	require.True(quota.User(suite.username).Exceeded())
+}
+
+func (suite *WorkerTestSuite) setupQuotaWorker(closeOverQuota bool) *usage.Quota {
+	require := suite.Require()
+	pw, err := auth.CreatePassword([]byte(suite.password))
+	require.NoError(err)
+	quota, err := usage.NewQuota(usage.QuotaConfig{Default: 100})
+	require.NoError(err)
+	w := New(Config{
+		Logger:         suite.logger,
+		Credentials:    auth.Credentials{suite.username: pw},
+		Quota:          quota,
+		CloseOverQuota: closeOverQuota,
+	})
+	go w.ServeConn(suite.pipe.server)
+	return quota
+}
@@ -0,0 +1,44 @@
+package worker
+
+import (
+	"math"
+	"net"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// checkIPRequestRate counts a request of the client at c against the rate
+// limit of its address, returning how long it must wait before retrying if
+// exceeded. It comes before authentication so that failed logins count too.
+func (w *Worker) checkIPRequestRate(log *zap.Logger, c net.Conn) time.Duration {
+	if c == nil {
+		return 0
+	}
+	d := w.ipRequests.Allow(addrIP(c.RemoteAddr()).String())
+	if d > 0 {
+		log.Warn("Too many requests", zap.String("reason", "ip request rate"))
+	}
+	return d
+}
+
+// checkUserRequestRate counts a request of the authenticated user against
+// its rate limit, returning how long it must wait before retrying if
+// exceeded.
+func (w *Worker) checkUserRequestRate(log *zap.Logger, user string) time.Duration {
+	if user == "" {
+		return 0
+	}
+	d := w.userRequests.Allow(user)
+	if d > 0 {
+		log.Warn("Too many requests", zap.String("reason", "user request rate"))
+	}
+	return d
+}
+
+// retryAfter returns the Retry-After header value telling the client to wait
+// for d, rounded up to whole seconds.
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,62 @@
+package worker
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"net/http"
+
+	"github.com/Frizz925/gilgamesh/auth"
+	"github.com/Frizz925/gilgamesh/ratelimit"
+)
+
+func (suite *WorkerTestSuite) TestRequestRateExceeded() {
+	require := suite.Require()
+	w := New(Config{
+		Logger:     suite.logger,
+		IPRequests: ratelimit.NewRequestLimit(0.1, 1),
+	})
+	go w.ServeConn(suite.pipe.server)
+
+	res, err := suite.client.Get(suite.url.String())
+	require.NoError(err)
+	require.Equal(http.StatusOK, res.StatusCode)
+	require.NoError(res.Body.Close())
+
+	// The keep-alive connection is reused for the next request
+	res, err = suite.client.Get(suite.url.String())
+	require.NoError(err)
+	require.Equal(http.StatusTooManyRequests, res.StatusCode)
+	require.Equal("10", res.Header.Get("Retry-After"))
+	require.NoError(res.Body.Close())
+}
+
+func (suite *WorkerTestSuite) TestRequestRateFailedLogin() {
+	require := suite.Require()
+	pw, err := auth.CreatePassword([]byte(suite.password))
+	require.NoError(err)
+	w := New(Config{
+		Logger:      suite.logger,
+		Credentials: auth.Credentials{suite.username: pw},
+		IPRequests:  ratelimit.NewRequestLimit(0.1, 1),
+	})
+
+	// Failed logins count against the rate of the client address
+	for _, password := range []string{"wrong", suite.password} {
+		cp, sp := net.Pipe()
+		go w.ServeConn(sp)
+		req, err := http.NewRequest(http.MethodGet, suite.url.String(), nil)
+		require.NoError(err)
+		creds := base64.URLEncoding.EncodeToString([]byte(suite.username + ":" + password))
+		req.Header.Set(authHeaderName, authHeaderPrefix+creds)
+		require.NoError(req.WriteProxy(cp))
+		res, err := http.ReadResponse(bufio.NewReader(cp), req)
+		require.NoError(err)
+		expected := http.StatusForbidden
+		if password == suite.password {
+			expected = http.StatusTooManyRequests
+		}
+		require.Equal(expected, res.StatusCode)
+		require.NoError(cp.Close())
+	}
+}
@@ -0,0 +1,370 @@
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Frizz925/gilgamesh/acl"
+	"github.com/Frizz925/gilgamesh/socks"
+	"go.uber.org/zap"
+)
+
+// socksReplyFunc writes a reply in the protocol version spoken by the client
+type socksReplyFunc func(reply socks.Reply, addr socks.Addr) bool
+
+type socksRequest struct {
+	cmd  byte
+	addr socks.Addr
+}
+
+// ServeSOCKS serves a SOCKS5, SOCKS4 or SOCKS4a client, sharing credentials
+// and tunnels with the HTTP proxy.
+func (w *Worker) ServeSOCKS(c net.Conn) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	rb := acquireReader(w.reader, c)
+	wb := acquireWriter(w.writer, c)
+
+	log := w.logger.With(
+		zap.String("src", c.RemoteAddr().String()),
+		zap.String("listener", c.LocalAddr().String()),
+	)
+	log.Info("Serving new connection")
+	w.conn = c
+	defer func() {
+		w.releaseUser()
+		w.conn = nil
+		w.bandwidth = bandwidth{}
+		w.traffic = traffic{}
+		_ = c.Close()
+		log.Info("Closed connection")
+	}()
+
+	// Cleared once the request has been read
+	if err := c.SetReadDeadline(time.Now().Add(w.headerTimeout)); err != nil {
+		log.Error("Failed to set read deadline", zap.Error(err))
+		return
+	}
+	ver, err := rb.ReadByte()
+	if err != nil {
+		logReadError(log, "Failed to read SOCKS version", err)
+		return
+	}
+	switch ver {
+	case socks.Version5:
+		w.serveSOCKS5(log.With(zap.String("protocol", "socks5")), c, rb, wb)
+	case socks.Version4:
+		w.serveSOCKS4(log, c, rb, wb)
+	default:
+		log.Error("Unsupported SOCKS version", zap.Uint8("version", ver))
+	}
+}
+
+func (w *Worker) serveSOCKS5(log *zap.Logger, c net.Conn, rb *bufio.Reader, wb *bufio.Writer) {
+	// Nothing can be replied before the negotiation, so the connection is
+	// closed right away
+	if w.checkIPRequestRate(log, c) > 0 {
+		return
+	}
+	log, user, ok := w.negotiateSOCKS5(log, rb, wb)
+	if !ok {
+		return
+	}
+	defer func() {
+		w.logAccess(log, w.traffic.access, w.outcome)
+		w.recordOutcome("socks5")
+	}()
+	if !w.holdUser(log, user) {
+		return
+	}
+	w.bandwidth = w.bandwidthOf(user)
+	req, err := readSOCKS5Request(rb)
+	if err != nil {
+		logReadError(log, "Malformed SOCKS request", err)
+		reply := socks.ReplyGeneralFailure
+		if err == socks.ErrUnsupportedAddressType {
+			reply = socks.ReplyAddressNotSupported
+		}
+		w.replySOCKS5(log, wb, reply, socks.Addr{})
+		return
+	}
+	if err := c.SetReadDeadline(time.Time{}); err != nil {
+		log.Error("Failed to clear read deadline", zap.Error(err))
+		return
+	}
+
+	hostport := req.addr.String()
+	log = log.With(zap.String("dst", hostport))
+	access := newAccess(c, "SOCKS5", socksMethod(req.cmd), hostport)
+	access.User = user
+	w.traffic = traffic{user: user, dst: hostport, quota: w.quota.User(user), access: access}
+	reply := func(rep socks.Reply, addr socks.Addr) bool {
+		return w.replySOCKS5(log, wb, rep, addr)
+	}
+	if w.checkUserRequestRate(log, user) > 0 {
+		reply(socks.ReplyNotAllowed, socks.Addr{})
+		return
+	}
+	if !checkQuota(log, w.traffic.quota) {
+		reply(socks.ReplyNotAllowed, socks.Addr{})
+		return
+	}
+	if req.cmd == socks.CmdUDPAssociate {
+		// Datagram destinations are checked as they come
+		w.serveSOCKS5UDP(log, c, rb, wb, user, req.addr)
+		return
+	}
+	if !w.checkSOCKSAccess(log, c, user, req.cmd, req.addr) {
+		reply(socks.ReplyNotAllowed, socks.Addr{})
+		return
+	}
+	switch req.cmd {
+	case socks.CmdConnect:
+		w.serveSOCKSConnect(log, rb, wb, hostport, reply)
+	case socks.CmdBind:
+		w.serveSOCKSBind(log, c, rb, wb, req.addr, reply)
+	default:
+		log.Error("Unsupported SOCKS command", zap.Uint8("cmd", req.cmd))
+		reply(socks.ReplyCommandNotSupported, socks.Addr{})
+	}
+}
+
+// negotiateSOCKS5 selects the authentication method and runs the RFC 1929
+// username/password sub-negotiation if credentials are configured, returning
+// the authenticated user.
+func (w *Worker) negotiateSOCKS5(log *zap.Logger, rb *bufio.Reader, wb *bufio.Writer) (*zap.Logger, string, bool) {
+	n, err := rb.ReadByte()
+	if err != nil {
+		logReadError(log, "Failed to read SOCKS methods", err)
+		return log, "", false
+	}
+	methods := make([]byte, n)
+	if _, err := io.ReadFull(rb, methods); err != nil {
+		logReadError(log, "Failed to read SOCKS methods", err)
+		return log, "", false
+	}
+
+	method := byte(socks.MethodNoAuth)
+	if w.authorization {
+		method = socks.MethodUserPass
+	}
+	if !bytes.Contains(methods, []byte{method}) {
+		log.Error("No acceptable SOCKS authentication method")
+		writeSOCKS(log, wb, socks.Version5, socks.MethodNoAcceptable)
+		return log, "", false
+	}
+	if !writeSOCKS(log, wb, socks.Version5, method) {
+		return log, "", false
+	}
+	if !w.authorization {
+		return log, "", true
+	}
+
+	var creds [2]string
+	if ver, err := rb.ReadByte(); err != nil || ver != socks.UserPassVersion {
+		logReadError(log, "Malformed SOCKS authentication request", err)
+		return log, "", false
+	}
+	for i := range creds {
+		n, err := rb.ReadByte()
+		if err != nil {
+			logReadError(log, "Malformed SOCKS authentication request", err)
+			return log, "", false
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(rb, b); err != nil {
+			logReadError(log, "Malformed SOCKS authentication request", err)
+			return log, "", false
+		}
+		creds[i] = string(b)
+	}
+
+	username, password := creds[0], creds[1]
+	log = log.With(zap.String("user", username))
+	ok := w.authenticate(log, username, password)
+	status := byte(socks.UserPassStatusSuccess)
+	if !ok {
+		status = socks.UserPassStatusFailure
+	}
+	if !writeSOCKS(log, wb, socks.UserPassVersion, status) {
+		return log, "", false
+	}
+	return log, username, ok
+}
+
+func (w *Worker) serveSOCKSConnect(log *zap.Logger, rb *bufio.Reader, wb *bufio.Writer, hostport string, reply socksReplyFunc) {
+	t, err := w.openTunnel(log, hostport)
+	if err != nil {
+		reply(socksReplyFor(err), socks.Addr{})
+		return
+	}
+	defer t.Close()
+	if !reply(socks.ReplySucceeded, socks.AddrFromNet(t.LocalAddr())) {
+		return
+	}
+	w.relay(log, w.conn, t, rb, wb, w.tunnel.reader, w.tunnel.writer)
+}
+
+// serveSOCKSBind waits for a single inbound connection from the requested
+// address on the interface the client is connected to, for no longer than the
+// dial timeout.
+func (w *Worker) serveSOCKSBind(log *zap.Logger, c net.Conn, rb *bufio.Reader, wb *bufio.Writer, addr socks.Addr, reply socksReplyFunc) {
+	var expected []net.IP
+	if addr.Name != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), w.dialTimeout)
+		addrs, err := w.resolver.LookupIPAddr(ctx, addr.Name)
+		cancel()
+		if err != nil {
+			log.Error("Failed to resolve BIND address", zap.Error(err))
+			reply(socks.ReplyHostUnreachable, socks.Addr{})
+			return
+		}
+		for _, v := range addrs {
+			expected = append(expected, v.IP)
+		}
+	} else if !addr.IP.IsUnspecified() {
+		expected = []net.IP{addr.IP}
+	}
+
+	laddr := &net.TCPAddr{}
+	if v, ok := c.LocalAddr().(*net.TCPAddr); ok {
+		laddr.IP = v.IP
+	}
+	l, err := net.ListenTCP("tcp", laddr)
+	if err != nil {
+		log.Error("Failed to listen for BIND", zap.Error(err))
+		reply(socks.ReplyGeneralFailure, socks.Addr{})
+		return
+	}
+	defer l.Close()
+	log = log.With(zap.String("bind", l.Addr().String()))
+	log.Info("Waiting for inbound connection")
+	if !reply(socks.ReplySucceeded, socks.AddrFromNet(l.Addr())) {
+		return
+	}
+
+	if err := l.SetDeadline(time.Now().Add(w.dialTimeout)); err != nil {
+		log.Error("Failed to set BIND deadline", zap.Error(err))
+		reply(socks.ReplyGeneralFailure, socks.Addr{})
+		return
+	}
+	var t *net.TCPConn
+	for {
+		ic, err := l.AcceptTCP()
+		if err != nil {
+			log.Error("Failed to accept inbound connection", zap.Error(err))
+			reply(socksReplyFor(err), socks.Addr{})
+			return
+		}
+		if ipAllowed(ic.RemoteAddr().(*net.TCPAddr).IP, expected) {
+			t = ic
+			break
+		}
+		log.Warn("Rejected unexpected inbound connection", zap.String("peer", ic.RemoteAddr().String()))
+		_ = ic.Close()
+	}
+	defer t.Close()
+	// Inbound connections are never made through the parent proxy
+	setUpstream(w.traffic.access, t, false)
+
+	if !reply(socks.ReplySucceeded, socks.AddrFromNet(t.RemoteAddr())) {
+		return
+	}
+	tr := acquireReader(w.tunnel.reader, t)
+	tw := acquireWriter(w.tunnel.writer, t)
+	w.relay(log, c, t, rb, wb, tr, tw)
+}
+
+// checkSOCKSAccess evaluates the ACL for CONNECT and BIND requests. For BIND
+// the address is the one of the peer expected to connect.
+func (w *Worker) checkSOCKSAccess(log *zap.Logger, c net.Conn, user string, cmd byte, addr socks.Addr) bool {
+	method := acl.MethodConnect
+	if cmd == socks.CmdBind {
+		method = acl.MethodBind
+	}
+	req := acl.Request{User: user, Method: method, Host: addr.Host(), Port: addr.Port}
+	if addr.IP != nil {
+		req.IPs = []net.IP{addr.IP}
+	}
+	return w.checkAccess(log, c, req)
+}
+
+func readSOCKS5Request(rb *bufio.Reader) (req socksRequest, err error) {
+	var b [3]byte
+	if _, err = io.ReadFull(rb, b[:]); err != nil {
+		return
+	}
+	if b[0] != socks.Version5 {
+		err = socks.ErrUnsupportedVersion
+		return
+	}
+	req.cmd = b[1]
+	req.addr, err = socks.ReadAddr(rb)
+	return
+}
+
+// replySOCKS5 writes the reply as the outcome of the request.
+func (w *Worker) replySOCKS5(log *zap.Logger, wb *bufio.Writer, reply socks.Reply, addr socks.Addr) bool {
+	w.outcome = strconv.Itoa(int(reply))
+	return writeSOCKS5Reply(log, wb, reply, addr)
+}
+
+func writeSOCKS5Reply(log *zap.Logger, wb *bufio.Writer, reply socks.Reply, addr socks.Addr) bool {
+	b, err := addr.Append([]byte{socks.Version5, byte(reply), 0})
+	if err != nil {
+		log.Error("Failed to encode SOCKS reply", zap.Error(err))
+		return false
+	}
+	return writeSOCKS(log, wb, b...)
+}
+
+func writeSOCKS(log *zap.Logger, wb *bufio.Writer, b ...byte) bool {
+	if _, err := wb.Write(b); err != nil {
+		log.Error("Failed to write response to buffer", zap.Error(err))
+		return false
+	}
+	if err := wb.Flush(); err != nil {
+		log.Error("Failed to flush buffer", zap.Error(err))
+		return false
+	}
+	return true
+}
+
+// socksReplyFor maps dial errors onto the closest SOCKS reply code.
+func socksReplyFor(err error) socks.Reply {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var blockedErr *acl.BlockedError
+	switch {
+	case errors.As(err, &blockedErr):
+		return socks.ReplyNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks.ReplyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks.ReplyNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return socks.ReplyHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return socks.ReplyTTLExpired
+	}
+	return socks.ReplyGeneralFailure
+}
+
+func ipAllowed(ip net.IP, allowed []net.IP) bool {
+	if len(allowed) <= 0 {
+		return true
+	}
+	for _, v := range allowed {
+		if v.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+package worker
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Frizz925/gilgamesh/socks"
+	"go.uber.org/zap"
+)
+
+// Both the user ID and the SOCKS4a domain are limited to this length
+const socks4MaxFieldLength = 255
+
+var errSOCKS4FieldTooLong = errors.New("SOCKS4 field too long")
+
+// serveSOCKS4 serves SOCKS4 and SOCKS4a clients once the version byte has
+// been read.
+func (w *Worker) serveSOCKS4(log *zap.Logger, c net.Conn, rb *bufio.Reader, wb *bufio.Writer) {
+	log = log.With(zap.String("protocol", "socks4"))
+	var b [7]byte
+	if _, err := io.ReadFull(rb, b[:]); err != nil {
+		logReadError(log, "Malformed SOCKS request", err)
+		return
+	}
+	cmd := b[0]
+	addr := socks.Addr{
+		IP:   net.IP(append([]byte(nil), b[3:7]...)),
+		Port: int(binary.BigEndian.Uint16(b[1:3])),
+	}
+	userID, err := readNullTerminated(rb)
+	if err != nil {
+		logReadError(log, "Malformed SOCKS request", err)
+		return
+	}
+	// Destination IP of 0.0.0.x with non-zero x is how SOCKS4a marks domains
+	protocol := "SOCKS4"
+	if b[3] == 0 && b[4] == 0 && b[5] == 0 && b[6] != 0 {
+		protocol = "SOCKS4A"
+		log = log.With(zap.String("protocol", "socks4a"))
+		name, err := readNullTerminated(rb)
+		if err != nil || name == "" {
+			logReadError(log, "Malformed SOCKS request", err)
+			return
+		}
+		addr = socks.Addr{Name: name, Port: addr.Port}
+	}
+	if err := c.SetReadDeadline(time.Time{}); err != nil {
+		log.Error("Failed to clear read deadline", zap.Error(err))
+		return
+	}
+
+	hostport := addr.String()
+	access := newAccess(c, protocol, socksMethod(cmd), hostport)
+	defer func() {
+		w.logAccess(log, access, w.outcome)
+		w.recordOutcome("socks4")
+	}()
+	if w.checkIPRequestRate(log, c) > 0 {
+		w.replySOCKS4(log, wb, socks.Reply4Rejected, socks.Addr{})
+		return
+	}
+	log, user, ok := w.authenticateSOCKS4(log, userID)
+	if !ok {
+		w.replySOCKS4(log, wb, socks.Reply4UserIDMismatch, socks.Addr{})
+		return
+	}
+	access.User = user
+	if !w.holdUser(log, user) {
+		return
+	}
+	w.bandwidth = w.bandwidthOf(user)
+
+	log = log.With(zap.String("dst", hostport))
+	w.traffic = traffic{user: user, dst: hostport, quota: w.quota.User(user), access: access}
+	reply := func(rep socks.Reply, addr socks.Addr) bool {
+		code := byte(socks.Reply4Granted)
+		if rep != socks.ReplySucceeded {
+			code = socks.Reply4Rejected
+		}
+		return w.replySOCKS4(log, wb, code, addr)
+	}
+	if w.checkUserRequestRate(log, user) > 0 {
+		reply(socks.ReplyNotAllowed, socks.Addr{})
+		return
+	}
+	if !checkQuota(log, w.traffic.quota) {
+		reply(socks.ReplyNotAllowed, socks.Addr{})
+		return
+	}
+	if (cmd == socks.CmdConnect || cmd == socks.CmdBind) && !w.checkSOCKSAccess(log, c, user, cmd, addr) {
+		reply(socks.ReplyNotAllowed, socks.Addr{})
+		return
+	}
+	switch cmd {
+	case socks.CmdConnect:
+		w.serveSOCKSConnect(log, rb, wb, hostport, reply)
+	case socks.CmdBind:
+		w.serveSOCKSBind(log, c, rb, wb, addr, reply)
+	default:
+		log.Error("Unsupported SOCKS command", zap.Uint8("cmd", cmd))
+		reply(socks.ReplyCommandNotSupported, socks.Addr{})
+	}
+}
+
+// authenticateSOCKS4 maps the user ID onto the configured credentials.
+// SOCKS4 has no password field, so clients either send "user:password" as
+// their user ID or the user ID alone is trusted when explicitly allowed.
+func (w *Worker) authenticateSOCKS4(log *zap.Logger, userID string) (*zap.Logger, string, bool) {
+	if !w.authorization {
+		return log, "", true
+	}
+	parts := strings.SplitN(userID, ":", 2)
+	username := parts[0]
+	log = log.With(zap.String("user", username))
+	if len(parts) > 1 {
+		return log, username, w.authenticate(log, username, parts[1])
+	}
+	if !w.socks4UserIDAuth {
+		log.Error("Password required for SOCKS4 user ID")
+		w.authFailed(authPasswordRequired)
+		return log, username, false
+	}
+	if _, ok := w.credentials[username]; !ok {
+		log.Error("Username not found")
+		w.authFailed(authUnknownUser)
+		return log, username, false
+	}
+	return log, username, true
+}
+
+func readNullTerminated(rb *bufio.Reader) (string, error) {
+	var sb strings.Builder
+	for {
+		c, err := rb.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == 0 {
+			return sb.String(), nil
+		}
+		if sb.Len() >= socks4MaxFieldLength {
+			return "", errSOCKS4FieldTooLong
+		}
+		sb.WriteByte(c)
+	}
+}
+
+// replySOCKS4 writes the reply as the outcome of the request.
+func (w *Worker) replySOCKS4(log *zap.Logger, wb *bufio.Writer, code byte, addr socks.Addr) bool {
+	w.outcome = strconv.Itoa(int(code))
+	return writeSOCKS4Reply(log, wb, code, addr)
+}
+
+// writeSOCKS4Reply writes the reply, leaving the address zeroed when it
+// cannot be represented in SOCKS4.
+func writeSOCKS4Reply(log *zap.Logger, wb *bufio.Writer, code byte, addr socks.Addr) bool {
+	b := []byte{0, code, byte(addr.Port >> 8), byte(addr.Port), 0, 0, 0, 0}
+	if ip := addr.IP.To4(); ip != nil {
+		copy(b[4:], ip)
+	}
+	return writeSOCKS(log, wb, b...)
+}
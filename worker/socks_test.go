@@ -0,0 +1,543 @@
+package worker
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Frizz925/gilgamesh/acl"
+	"github.com/Frizz925/gilgamesh/auth"
+	"github.com/Frizz925/gilgamesh/dns"
+	"github.com/Frizz925/gilgamesh/proxyproto"
+	"github.com/Frizz925/gilgamesh/ratelimit"
+	"github.com/Frizz925/gilgamesh/socks"
+	"github.com/Frizz925/gilgamesh/usage"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+)
+
+type SOCKSTestSuite struct {
+	suite.Suite
+
+	logger   *zap.Logger
+	listener net.Listener
+
+	username string
+	password string
+
+	pipe struct {
+		client net.Conn
+		server net.Conn
+	}
+}
+
+func TestSOCKS(t *testing.T) {
+	suite.Run(t, &SOCKSTestSuite{
+		username: "user",
+		password: "password",
+	})
+}
+
+func (suite *SOCKSTestSuite) SetupSuite() {
+	require := suite.Require()
+	logger, err := zap.NewDevelopment()
+	require.NoError(err)
+	suite.logger = logger
+
+	// Echo server as the tunnel destination
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	suite.listener = l
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(c, c)
+				_ = c.Close()
+			}()
+		}
+	}()
+}
+
+func (suite *SOCKSTestSuite) SetupTest() {
+	suite.pipe.client, suite.pipe.server = net.Pipe()
+}
+
+func (suite *SOCKSTestSuite) TearDownTest() {
+	_ = suite.pipe.client.Close()
+	_ = suite.pipe.server.Close()
+}
+
+func (suite *SOCKSTestSuite) TearDownSuite() {
+	_ = suite.listener.Close()
+	_ = suite.logger.Sync()
+}
+
+func (suite *SOCKSTestSuite) TestConnect() {
+	suite.setupWorker(false)
+	suite.handshake(socks.MethodNoAuth)
+	reply, _ := suite.request(socks.CmdConnect, suite.listener.Addr().String())
+	suite.Require().Equal(socks.ReplySucceeded, reply)
+	suite.assertEcho(suite.pipe.client)
+}
+
+func (suite *SOCKSTestSuite) TestConnectDomain() {
+	suite.setupWorker(false)
+	suite.handshake(socks.MethodNoAuth)
+	_, port, err := net.SplitHostPort(suite.listener.Addr().String())
+	suite.Require().NoError(err)
+	reply, _ := suite.request(socks.CmdConnect, net.JoinHostPort("localhost", port))
+	suite.Require().Equal(socks.ReplySucceeded, reply)
+	suite.assertEcho(suite.pipe.client)
+}
+
+func (suite *SOCKSTestSuite) TestConnectRefused() {
+	suite.setupWorker(false)
+	suite.handshake(socks.MethodNoAuth)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	suite.Require().NoError(err)
+	addr := l.Addr().String()
+	suite.Require().NoError(l.Close())
+	reply, _ := suite.request(socks.CmdConnect, addr)
+	suite.Require().Equal(socks.ReplyConnectionRefused, reply)
+}
+
+func (suite *SOCKSTestSuite) TestConnectNotAllowed() {
+	w := New(Config{
+		Logger: suite.logger,
+		ACL: acl.New(acl.Config{
+			Rules: []acl.Rule{{Action: acl.Allow, Hosts: []string{"*.example.com"}}},
+			// Anything else is denied
+			Default: acl.Deny,
+		}),
+	})
+	go w.ServeSOCKS(suite.pipe.server)
+	suite.handshake(socks.MethodNoAuth)
+	reply, _ := suite.request(socks.CmdConnect, suite.listener.Addr().String())
+	suite.Require().Equal(socks.ReplyNotAllowed, reply)
+}
+
+func (suite *SOCKSTestSuite) TestConnectBlocked() {
+	w := New(Config{
+		Logger: suite.logger,
+		Guard:  acl.NewGuard(acl.GuardConfig{}),
+	})
+	go w.ServeSOCKS(suite.pipe.server)
+	suite.handshake(socks.MethodNoAuth)
+	reply, _ := suite.request(socks.CmdConnect, suite.listener.Addr().String())
+	suite.Require().Equal(socks.ReplyNotAllowed, reply)
+}
+
+func (suite *SOCKSTestSuite) TestAuthSuccess() {
+	suite.setupWorker(true)
+	suite.handshake(socks.MethodUserPass, socks.MethodNoAuth, socks.MethodUserPass)
+	suite.Require().Equal(byte(socks.UserPassStatusSuccess), suite.authenticate(suite.username, suite.password))
+	reply, _ := suite.request(socks.CmdConnect, suite.listener.Addr().String())
+	suite.Require().Equal(socks.ReplySucceeded, reply)
+	suite.assertEcho(suite.pipe.client)
+}
+
+func (suite *SOCKSTestSuite) TestAuthFailure() {
+	suite.setupWorker(true)
+	suite.handshake(socks.MethodUserPass, socks.MethodUserPass)
+	suite.Require().Equal(byte(socks.UserPassStatusFailure), suite.authenticate(suite.username, "invalid"))
+}
+
+func (suite *SOCKSTestSuite) TestRequestRateExceeded() {
+	require := suite.Require()
+	cfg := Config{
+		Logger:     suite.logger,
+		IPRequests: ratelimit.NewRequestLimit(0.1, 1),
+	}
+	go New(cfg).ServeSOCKS(suite.pipe.server)
+	suite.handshake(socks.MethodNoAuth)
+	reply, _ := suite.request(socks.CmdConnect, suite.listener.Addr().String())
+	require.Equal(socks.ReplySucceeded, reply)
+
+	// Closed before any negotiation
+	c, s := net.Pipe()
+	defer c.Close()
+	go New(cfg).ServeSOCKS(s)
+	_, err := c.Write([]byte{socks.Version5, 1, socks.MethodNoAuth})
+	require.NoError(err)
+	_, err = c.Read(make([]byte, 2))
+	require.Equal(io.EOF, err)
+}
+
+func (suite *SOCKSTestSuite) TestNoAcceptableMethod() {
+	suite.setupWorker(true)
+	suite.handshake(socks.MethodNoAcceptable, socks.MethodNoAuth)
+}
+
+func (suite *SOCKSTestSuite) TestBind() {
+	require := suite.Require()
+	suite.setupWorker(false)
+	suite.handshake(socks.MethodNoAuth)
+	reply, addr := suite.request(socks.CmdBind, "127.0.0.1:0")
+	require.Equal(socks.ReplySucceeded, reply)
+
+	ic, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(addr.Port)))
+	require.NoError(err)
+	defer ic.Close()
+	reply, addr = suite.readReply()
+	require.Equal(socks.ReplySucceeded, reply)
+	require.Equal(ic.LocalAddr().String(), addr.String())
+
+	expected := []byte("message through bind")
+	_, err = suite.pipe.client.Write(expected)
+	require.NoError(err)
+	b := make([]byte, len(expected))
+	_, err = io.ReadFull(ic, b)
+	require.NoError(err)
+	require.Equal(expected, b)
+}
+
+func (suite *SOCKSTestSuite) TestBindTimeout() {
+	require := suite.Require()
+	go New(Config{
+		Logger:      suite.logger,
+		DialTimeout: 100 * time.Millisecond,
+	}).ServeSOCKS(suite.pipe.server)
+	suite.handshake(socks.MethodNoAuth)
+	reply, _ := suite.request(socks.CmdBind, "127.0.0.1:0")
+	require.Equal(socks.ReplySucceeded, reply)
+
+	// Nothing connects within the dial timeout
+	require.NoError(suite.pipe.client.SetReadDeadline(time.Now().Add(time.Second)))
+	reply, _ = suite.readReply()
+	require.Equal(socks.ReplyTTLExpired, reply)
+}
+
+func (suite *SOCKSTestSuite) TestUDPAssociate() {
+	require := suite.Require()
+	echo := startUDPEcho(suite.T())
+	defer echo.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(err)
+	defer client.Close()
+	intruder, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(err)
+	defer intruder.Close()
+
+	suite.setupWorker(false)
+	suite.handshake(socks.MethodNoAuth)
+	reply, relay := suite.request(socks.CmdUDPAssociate, client.LocalAddr().String())
+	require.Equal(socks.ReplySucceeded, reply)
+	raddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: relay.Port}
+
+	dst, err := socks.ParseAddr(echo.LocalAddr().String())
+	require.NoError(err)
+	packet, err := dst.Append([]byte{0, 0, 0})
+	require.NoError(err)
+	packet = append(packet, "datagram to be echoed"...)
+
+	// Datagrams from other addresses than the client's are dropped
+	_, err = intruder.WriteToUDP(packet, raddr)
+	require.NoError(err)
+	require.NoError(intruder.SetReadDeadline(time.Now().Add(100 * time.Millisecond)))
+	_, _, err = intruder.ReadFromUDP(make([]byte, 512))
+	require.Error(err)
+
+	_, err = client.WriteToUDP(packet, raddr)
+	require.NoError(err)
+	require.NoError(client.SetReadDeadline(time.Now().Add(time.Second)))
+	b := make([]byte, 512)
+	n, _, err := client.ReadFromUDP(b)
+	require.NoError(err)
+	require.Equal(packet, b[:n])
+}
+
+func (suite *SOCKSTestSuite) TestUDPAssociateUsage() {
+	require := suite.Require()
+	echo := startUDPEcho(suite.T())
+	defer echo.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(err)
+	defer client.Close()
+	dir, err := ioutil.TempDir("", "usage")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	store := usage.NewStore(filepath.Join(dir, "usage.log"))
+	meter := usage.NewMeter(store)
+
+	done := make(chan struct{})
+	go func() {
+		New(Config{Logger: suite.logger, Meter: meter}).ServeSOCKS(suite.pipe.server)
+		close(done)
+	}()
+	suite.handshake(socks.MethodNoAuth)
+	reply, relay := suite.request(socks.CmdUDPAssociate, client.LocalAddr().String())
+	require.Equal(socks.ReplySucceeded, reply)
+	raddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: relay.Port}
+
+	port := echo.LocalAddr().(*net.UDPAddr).Port
+	dst := socks.Addr{Name: "localhost", Port: port}
+	packet, err := dst.Append([]byte{0, 0, 0})
+	require.NoError(err)
+	packet = append(packet, "datagram to be echoed"...)
+	_, err = client.WriteToUDP(packet, raddr)
+	require.NoError(err)
+	require.NoError(client.SetReadDeadline(time.Now().Add(time.Second)))
+	_, _, err = client.ReadFromUDP(make([]byte, 512))
+	require.NoError(err)
+	require.NoError(suite.pipe.client.Close())
+	<-done
+
+	// Replies are accounted under the name the client asked for
+	require.NoError(meter.Flush())
+	now := time.Now()
+	records, err := store.Read(now.Add(-time.Minute), now)
+	require.NoError(err)
+	require.Len(records, 1)
+	require.Equal(dst.String(), records[0].Destination)
+	require.Greater(records[0].Upload, int64(0))
+	require.Greater(records[0].Download, int64(0))
+}
+
+func (suite *SOCKSTestSuite) TestUDPResolveTimeout() {
+	require := suite.Require()
+	echo := startUDPEcho(suite.T())
+	defer echo.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(err)
+	defer client.Close()
+	// DNS server never answering
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(err)
+	defer silent.Close()
+
+	go New(Config{
+		Logger: suite.logger,
+		Resolver: dns.New(dns.Config{
+			Servers: []dns.Server{{Network: "udp", Address: silent.LocalAddr().String()}},
+			Timeout: 10 * time.Second,
+		}),
+		DialTimeout: 100 * time.Millisecond,
+	}).ServeSOCKS(suite.pipe.server)
+	suite.handshake(socks.MethodNoAuth)
+	reply, relay := suite.request(socks.CmdUDPAssociate, client.LocalAddr().String())
+	require.Equal(socks.ReplySucceeded, reply)
+	raddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: relay.Port}
+
+	// Datagrams after one to a name failing to resolve still get relayed
+	hung, err := (&socks.Addr{Name: "hung.test", Port: 53}).Append([]byte{0, 0, 0})
+	require.NoError(err)
+	_, err = client.WriteToUDP(hung, raddr)
+	require.NoError(err)
+	dst, err := socks.ParseAddr(echo.LocalAddr().String())
+	require.NoError(err)
+	packet, err := dst.Append([]byte{0, 0, 0})
+	require.NoError(err)
+	packet = append(packet, "datagram to be echoed"...)
+	_, err = client.WriteToUDP(packet, raddr)
+	require.NoError(err)
+	require.NoError(client.SetReadDeadline(time.Now().Add(time.Second)))
+	b := make([]byte, 512)
+	n, _, err := client.ReadFromUDP(b)
+	require.NoError(err)
+	require.Equal(packet, b[:n])
+}
+
+func (suite *SOCKSTestSuite) TestUDPIdleTimeout() {
+	require := suite.Require()
+	w := New(Config{
+		Logger:         suite.logger,
+		UDPIdleTimeout: 50 * time.Millisecond,
+	})
+	go w.ServeSOCKS(suite.pipe.server)
+	suite.handshake(socks.MethodNoAuth)
+	reply, _ := suite.request(socks.CmdUDPAssociate, "0.0.0.0:0")
+	require.Equal(socks.ReplySucceeded, reply)
+
+	// The control connection gets closed once the association expires
+	_, err := suite.pipe.client.Read(make([]byte, 1))
+	require.Equal(io.EOF, err)
+}
+
+func (suite *SOCKSTestSuite) TestUDPAssociateProxyProtocol() {
+	src := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 12345}
+	dst := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}
+	h := proxyproto.NewHeader(proxyproto.Version2, src, dst)
+	go New(Config{Logger: suite.logger}).ServeSOCKS(proxyproto.NewConn(suite.pipe.server, h))
+	suite.handshake(socks.MethodNoAuth)
+	reply, _ := suite.request(socks.CmdUDPAssociate, "0.0.0.0:0")
+	suite.Require().Equal(socks.ReplyCommandNotSupported, reply)
+}
+
+func (suite *SOCKSTestSuite) TestSOCKS4Connect() {
+	suite.setupWorker(false)
+	addr, err := socks.ParseAddr(suite.listener.Addr().String())
+	suite.Require().NoError(err)
+	suite.Require().Equal(byte(socks.Reply4Granted), suite.requestSOCKS4(addr, ""))
+	suite.assertEcho(suite.pipe.client)
+}
+
+func (suite *SOCKSTestSuite) TestSOCKS4aConnect() {
+	suite.setupWorker(false)
+	addr, err := socks.ParseAddr(suite.listener.Addr().String())
+	suite.Require().NoError(err)
+	addr = socks.Addr{Name: "localhost", Port: addr.Port}
+	suite.Require().Equal(byte(socks.Reply4Granted), suite.requestSOCKS4(addr, ""))
+	suite.assertEcho(suite.pipe.client)
+}
+
+func (suite *SOCKSTestSuite) TestSOCKS4Auth() {
+	require := suite.Require()
+	addr, err := socks.ParseAddr(suite.listener.Addr().String())
+	require.NoError(err)
+	userID := suite.username + ":" + suite.password
+	for _, tc := range []struct {
+		userIDAuth bool
+		userID     string
+		expected   byte
+	}{
+		{false, userID, socks.Reply4Granted},
+		{false, suite.username + ":invalid", socks.Reply4UserIDMismatch},
+		{false, suite.username, socks.Reply4UserIDMismatch},
+		{true, suite.username, socks.Reply4Granted},
+		{true, "notfound", socks.Reply4UserIDMismatch},
+	} {
+		pw, err := auth.CreatePassword([]byte(suite.password))
+		require.NoError(err)
+		w := New(Config{
+			Logger:           suite.logger,
+			Credentials:      auth.Credentials{suite.username: pw},
+			SOCKS4UserIDAuth: tc.userIDAuth,
+		})
+		go w.ServeSOCKS(suite.pipe.server)
+		require.Equal(tc.expected, suite.requestSOCKS4(addr, tc.userID), tc.userID)
+		suite.TearDownTest()
+		suite.SetupTest()
+	}
+}
+
+func (suite *SOCKSTestSuite) TestUnsupportedVersion() {
+	suite.setupWorker(false)
+	_, err := suite.pipe.client.Write([]byte{0x06, 1, socks.MethodNoAuth})
+	suite.Require().NoError(err)
+	_, err = suite.pipe.client.Read(make([]byte, 1))
+	suite.Require().Equal(io.EOF, err)
+}
+
+func (suite *SOCKSTestSuite) setupWorker(withAuth bool) {
+	creds := make(auth.Credentials)
+	if withAuth {
+		pw, err := auth.CreatePassword([]byte(suite.password))
+		suite.Require().NoError(err)
+		creds[suite.username] = pw
+	}
+	w := New(Config{
+		Logger:      suite.logger,
+		Credentials: creds,
+	})
+	go w.ServeSOCKS(suite.pipe.server)
+}
+
+func (suite *SOCKSTestSuite) handshake(expected byte, methods ...byte) {
+	if len(methods) <= 0 {
+		methods = []byte{expected}
+	}
+	require := suite.Require()
+	c := suite.pipe.client
+	_, err := c.Write(append([]byte{socks.Version5, byte(len(methods))}, methods...))
+	require.NoError(err)
+	b := make([]byte, 2)
+	_, err = io.ReadFull(c, b)
+	require.NoError(err)
+	require.Equal([]byte{socks.Version5, expected}, b)
+}
+
+func (suite *SOCKSTestSuite) authenticate(username, password string) byte {
+	require := suite.Require()
+	c := suite.pipe.client
+	b := []byte{socks.UserPassVersion, byte(len(username))}
+	b = append(b, username...)
+	b = append(b, byte(len(password)))
+	b = append(b, password...)
+	_, err := c.Write(b)
+	require.NoError(err)
+	_, err = io.ReadFull(c, b[:2])
+	require.NoError(err)
+	return b[1]
+}
+
+func (suite *SOCKSTestSuite) request(cmd byte, hostport string) (socks.Reply, socks.Addr) {
+	require := suite.Require()
+	addr, err := socks.ParseAddr(hostport)
+	require.NoError(err)
+	b, err := addr.Append([]byte{socks.Version5, cmd, 0})
+	require.NoError(err)
+	_, err = suite.pipe.client.Write(b)
+	require.NoError(err)
+	return suite.readReply()
+}
+
+func (suite *SOCKSTestSuite) requestSOCKS4(addr socks.Addr, userID string) byte {
+	require := suite.Require()
+	b := []byte{socks.Version4, socks.CmdConnect, byte(addr.Port >> 8), byte(addr.Port)}
+	if addr.Name != "" {
+		b = append(b, 0, 0, 0, 1)
+	} else {
+		b = append(b, addr.IP.To4()...)
+	}
+	b = append(b, userID...)
+	b = append(b, 0)
+	if addr.Name != "" {
+		b = append(b, addr.Name...)
+		b = append(b, 0)
+	}
+	_, err := suite.pipe.client.Write(b)
+	require.NoError(err)
+	_, err = io.ReadFull(suite.pipe.client, b[:8])
+	require.NoError(err)
+	require.Equal(byte(0), b[0])
+	return b[1]
+}
+
+func (suite *SOCKSTestSuite) readReply() (socks.Reply, socks.Addr) {
+	require := suite.Require()
+	b := make([]byte, 3)
+	_, err := io.ReadFull(suite.pipe.client, b)
+	require.NoError(err)
+	require.Equal(byte(socks.Version5), b[0])
+	addr, err := socks.ReadAddr(suite.pipe.client)
+	require.NoError(err)
+	return socks.Reply(b[1]), addr
+}
+
+func (suite *SOCKSTestSuite) assertEcho(c net.Conn) {
+	require := suite.Require()
+	expected := []byte("message to be echoed")
+	_, err := c.Write(expected)
+	require.NoError(err)
+	b := make([]byte, len(expected))
+	_, err = io.ReadFull(c, b)
+	require.NoError(err)
+	require.Equal(expected, b)
+}
+
+func startUDPEcho(t *testing.T) *net.UDPConn {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := c.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			_, _ = c.WriteToUDP(b[:n], addr)
+		}
+	}()
+	return c
+}
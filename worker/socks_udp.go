@@ -0,0 +1,395 @@
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Frizz925/gilgamesh/acl"
+	"github.com/Frizz925/gilgamesh/proxyproto"
+	"github.com/Frizz925/gilgamesh/socks"
+	"github.com/Frizz925/gilgamesh/usage"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	DefaultUDPIdleTimeout = 2 * time.Minute
+	// Large enough for any UDP payload plus the SOCKS header
+	udpBufferSize = 64 * 1024
+	// How long destination names are not looked up again, the resolver
+	// cache honoring the record TTLs past that
+	udpResolvedTTL = 10 * time.Second
+)
+
+// udpAssociation relays datagrams between a single SOCKS client and any
+// number of remote hosts the client has sent datagrams to.
+type udpAssociation struct {
+	log *zap.Logger
+
+	// Socket facing the client and the one facing the remote hosts
+	clientConn *net.UDPConn
+	remoteConn *net.UDPConn
+
+	// Only datagrams from this IP, and port if non-zero, are relayed
+	clientIP   net.IP
+	clientPort int
+
+	idleTimeout time.Duration
+	resolver    acl.Resolver
+	// Bounds the lookups of destination names, which hold up the relay
+	lookupTimeout time.Duration
+	bandwidth     bandwidth
+	// Accounts the bytes sent to or received from a remote host
+	account func(remote string, upload, download int64)
+	// Ends the association once the user goes over the quota, if set
+	quota          *usage.UserQuota
+	closeOverQuota bool
+
+	// Tells whether the client may send datagrams to a new destination
+	access func(dst socks.Addr, ip net.IP) bool
+	denied map[string]struct{}
+
+	bytesOut   int64
+	bytesIn    int64
+	packetsOut int64
+	packetsIn  int64
+
+	mu     sync.Mutex
+	client *net.UDPAddr
+	// Destinations as requested by the client, by their resolved address
+	remotes   map[string]string
+	resolved  map[string]resolvedAddr
+	idleTimer *time.Timer
+	timedOut  bool
+	overQuota bool
+}
+
+// serveSOCKS5UDP relays datagrams of the client through a new association.
+// Associations are refused for connections relayed with a PROXY protocol
+// header, whose client address is not the one datagrams come from.
+func (w *Worker) serveSOCKS5UDP(log *zap.Logger, c net.Conn, rb *bufio.Reader, wb *bufio.Writer, user string, addr socks.Addr) {
+	if pc, ok := c.(*proxyproto.Conn); ok && pc.Header().Source != nil {
+		log.Warn("Unsupported UDP association", zap.String("reason", "connection behind PROXY protocol"))
+		w.replySOCKS5(log, wb, socks.ReplyCommandNotSupported, socks.Addr{})
+		return
+	}
+	// Datagrams of every destination add up in the record of the association
+	access := w.traffic.access
+	a := &udpAssociation{
+		clientPort:    addr.Port,
+		idleTimeout:   w.udpIdleTimeout,
+		resolver:      w.resolver,
+		lookupTimeout: w.dialTimeout,
+		bandwidth:     w.bandwidthOf(user),
+		account: func(remote string, upload, download int64) {
+			w.account(traffic{user: user, dst: remote, access: access}, upload, download)
+		},
+		quota:          w.traffic.quota,
+		closeOverQuota: w.closeOverQuota,
+		denied:         make(map[string]struct{}),
+		remotes:        make(map[string]string),
+		resolved:       make(map[string]resolvedAddr),
+	}
+	if v, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		a.clientIP = v.IP
+	} else if addr.IP != nil && !addr.IP.IsUnspecified() {
+		a.clientIP = addr.IP
+	}
+
+	laddr := &net.UDPAddr{}
+	if v, ok := c.LocalAddr().(*net.TCPAddr); ok {
+		laddr.IP = v.IP
+	}
+	var err error
+	if a.clientConn, err = net.ListenUDP("udp", laddr); err != nil {
+		log.Error("Failed to listen for UDP relay", zap.Error(err))
+		w.replySOCKS5(log, wb, socks.ReplyGeneralFailure, socks.Addr{})
+		return
+	}
+	defer a.clientConn.Close()
+	if a.remoteConn, err = net.ListenUDP("udp", nil); err != nil {
+		log.Error("Failed to listen for UDP relay", zap.Error(err))
+		w.replySOCKS5(log, wb, socks.ReplyGeneralFailure, socks.Addr{})
+		return
+	}
+	defer a.remoteConn.Close()
+
+	a.log = log.With(zap.String("relay", a.clientConn.LocalAddr().String()))
+	a.access = func(dst socks.Addr, ip net.IP) bool {
+		if w.guard != nil {
+			if err := w.guard.Check(ip); err != nil {
+				a.log.Warn("Access denied", zap.String("dst", dst.String()), zap.String("reason", "blocked address"))
+				return false
+			}
+		}
+		req := acl.Request{
+			User:   user,
+			Method: acl.MethodUDP,
+			Host:   dst.Host(),
+			Port:   dst.Port,
+			IPs:    []net.IP{ip},
+		}
+		return w.checkAccess(a.log.With(zap.String("dst", dst.String())), c, req)
+	}
+	if !w.replySOCKS5(a.log, wb, socks.ReplySucceeded, socks.AddrFromNet(a.clientConn.LocalAddr())) {
+		return
+	}
+	a.log.Info("Opened UDP association")
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			_ = a.clientConn.Close()
+			_ = a.remoteConn.Close()
+			// Unblock the control connection reader
+			_ = c.SetReadDeadline(time.Now())
+		})
+	}
+	a.idleTimer = time.AfterFunc(a.idleTimeout, func() {
+		a.mu.Lock()
+		a.timedOut = true
+		a.mu.Unlock()
+		stop()
+	})
+	defer a.idleTimer.Stop()
+
+	g := &errgroup.Group{}
+	// The association lives as long as the control connection does
+	g.Go(func() error {
+		defer stop()
+		_, err := rb.WriteTo(ioutil.Discard)
+		return err
+	})
+	g.Go(func() error {
+		defer stop()
+		return a.relayClient()
+	})
+	g.Go(func() error {
+		defer stop()
+		return a.relayRemote()
+	})
+	_ = g.Wait()
+
+	reason := "control connection closed"
+	a.mu.Lock()
+	if a.timedOut {
+		reason = "idle timeout"
+	} else if a.overQuota {
+		reason = reasonQuotaExceeded
+	}
+	a.mu.Unlock()
+	a.log.Info("Closed UDP association",
+		zap.String("reason", reason),
+		zap.Int64("bytes_out", atomic.LoadInt64(&a.bytesOut)),
+		zap.Int64("bytes_in", atomic.LoadInt64(&a.bytesIn)),
+		zap.Int64("packets_out", atomic.LoadInt64(&a.packetsOut)),
+		zap.Int64("packets_in", atomic.LoadInt64(&a.packetsIn)),
+	)
+}
+
+// relayClient forwards datagrams from the client to their destinations.
+func (a *udpAssociation) relayClient() error {
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, src, err := a.clientConn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		if !a.acceptClient(src) {
+			a.log.Warn("Dropped datagram from unauthorized address", zap.String("peer", src.String()))
+			continue
+		}
+		// Fragmentation is not supported, such datagrams are dropped
+		if n < 4 || buf[2] != 0 {
+			a.log.Debug("Dropped malformed or fragmented datagram")
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		dst, err := socks.ReadAddr(r)
+		if err != nil {
+			a.log.Debug("Dropped datagram with malformed address", zap.Error(err))
+			continue
+		}
+		raddr, err := a.resolve(dst)
+		if err != nil {
+			a.log.Debug("Failed to resolve datagram destination", zap.String("dst", dst.String()), zap.Error(err))
+			continue
+		}
+		if !a.checkRemote(dst, raddr) {
+			continue
+		}
+		payload := buf[n-r.Len() : n]
+		a.allowRemote(raddr, dst)
+		a.bandwidth.upload.Wait(len(payload))
+		if _, err := a.remoteConn.WriteToUDP(payload, raddr); err != nil {
+			a.log.Debug("Failed to send datagram", zap.String("dst", raddr.String()), zap.Error(err))
+			continue
+		}
+		a.touch()
+		atomic.AddInt64(&a.bytesOut, int64(len(payload)))
+		a.account(dst.String(), int64(len(payload)), 0)
+		if !a.countQuota(len(payload)) {
+			return errQuotaExceeded
+		}
+		atomic.AddInt64(&a.packetsOut, 1)
+	}
+}
+
+// relayRemote forwards datagrams from remote hosts back to the client.
+func (a *udpAssociation) relayRemote() error {
+	buf := make([]byte, udpBufferSize)
+	// Leave room for the largest header in front of the payload
+	const offset = 3 + 1 + net.IPv6len + 2
+	for {
+		n, src, err := a.remoteConn.ReadFromUDP(buf[offset:])
+		if err != nil {
+			return err
+		}
+		client, dst := a.remoteAllowed(src)
+		if client == nil {
+			continue
+		}
+		header, err := socks.AddrFromNet(src).Append(make([]byte, 3, offset))
+		if err != nil {
+			continue
+		}
+		start := offset - len(header)
+		copy(buf[start:], header)
+		a.bandwidth.download.Wait(n)
+		if _, err := a.clientConn.WriteToUDP(buf[start:offset+n], client); err != nil {
+			a.log.Debug("Failed to send datagram", zap.String("dst", client.String()), zap.Error(err))
+			continue
+		}
+		a.touch()
+		atomic.AddInt64(&a.bytesIn, int64(n))
+		a.account(dst, 0, int64(n))
+		if !a.countQuota(n) {
+			return errQuotaExceeded
+		}
+		atomic.AddInt64(&a.packetsIn, 1)
+	}
+}
+
+// countQuota counts relayed bytes against the quota, reporting whether the
+// association may go on.
+func (a *udpAssociation) countQuota(n int) bool {
+	if a.quota.Add(int64(n)) || !a.closeOverQuota {
+		return true
+	}
+	a.mu.Lock()
+	a.overQuota = true
+	a.mu.Unlock()
+	return false
+}
+
+// acceptClient reports whether the datagram comes from the client owning
+// the association. The first accepted source address is pinned.
+func (a *udpAssociation) acceptClient(src *net.UDPAddr) bool {
+	if a.clientIP != nil && !a.clientIP.Equal(src.IP) {
+		return false
+	}
+	if a.clientPort != 0 && a.clientPort != src.Port {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.client == nil {
+		a.client = src
+		return true
+	}
+	return a.client.IP.Equal(src.IP) && a.client.Port == src.Port
+}
+
+// checkRemote reports whether the client may send datagrams to the
+// destination, evaluating the ACL once per destination.
+func (a *udpAssociation) checkRemote(dst socks.Addr, raddr *net.UDPAddr) bool {
+	key := raddr.String()
+	a.mu.Lock()
+	_, ok := a.remotes[key]
+	a.mu.Unlock()
+	if ok {
+		return true
+	}
+	if _, ok := a.denied[key]; ok {
+		return false
+	}
+	if !a.access(dst, raddr.IP) {
+		a.denied[key] = struct{}{}
+		return false
+	}
+	return true
+}
+
+// allowRemote lets the remote host reply, its datagrams being accounted
+// under the destination the client asked for.
+func (a *udpAssociation) allowRemote(raddr *net.UDPAddr, dst socks.Addr) {
+	a.mu.Lock()
+	a.remotes[raddr.String()] = dst.String()
+	a.mu.Unlock()
+}
+
+// remoteAllowed returns the client address and the destination the client
+// asked for if the remote host has been sent datagrams to before, nil
+// otherwise.
+func (a *udpAssociation) remoteAllowed(src *net.UDPAddr) (*net.UDPAddr, string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	dst, ok := a.remotes[src.String()]
+	if !ok {
+		return nil, ""
+	}
+	return a.client, dst
+}
+
+// resolve returns the address datagrams to the destination are sent to,
+// looking names up within the lookup timeout.
+func (a *udpAssociation) resolve(dst socks.Addr) (*net.UDPAddr, error) {
+	if dst.Name == "" {
+		return &net.UDPAddr{IP: dst.IP, Port: dst.Port}, nil
+	}
+	key := dst.String()
+	now := time.Now()
+	if v, ok := a.resolved[key]; ok && now.Before(v.expires) {
+		return v.addr, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), a.lookupTimeout)
+	defer cancel()
+	addrs, err := a.resolver.LookupIPAddr(ctx, dst.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) <= 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: dst.Name, IsNotFound: true}
+	}
+	// Prefer IPv4 addresses like the standard resolution does
+	raddr := &net.UDPAddr{IP: addrs[0].IP, Port: dst.Port}
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			raddr.IP = addr.IP
+			break
+		}
+	}
+	a.resolved[key] = resolvedAddr{addr: raddr, expires: now.Add(udpResolvedTTL)}
+	return raddr, nil
+}
+
+// resolvedAddr is the address a destination name resolved to, reused until
+// it expires.
+type resolvedAddr struct {
+	addr    *net.UDPAddr
+	expires time.Time
+}
+
+func (a *udpAssociation) touch() {
+	a.mu.Lock()
+	if !a.timedOut {
+		a.idleTimer.Reset(a.idleTimeout)
+	}
+	a.mu.Unlock()
+}
@@ -0,0 +1,40 @@
+package worker
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/Frizz925/gilgamesh/ratelimit"
+)
+
+// bandwidth holds the buckets limiting the bytes sent by the client and the
+// ones sent back to it, nil for unlimited directions.
+type bandwidth struct {
+	upload   *ratelimit.Bucket
+	download *ratelimit.Bucket
+}
+
+// bandwidthOf returns the buckets of the user, or of the client address for
+// anonymous clients so that they don't all share a single limit.
+func (w *Worker) bandwidthOf(user string) bandwidth {
+	var upload, download *ratelimit.Bucket
+	if user == "" && w.conn != nil {
+		upload, download = w.throttle.ClientBuckets(addrIP(w.conn.RemoteAddr()).String())
+	} else {
+		upload, download = w.throttle.Buckets(user)
+	}
+	return bandwidth{upload: upload, download: download}
+}
+
+type limitedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// limitBody makes reading the message body wait for the bucket.
+func limitBody(body io.ReadCloser, b *ratelimit.Bucket) io.ReadCloser {
+	if b == nil || body == nil || body == http.NoBody {
+		return body
+	}
+	return limitedBody{Reader: b.Reader(body), Closer: body}
+}
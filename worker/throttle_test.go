@@ -0,0 +1,43 @@
+package worker
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Frizz925/gilgamesh/ratelimit"
+)
+
+func (suite *WorkerTestSuite) TestThrottle() {
+	require := suite.Require()
+	w := New(Config{
+		Logger: suite.logger,
+		Throttle: ratelimit.NewThrottle(ratelimit.ThrottleConfig{
+			Default: ratelimit.Limits{Upload: 10000},
+		}),
+	})
+	go w.ServeConn(suite.pipe.server)
+
+	c := suite.pipe.client
+	br, bw := bufio.NewReader(c), bufio.NewWriter(c)
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    suite.url,
+		Host:   suite.url.Host,
+	}
+	require.NoError(req.Write(bw))
+	require.NoError(bw.Flush())
+	res, err := http.ReadResponse(br, req)
+	require.NoError(err)
+	require.Equal(http.StatusOK, res.StatusCode)
+
+	// A second's worth of bytes passes right away, the next one being held
+	// back until the bucket is refilled
+	body := strings.Repeat("x", 25000)
+	start := time.Now()
+	_, err = fmt.Fprintf(c, "POST / HTTP/1.1\r\nHost: %s\r\nContent-Length: %d\r\n\r\n%s", suite.url.Host, len(body), body)
+	require.NoError(err)
+	require.GreaterOrEqual(int64(time.Since(start)), int64(900*time.Millisecond))
+}
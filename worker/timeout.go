@@ -0,0 +1,195 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const DefaultIdleTimeout = 5 * time.Minute
+
+// Reasons of connections and tunnels being closed on timeout
+const (
+	reasonHeaderTimeout = "header timeout"
+	reasonIdleTimeout   = "idle timeout"
+	reasonMaxLifetime   = "max lifetime"
+)
+
+// Reason of tunnels ended by the server shutting down
+const reasonShutdown = "shutdown"
+
+// forwardEndedError reports a forwarded request whose watch ended it.
+type forwardEndedError struct {
+	reason string
+}
+
+func (e *forwardEndedError) Error() string {
+	return "forward ended: " + e.reason
+}
+
+// tunnelWatch ends a tunnel once it has been idle or open for too long by
+// expiring the deadlines of its connections, unblocking any copy in progress.
+type tunnelWatch struct {
+	worker   *Worker
+	conns    []net.Conn
+	idle     time.Duration
+	deadline time.Time
+	// Unix time in nanoseconds of the last bytes relayed
+	active int64
+
+	mu     sync.Mutex
+	timer  *time.Timer
+	reason string
+}
+
+// watchTunnel starts watching the tunnel made of the given connections.
+func (w *Worker) watchTunnel(conns ...net.Conn) *tunnelWatch {
+	return w.watch(w.maxLifetime, conns)
+}
+
+// watchForward starts watching the connections a plain request is forwarded
+// over, which time out once idle but have no maximum lifetime.
+func (w *Worker) watchForward(conns ...net.Conn) *tunnelWatch {
+	return w.watch(0, conns)
+}
+
+func (w *Worker) watch(lifetime time.Duration, conns []net.Conn) *tunnelWatch {
+	now := time.Now()
+	tw := &tunnelWatch{
+		worker: w,
+		conns:  conns,
+		idle:   w.idleTimeout,
+		active: now.UnixNano(),
+	}
+	if lifetime > 0 {
+		tw.deadline = now.Add(lifetime)
+	}
+	if next := tw.next(now); next > 0 {
+		tw.timer = time.AfterFunc(next, tw.check)
+	}
+	w.watchMu.Lock()
+	w.watches[tw] = struct{}{}
+	w.watchMu.Unlock()
+	return tw
+}
+
+// touch marks the tunnel as active.
+func (tw *tunnelWatch) touch() {
+	atomic.StoreInt64(&tw.active, time.Now().UnixNano())
+}
+
+// reader returns a reader marking the tunnel as active on every read.
+func (tw *tunnelWatch) reader(r io.Reader) io.Reader {
+	return watchReader{r: r, tw: tw}
+}
+
+// body returns a message body marking the tunnel as active on every read.
+func (tw *tunnelWatch) body(body io.ReadCloser) io.ReadCloser {
+	if body == nil || body == http.NoBody {
+		return body
+	}
+	return limitedBody{Reader: tw.reader(body), Closer: body}
+}
+
+// stop stops watching the tunnel, returning the reason it was ended for, if
+// any.
+func (tw *tunnelWatch) stop() string {
+	tw.worker.watchMu.Lock()
+	delete(tw.worker.watches, tw)
+	tw.worker.watchMu.Unlock()
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timer != nil {
+		tw.timer.Stop()
+	}
+	return tw.reason
+}
+
+// next returns how long to wait before checking the tunnel again, zero if
+// it never times out.
+func (tw *tunnelWatch) next(now time.Time) time.Duration {
+	var next time.Duration
+	if tw.idle > 0 {
+		next = time.Unix(0, atomic.LoadInt64(&tw.active)).Add(tw.idle).Sub(now)
+	}
+	if !tw.deadline.IsZero() {
+		if d := tw.deadline.Sub(now); next <= 0 || d < next {
+			next = d
+		}
+	}
+	return next
+}
+
+// end ends the tunnel right away for the given reason.
+func (tw *tunnelWatch) end(reason string) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.reason != "" {
+		return
+	}
+	tw.reason = reason
+	now := time.Now()
+	for _, c := range tw.conns {
+		_ = c.SetDeadline(now)
+	}
+}
+
+func (tw *tunnelWatch) check() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.reason != "" {
+		return
+	}
+	now := time.Now()
+	switch {
+	case !tw.deadline.IsZero() && !now.Before(tw.deadline):
+		tw.reason = reasonMaxLifetime
+	case tw.idle > 0 && now.Sub(time.Unix(0, atomic.LoadInt64(&tw.active))) >= tw.idle:
+		tw.reason = reasonIdleTimeout
+	default:
+		tw.timer.Reset(tw.next(now))
+		return
+	}
+	for _, c := range tw.conns {
+		_ = c.SetDeadline(now)
+	}
+}
+
+type watchReader struct {
+	r  io.Reader
+	tw *tunnelWatch
+}
+
+func (wr watchReader) Read(b []byte) (int, error) {
+	n, err := wr.r.Read(b)
+	if n > 0 {
+		wr.tw.touch()
+	}
+	return n, err
+}
+
+// logReadError logs a failure to read from the client, telling timeouts
+// apart from other errors.
+func logReadError(log *zap.Logger, msg string, err error) {
+	if isTimeout(err) {
+		log.Info("Connection timed out", zap.String("reason", reasonHeaderTimeout))
+		return
+	}
+	log.Error(msg, zap.Error(err))
+}
+
+func isDialTimeout(err error) bool {
+	return isTimeout(err) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,127 @@
+package worker
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+type blockingDialer struct{}
+
+func (blockingDialer) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (suite *WorkerTestSuite) TestHeaderTimeout() {
+	w := New(Config{
+		Logger:        suite.logger,
+		HeaderTimeout: 50 * time.Millisecond,
+	})
+	done := make(chan struct{})
+	go func() {
+		w.ServeConn(suite.pipe.server)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		suite.FailNow("Connection not closed on header timeout")
+	}
+}
+
+func (suite *WorkerTestSuite) TestDialTimeout() {
+	require := suite.Require()
+	w := New(Config{
+		Logger:      suite.logger,
+		Upstream:    blockingDialer{},
+		DialTimeout: 50 * time.Millisecond,
+	})
+	go w.ServeConn(suite.pipe.server)
+
+	res, err := suite.client.Do(&http.Request{
+		Method: http.MethodConnect,
+		URL:    suite.url,
+	})
+	require.NoError(err)
+	require.Equal(http.StatusGatewayTimeout, res.StatusCode)
+}
+
+func (suite *WorkerTestSuite) TestTunnelIdleTimeout() {
+	suite.testTunnelTimeout(Config{
+		Logger:      suite.logger,
+		IdleTimeout: 100 * time.Millisecond,
+	})
+}
+
+func (suite *WorkerTestSuite) TestTunnelMaxLifetime() {
+	suite.testTunnelTimeout(Config{
+		Logger:            suite.logger,
+		MaxTunnelLifetime: 100 * time.Millisecond,
+	})
+}
+
+// testTunnelTimeout opens a tunnel to the test server, which never sends
+// anything unprompted, and waits for the worker to end it.
+func (suite *WorkerTestSuite) testTunnelTimeout(cfg Config) {
+	require := suite.Require()
+	w := New(cfg)
+	go w.ServeConn(suite.pipe.server)
+
+	c := suite.pipe.client
+	br, bw := bufio.NewReader(c), bufio.NewWriter(c)
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    suite.url,
+		Host:   suite.url.Host,
+	}
+	require.NoError(req.Write(bw))
+	require.NoError(bw.Flush())
+	res, err := http.ReadResponse(br, req)
+	require.NoError(err)
+	require.Equal(http.StatusOK, res.StatusCode)
+
+	require.NoError(c.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = ioutil.ReadAll(br)
+	require.NoError(err)
+}
+
+func (suite *WorkerTestSuite) TestForwardIdleTimeout() {
+	require := suite.Require()
+	// Origin accepting requests without ever answering them
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	w := New(Config{
+		Logger:      suite.logger,
+		IdleTimeout: 100 * time.Millisecond,
+	})
+	done := make(chan struct{})
+	go func() {
+		w.ServeConn(suite.pipe.server)
+		close(done)
+	}()
+
+	res, err := suite.client.Get("http://" + l.Addr().String())
+	require.NoError(err)
+	require.Equal(http.StatusGatewayTimeout, res.StatusCode)
+	require.NoError(res.Body.Close())
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		suite.FailNow("Worker still busy after the forward timed out")
+	}
+}
@@ -0,0 +1,162 @@
+package worker
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Frizz925/gilgamesh/acl"
+	"go.uber.org/zap"
+)
+
+// Clients speaking first are given this long to send a TLS ClientHello
+// before the connection is relayed as is.
+const DefaultSniffTimeout = 500 * time.Millisecond
+
+var errSniffDone = errors.New("sniffing done")
+
+// ServeTransparent serves a connection redirected to the proxy by the
+// firewall, relaying it to its original destination without expecting any
+// proxy protocol from the client.
+func (w *Worker) ServeTransparent(c net.Conn) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	log := w.logger.With(
+		zap.String("src", c.RemoteAddr().String()),
+		zap.String("listener", c.LocalAddr().String()),
+		zap.String("protocol", "transparent"),
+	)
+	log.Info("Serving new connection")
+	w.conn = c
+	defer func() {
+		w.conn = nil
+		_ = c.Close()
+		log.Info("Closed connection")
+	}()
+
+	dst, err := originalDst(c)
+	if err != nil {
+		log.Error("Failed to recover original destination", zap.Error(err))
+		return
+	}
+	log = log.With(zap.String("dst", dst.String()))
+	if isListenerAddr(dst, c.LocalAddr()) {
+		log.Error("Refusing to relay connection to the proxy itself")
+		return
+	}
+	w.serveTransparent(log, c, dst.String())
+}
+
+// serveTransparent relays the connection to the destination, its outcome
+// being given the status code a tunnel would have been answered with.
+func (w *Worker) serveTransparent(log *zap.Logger, c net.Conn, hostport string) {
+	sni, r := w.sniffSNI(log, c)
+	access := newAccess(c, "transparent", acl.MethodConnect, hostport)
+	defer func() {
+		w.logAccess(log, access, w.outcome)
+		w.recordOutcome("transparent")
+	}()
+	req := newACLRequest("", acl.MethodConnect, hostport)
+	if sni != "" {
+		log = log.With(zap.String("sni", sni))
+		// The name is checked while the address actually dialed is kept
+		if ip := net.ParseIP(req.Host); ip != nil {
+			req.IPs = []net.IP{ip}
+		}
+		req.Host = sni
+	}
+	if w.checkIPRequestRate(log, c) > 0 {
+		w.outcome = strconv.Itoa(http.StatusTooManyRequests)
+		return
+	}
+	if !w.checkAccess(log, c, req) {
+		w.outcome = strconv.Itoa(http.StatusForbidden)
+		return
+	}
+	rb := acquireReader(w.reader, r)
+	wb := acquireWriter(w.writer, c)
+	w.bandwidth = w.bandwidthOf("")
+	w.traffic = traffic{dst: hostport, access: access}
+	defer func() {
+		w.bandwidth = bandwidth{}
+		w.traffic = traffic{}
+	}()
+
+	t, err := w.openTunnel(log, hostport)
+	if err != nil {
+		w.outcome = strconv.Itoa(dialStatus(err))
+		return
+	}
+	defer t.Close()
+	w.outcome = strconv.Itoa(http.StatusOK)
+	w.relay(log, c, t, rb, wb, w.tunnel.reader, w.tunnel.writer)
+}
+
+// sniffSNI reads the TLS ClientHello sent by the client, if any, and returns
+// the requested server name along with a reader replaying the consumed bytes
+// in front of the rest of the connection.
+func (w *Worker) sniffSNI(log *zap.Logger, c net.Conn) (string, io.Reader) {
+	if err := c.SetReadDeadline(time.Now().Add(w.sniffTimeout)); err != nil {
+		log.Debug("Failed to set sniffing deadline", zap.Error(err))
+		return "", c
+	}
+	var buf bytes.Buffer
+	var sni string
+	err := tls.Server(sniffConn{Conn: c, r: io.TeeReader(c, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = hello.ServerName
+			return nil, errSniffDone
+		},
+	}).Handshake()
+	if err := c.SetReadDeadline(time.Time{}); err != nil {
+		log.Debug("Failed to reset sniffing deadline", zap.Error(err))
+	}
+	if !errors.Is(err, errSniffDone) {
+		log.Debug("No TLS ClientHello received", zap.Error(err))
+	}
+	return sni, io.MultiReader(&buf, c)
+}
+
+// sniffConn feeds the TLS handshake with bytes read from the client while
+// making sure nothing is ever written back to it.
+type sniffConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c sniffConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c sniffConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// isListenerAddr reports whether the destination is the transparent listener
+// itself, as happens when a client connects to it directly. Addresses not
+// local to this host, such as the ones TPROXY binds to, never are.
+func isListenerAddr(dst *net.TCPAddr, local net.Addr) bool {
+	la, ok := local.(*net.TCPAddr)
+	if !ok || la.Port != dst.Port {
+		return false
+	}
+	if dst.IP.IsLoopback() || dst.IP.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(dst.IP) {
+			return true
+		}
+	}
+	return false
+}
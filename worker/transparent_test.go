@@ -0,0 +1,146 @@
+package worker
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Frizz925/gilgamesh/acl"
+	"github.com/Frizz925/gilgamesh/metrics"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestSniffSNI(t *testing.T) {
+	require := require.New(t)
+	w := New(Config{Logger: zap.NewNop()})
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		_ = tls.Client(client, &tls.Config{ServerName: "example.com"}).Handshake()
+	}()
+
+	sni, r := w.sniffSNI(w.logger, server)
+	require.Equal("example.com", sni)
+	// The ClientHello is replayed to the destination
+	b := make([]byte, 1)
+	_, err := io.ReadFull(r, b)
+	require.NoError(err)
+	require.Equal(byte(0x16), b[0])
+	_ = client.Close()
+}
+
+func TestSniffSNIPlaintext(t *testing.T) {
+	require := require.New(t)
+	w := New(Config{Logger: zap.NewNop()})
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	const msg = "GET / HTTP/1.1\r\n"
+	go func() {
+		_, _ = client.Write([]byte(msg))
+	}()
+
+	sni, r := w.sniffSNI(w.logger, server)
+	require.Empty(sni)
+	b := make([]byte, len(msg))
+	_, err := io.ReadFull(r, b)
+	require.NoError(err)
+	require.Equal(msg, string(b))
+}
+
+func TestSniffSNITimeout(t *testing.T) {
+	require := require.New(t)
+	w := New(Config{Logger: zap.NewNop(), SniffTimeout: 50 * time.Millisecond})
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// Clients waiting for the server to speak first are not held up
+	sni, r := w.sniffSNI(w.logger, server)
+	require.Empty(sni)
+	go func() {
+		_, _ = client.Write([]byte("hello"))
+	}()
+	b := make([]byte, 5)
+	_, err := io.ReadFull(r, b)
+	require.NoError(err)
+	require.Equal("hello", string(b))
+}
+
+func TestServeTransparentTLS(t *testing.T) {
+	require := require.New(t)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Host)
+	}))
+	defer ts.Close()
+
+	w := New(Config{Logger: zap.NewNop()})
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		w.serveTransparent(w.logger, server, ts.Listener.Addr().String())
+		_ = server.Close()
+	}()
+
+	tc := tls.Client(client, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true}) //nolint:gosec
+	req, err := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+	require.NoError(err)
+	require.NoError(req.Write(tc))
+	res, err := http.ReadResponse(bufio.NewReader(tc), req)
+	require.NoError(err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(err)
+	require.Equal("example.com", string(body))
+}
+
+func TestServeTransparentOutcome(t *testing.T) {
+	require := require.New(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	refused := l.Addr().String()
+	require.NoError(l.Close())
+	m := metrics.NewProxy(nil)
+	serve := func(cfg Config) {
+		cfg.Logger, cfg.Metrics = zap.NewNop(), m
+		client, server := net.Pipe()
+		defer client.Close()
+		w := New(cfg)
+		// Plaintext clients wait for the sniffing to time out
+		w.serveTransparent(w.logger, server, refused)
+	}
+
+	serve(Config{SniffTimeout: time.Millisecond})
+	serve(Config{
+		SniffTimeout: time.Millisecond,
+		ACL:          acl.New(acl.Config{Default: acl.Deny}),
+	})
+	out := scrapeMetrics(m)
+	require.Contains(out, `gilgamesh_requests_total{protocol="transparent",code="502"} 1`)
+	require.Contains(out, `gilgamesh_requests_total{protocol="transparent",code="403"} 1`)
+}
+
+func TestServeTransparentLoop(t *testing.T) {
+	require := require.New(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(err)
+	defer client.Close()
+	server, err := l.Accept()
+	require.NoError(err)
+
+	// Connecting to the listener directly must not make it dial itself
+	w := New(Config{Logger: zap.NewNop()})
+	w.ServeTransparent(server)
+	_, err = client.Read(make([]byte, 1))
+	require.Equal(io.EOF, err)
+}
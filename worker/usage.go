@@ -0,0 +1,52 @@
+package worker
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/Frizz925/gilgamesh/accesslog"
+	"github.com/Frizz925/gilgamesh/usage"
+)
+
+// traffic names the user and destination relayed bytes are accounted to,
+// along with the quota they count against and the access log record of the
+// request they are relayed for.
+type traffic struct {
+	user   string
+	dst    string
+	quota  *usage.UserQuota
+	access *accesslog.Entry
+}
+
+// account adds the bytes relayed to the usage of the user and destination,
+// to the metrics and to the access log record.
+func (w *Worker) account(t traffic, upload, download int64) {
+	w.meter.Add(t.user, t.dst, upload, download)
+	w.metrics.Bytes.With("upload").Add(float64(upload))
+	w.metrics.Bytes.With("download").Add(float64(download))
+	if t.access != nil {
+		atomic.AddInt64(&t.access.BytesIn, upload)
+		atomic.AddInt64(&t.access.BytesOut, download)
+	}
+}
+
+// countingBody counts the bytes read from a message body.
+type countingBody struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (cb countingBody) Read(b []byte) (int, error) {
+	n, err := cb.ReadCloser.Read(b)
+	atomic.AddInt64(cb.n, int64(n))
+	return n, err
+}
+
+// countBody adds the bytes read from body to n, skipping missing bodies.
+func countBody(body io.ReadCloser, n *int64) io.ReadCloser {
+	if body == nil || body == http.NoBody {
+		return body
+	}
+	return countingBody{ReadCloser: body, n: n}
+}
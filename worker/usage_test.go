@@ -0,0 +1,68 @@
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Frizz925/gilgamesh/usage"
+)
+
+func (suite *WorkerTestSuite) TestUsage() {
+	require := suite.Require()
+	dir, err := ioutil.TempDir("", "usage")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	store := usage.NewStore(filepath.Join(dir, "usage.log"))
+	meter := usage.NewMeter(store)
+	w := New(Config{
+		Logger: suite.logger,
+		Meter:  meter,
+	})
+	done := make(chan struct{})
+	go func() {
+		w.ServeConn(suite.pipe.server)
+		close(done)
+	}()
+
+	c := suite.pipe.client
+	br, bw := bufio.NewReader(c), bufio.NewWriter(c)
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    suite.url,
+		Host:   suite.url.Host,
+	}
+	require.NoError(req.Write(bw))
+	require.NoError(bw.Flush())
+	res, err := http.ReadResponse(br, req)
+	require.NoError(err)
+	require.Equal(http.StatusOK, res.StatusCode)
+
+	// Bytes relayed through the tunnel are accounted once it is closed
+	treq, err := http.NewRequest(http.MethodGet, suite.url.String(), nil)
+	require.NoError(err)
+	treq.Close = true
+	var buf bytes.Buffer
+	require.NoError(treq.Write(&buf))
+	upload := buf.Len()
+	_, err = buf.WriteTo(c)
+	require.NoError(err)
+	tres, err := http.ReadResponse(br, treq)
+	require.NoError(err)
+	require.Equal(http.StatusOK, tres.StatusCode)
+	require.NoError(c.Close())
+	<-done
+
+	require.NoError(meter.Flush())
+	now := time.Now()
+	records, err := store.Read(now.Add(-time.Minute), now)
+	require.NoError(err)
+	require.Len(records, 1)
+	require.Equal(suite.url.Host, records[0].Destination)
+	require.Equal(int64(upload), records[0].Upload)
+	require.Greater(records[0].Download, int64(0))
+}
@@ -2,18 +2,29 @@ package worker
 
 import (
 	"bufio"
+	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/Frizz925/gilgamesh/accesslog"
+	"github.com/Frizz925/gilgamesh/acl"
 	"github.com/Frizz925/gilgamesh/auth"
+	"github.com/Frizz925/gilgamesh/dns"
+	"github.com/Frizz925/gilgamesh/metrics"
+	"github.com/Frizz925/gilgamesh/ratelimit"
+	"github.com/Frizz925/gilgamesh/upstream"
+	"github.com/Frizz925/gilgamesh/usage"
+	"github.com/Frizz925/gilgamesh/utils"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 )
@@ -41,15 +52,72 @@ type Worker struct {
 		writer *bufio.Writer
 	}
 
-	logger          *zap.Logger
-	dialer          *net.Dialer
-	credentials     auth.Credentials
-	readBufferSize  int
-	writeBufferSize int
+	upstream struct {
+		conn     net.Conn
+		hostport string
+		// Whether the connection is at a message boundary and can be pooled
+		reusable bool
+		// Whether a PROXY protocol header tied it to the current client
+		private bool
+		// Whether it already carried requests, and may have been closed
+		// by the origin since
+		reused bool
+	}
 
-	peerBuf       []byte
-	tunnelBuf     []byte
-	authorization bool
+	// Peer connection being served
+	conn net.Conn
+
+	logger             *zap.Logger
+	dialer             upstream.Dialer
+	resolver           acl.Resolver
+	forwarder          upstream.Forwarder
+	upstreamAddr       string
+	connPool           *ConnPool
+	udpIdleTimeout     time.Duration
+	sniffTimeout       time.Duration
+	dialTimeout        time.Duration
+	headerTimeout      time.Duration
+	idleTimeout        time.Duration
+	maxLifetime        time.Duration
+	proxyProtocolRules []ProxyProtocolRule
+	acl                *acl.ACL
+	guard              *acl.Guard
+	hosts              *Hosts
+	ports              PortPolicy
+	userPorts          map[string]PortPolicy
+	throttle           *ratelimit.Throttle
+	userConns          *ratelimit.ConnLimit
+	userRequests       *ratelimit.RequestLimit
+	ipRequests         *ratelimit.RequestLimit
+	meter              *usage.Meter
+	quota              *usage.Quota
+	closeOverQuota     bool
+	metrics            *metrics.Proxy
+	accessLog          *accesslog.Logger
+	credentials        auth.Credentials
+	readBufferSize     int
+	writeBufferSize    int
+	// Guard checked before dialing through the upstream, if any
+	upstreamGuard *acl.Guard
+	// Whether destinations are dialed through the parent proxy
+	parent bool
+
+	peerBuf          []byte
+	tunnelBuf        []byte
+	bandwidth        bandwidth
+	heldUser         string
+	traffic          traffic
+	outcome          string
+	authorization    bool
+	socks4UserIDAuth bool
+
+	// Whether the connection waits for its next request, read without
+	// holding the lock
+	idle    utils.AtomicBool
+	streams int32
+	// Tunnels being relayed, more than one over HTTP/2
+	watches map[*tunnelWatch]struct{}
+	watchMu sync.Mutex
 
 	mu sync.Mutex
 }
@@ -58,8 +126,67 @@ type Config struct {
 	ReadBufferSize  int
 	WriteBufferSize int
 	Dialer          *net.Dialer
-	Logger          *zap.Logger
-	Credentials     auth.Credentials
+	// Resolver of the names dialed directly, the system one if nil
+	Resolver       *dns.Resolver
+	Upstream       upstream.Dialer
+	ConnPool       *ConnPool
+	Logger         *zap.Logger
+	Credentials    auth.Credentials
+	UDPIdleTimeout time.Duration
+	SniffTimeout   time.Duration
+	DialTimeout    time.Duration
+	// Time allowed for reading request headers, the SOCKS handshake included
+	HeaderTimeout time.Duration
+	// Time tunnels and keep-alive connections may stay idle
+	IdleTimeout time.Duration
+	// Time tunnels may stay open regardless of activity, unbounded if zero
+	MaxTunnelLifetime time.Duration
+	// Destinations sent a PROXY protocol header, first matching rule wins
+	ProxyProtocolRules []ProxyProtocolRule
+	// Destinations clients may reach, any if nil
+	ACL *acl.ACL
+	// Addresses blocked when dialing destinations, none if nil. Through an
+	// upstream the addresses names resolve to locally are checked instead of
+	// the ones connected to, leaving DNS rebinding possible.
+	Guard *acl.Guard
+	// Destination overrides applied before dialing, none if nil
+	Hosts *Hosts
+	// Destination ports of tunnels and forwarded requests
+	Ports PortPolicy
+	// Port sets overriding the default ones for the given users
+	UserPorts map[string]PortPolicy
+	// Bandwidth limits of each user, none if nil
+	Throttle *ratelimit.Throttle
+	// Concurrent connections of each authenticated user, unlimited if nil
+	UserConns *ratelimit.ConnLimit
+	// Request rates of each authenticated user and client address,
+	// unlimited if nil
+	UserRequests *ratelimit.RequestLimit
+	IPRequests   *ratelimit.RequestLimit
+	// Bytes relayed for each user and destination, not accounted if nil
+	Meter *usage.Meter
+	// Data quotas of each user, unlimited if nil
+	Quota *usage.Quota
+	// Close the live tunnels of users going over their quota
+	CloseOverQuota bool
+	// Accept SOCKS4 user IDs naming a configured user without a password
+	SOCKS4UserIDAuth bool
+	// Metrics recorded while serving clients, not exposed if nil
+	Metrics *metrics.Proxy
+	// Record of every request and tunnel served, not logged if nil
+	AccessLog *accesslog.Logger
+}
+
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
 }
 
 var (
@@ -84,20 +211,86 @@ func New(cfg Config) *Worker {
 	if cfg.Dialer == nil {
 		cfg.Dialer = new(net.Dialer)
 	}
+	if cfg.Guard != nil {
+		cfg.Dialer = cfg.Guard.Dialer(cfg.Dialer)
+	}
+	if cfg.UDPIdleTimeout <= 0 {
+		cfg.UDPIdleTimeout = DefaultUDPIdleTimeout
+	}
+	if cfg.SniffTimeout <= 0 {
+		cfg.SniffTimeout = DefaultSniffTimeout
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = DefaultTimeout
+	}
+	if cfg.HeaderTimeout <= 0 {
+		cfg.HeaderTimeout = DefaultTimeout
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = DefaultIdleTimeout
+	}
+	if cfg.Metrics == nil {
+		cfg.Metrics = metrics.NewProxy(nil)
+	}
+	var resolver acl.Resolver = net.DefaultResolver
+	var dialer upstream.Dialer = cfg.Dialer
+	if cfg.Resolver != nil {
+		resolver = cfg.Resolver
+		dialer = dns.NewDialer(cfg.Resolver, cfg.Dialer)
+	}
+	// Upstream dialer takes precedence over the direct one
+	var upstreamGuard *acl.Guard
+	if cfg.Upstream != nil {
+		dialer = cfg.Upstream
+		upstreamGuard = cfg.Guard
+	}
 	id := atomic.AddUint64(&nextID, 1)
 	w := &Worker{
 		id:     id,
 		b64enc: base64.URLEncoding,
 
-		logger:          cfg.Logger.With(zap.Uint64("worker_id", id)),
-		dialer:          cfg.Dialer,
-		credentials:     cfg.Credentials,
-		readBufferSize:  cfg.ReadBufferSize,
-		writeBufferSize: cfg.WriteBufferSize,
-
-		peerBuf:       make([]byte, cfg.ReadBufferSize),
-		tunnelBuf:     make([]byte, cfg.ReadBufferSize),
-		authorization: len(cfg.Credentials) > 0,
+		logger:             cfg.Logger.With(zap.Uint64("worker_id", id)),
+		dialer:             dialer,
+		resolver:           resolver,
+		connPool:           cfg.ConnPool,
+		udpIdleTimeout:     cfg.UDPIdleTimeout,
+		sniffTimeout:       cfg.SniffTimeout,
+		dialTimeout:        cfg.DialTimeout,
+		headerTimeout:      cfg.HeaderTimeout,
+		idleTimeout:        cfg.IdleTimeout,
+		maxLifetime:        cfg.MaxTunnelLifetime,
+		proxyProtocolRules: cfg.ProxyProtocolRules,
+		acl:                cfg.ACL,
+		guard:              cfg.Guard,
+		hosts:              cfg.Hosts,
+		ports:              cfg.Ports,
+		userPorts:          cfg.UserPorts,
+		throttle:           cfg.Throttle,
+		userConns:          cfg.UserConns,
+		userRequests:       cfg.UserRequests,
+		ipRequests:         cfg.IPRequests,
+		meter:              cfg.Meter,
+		quota:              cfg.Quota,
+		closeOverQuota:     cfg.CloseOverQuota,
+		metrics:            cfg.Metrics,
+		accessLog:          cfg.AccessLog,
+		credentials:        cfg.Credentials,
+		readBufferSize:     cfg.ReadBufferSize,
+		writeBufferSize:    cfg.WriteBufferSize,
+		upstreamGuard:      upstreamGuard,
+		parent:             cfg.Upstream != nil,
+
+		peerBuf:          make([]byte, cfg.ReadBufferSize),
+		tunnelBuf:        make([]byte, cfg.ReadBufferSize),
+		authorization:    len(cfg.Credentials) > 0,
+		socks4UserIDAuth: cfg.SOCKS4UserIDAuth,
+		watches:          make(map[*tunnelWatch]struct{}),
+	}
+	if f, ok := dialer.(upstream.Forwarder); ok {
+		w.forwarder = f
+	}
+	if s, ok := dialer.(fmt.Stringer); ok {
+		w.upstreamAddr = s.String()
 	}
 	w.reader = bufio.NewReaderSize(nil, cfg.ReadBufferSize)
 	w.writer = bufio.NewWriterSize(nil, cfg.WriteBufferSize)
@@ -117,72 +310,135 @@ func (w *Worker) ServeConn(c net.Conn) {
 		zap.String("listener", c.LocalAddr().String()),
 	)
 	log.Info("Serving new connection")
+	w.conn = c
 	defer func() {
+		w.idle.Set(false)
+		w.releaseUpstream()
+		w.releaseUser()
+		w.conn = nil
+		w.bandwidth = bandwidth{}
+		w.traffic = traffic{}
 		_ = c.Close()
 		log.Info("Closed connection")
 	}()
 
-	// Zero response code means close connection without returning response
-	responseCode := 0
-	req, err := readRequest(rb)
-	if err != nil {
-		log.Error("Malformed HTTP request")
-		writeResponse(log, respond(nil, responseCode), wb)
-		return
+	for served := 0; ; served++ {
+		// Keep-alive connections wait for the next request as long as idle
+		timeout, reason := w.headerTimeout, reasonHeaderTimeout
+		if served > 0 {
+			timeout, reason = w.idleTimeout, reasonIdleTimeout
+		}
+		if err := c.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			log.Error("Failed to set read deadline", zap.Error(err))
+			return
+		}
+		w.idle.Set(served > 0)
+		req, err := readRequest(rb)
+		w.idle.Set(false)
+		if isTimeout(err) {
+			log.Info("Connection timed out", zap.String("reason", reason))
+			return
+		}
+		if err != nil {
+			// Client closing an idle keep-alive connection is not an error
+			if served > 0 {
+				log.Debug("Keep-alive connection ended", zap.Error(err))
+				return
+			}
+			log.Error("Malformed HTTP request")
+			writeResponse(log, respond(nil, 0), wb)
+			return
+		}
+		if err := c.SetReadDeadline(time.Time{}); err != nil {
+			log.Error("Failed to clear read deadline", zap.Error(err))
+			return
+		}
+		if !w.serveRequest(log, req, rb, wb) {
+			return
+		}
 	}
+}
+
+// Idle reports whether the connection being served waits for its next
+// request with none in flight, so that closing it cuts nothing short.
+func (w *Worker) Idle() bool {
+	return w.idle.Get() && atomic.LoadInt32(&w.streams) <= 0
+}
+
+// EndTunnels ends the tunnels being relayed and the requests being forwarded
+// right away, so that closing the connection does not leave them waiting on
+// their destination.
+func (w *Worker) EndTunnels() {
+	w.watchMu.Lock()
+	defer w.watchMu.Unlock()
+	for tw := range w.watches {
+		tw.end(reasonShutdown)
+	}
+}
+
+// serveRequest handles a single request read from the peer and reports
+// whether the peer connection may be used for the next request.
+func (w *Worker) serveRequest(log *zap.Logger, req *http.Request, rb *bufio.Reader, wb *bufio.Writer) bool {
 	if req.URL.Scheme == "" {
 		req.URL.Scheme = "http"
 	}
 	if req.URL.Host == "" {
 		req.URL.Host = req.Host
 	}
+
+	// Zero response code means close connection without returning response
+	responseCode := 0
+	var responseHeader http.Header
+	keepAlive := false
+	access := newAccess(w.conn, req.Proto, req.Method, requestTarget(req))
 	defer func() {
 		if responseCode == http.StatusProxyAuthRequired {
-			hdr := make(http.Header)
-			hdr.Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=\"%s\"", authRealm))
-			writeResponse(log, respond(req, responseCode, hdr), wb)
-		} else if responseCode > 0 {
-			writeResponse(log, respond(req, responseCode), wb)
+			responseHeader = make(http.Header)
+			responseHeader.Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=\"%s\"", authRealm))
 		}
+		if responseCode > 0 {
+			writeResponse(log, respond(req, responseCode, responseHeader), wb)
+			w.outcome = strconv.Itoa(responseCode)
+		}
+		w.logAccess(log, access, w.outcome)
+		w.recordOutcome("http")
 		if req.Body != nil {
 			_ = req.Body.Close()
 		}
 	}()
 
-	if w.authorization {
-		responseCode = http.StatusProxyAuthRequired
-		auth := req.Header.Get(authHeaderName)
-		if !strings.HasPrefix(auth, authHeaderPrefix) {
-			return
-		}
-
-		responseCode = http.StatusBadRequest
-		dec, err := w.b64enc.DecodeString(auth[len(authHeaderPrefix):])
-		if err != nil {
-			log.Error("Malformed authorization header", zap.Error(err))
-			return
-		}
-
+	if d := w.checkIPRequestRate(log, w.conn); d > 0 {
+		responseCode = http.StatusTooManyRequests
+		responseHeader = http.Header{"Retry-After": {retryAfter(d)}}
+		return false
+	}
+	var user string
+	if log, user, responseCode = w.authorizeRequest(log, req); responseCode > 0 {
+		return false
+	}
+	access.User = user
+	if !w.holdUser(log, user) {
+		responseCode = http.StatusTooManyRequests
+		return false
+	}
+	if d := w.checkUserRequestRate(log, user); d > 0 {
+		responseCode = http.StatusTooManyRequests
+		responseHeader = http.Header{"Retry-After": {retryAfter(d)}}
+		return false
+	}
+	quota := w.quota.User(user)
+	if !checkQuota(log, quota) {
 		responseCode = http.StatusForbidden
-		parts := strings.Split(string(dec), ":")
-		username, password := parts[0], parts[1]
-		log = log.With(zap.String("user", username))
-		pw, ok := w.credentials[username]
-		if !ok {
-			log.Error("Username not found")
-			return
-		}
-		if pw.Compare([]byte(password)) != nil {
-			log.Error("Password mismatch")
-			return
-		}
+		responseHeader = http.Header{"Proxy-Status": {quotaProxyStatus}}
+		return false
 	}
+	w.bandwidth = w.bandwidthOf(user)
 
 	responseCode = http.StatusBadRequest
 	reqhost := req.Host
 	if reqhost == "" {
 		log.Error("Unknown request target host", zap.String("url", req.URL.String()))
-		return
+		return false
 	}
 	host, port, err := net.SplitHostPort(reqhost)
 	if err != nil {
@@ -191,52 +447,266 @@ func (w *Worker) ServeConn(c net.Conn) {
 	}
 	hostport := net.JoinHostPort(host, port)
 	log = log.With(zap.String("dst", hostport))
-	log.Info("Opening proxy connection")
+	w.traffic = traffic{user: user, dst: hostport, quota: quota, access: access}
 
-	responseCode = http.StatusBadGateway
-	t, err := w.establishTunnel(hostport)
-	if err != nil {
-		writeResponse(log, respond(req, http.StatusBadGateway), wb)
-		return
+	responseCode = http.StatusForbidden
+	if !w.checkAccess(log, w.conn, newACLRequest(user, req.Method, hostport)) {
+		return false
+	}
+	if responseCode = w.checkPort(log, user, req.Method, hostport); responseCode > 0 {
+		return false
 	}
-	defer t.Close()
-	tr := acquireReader(w.tunnel.reader, t)
-	tw := acquireWriter(w.tunnel.writer, t)
 
-	responseCode = 0
+	responseCode = http.StatusBadGateway
 	if req.Method == http.MethodConnect {
+		w.releaseUpstream()
+		t, err := w.openTunnel(log, hostport)
+		if err != nil {
+			responseCode = dialStatus(err)
+			return false
+		}
+		defer t.Close()
+
+		responseCode = 0
 		if !handleTunneling(log, req, wb) {
-			return
+			return false
 		}
-	} else {
-		for key := range req.Header {
-			if strings.HasPrefix(key, "Proxy") {
-				req.Header.Del(key)
+		w.outcome = strconv.Itoa(http.StatusOK)
+		w.relay(log, w.conn, t, rb, wb, w.tunnel.reader, w.tunnel.writer)
+		return false
+	}
+
+	if err := w.acquireUpstream(log, hostport, false); err != nil {
+		log.Error("Failed to establish tunnel", w.dialErrorFields(err)...)
+		responseCode = dialStatus(err)
+		return false
+	}
+	setUpstream(access, w.upstream.conn, w.parent)
+	retry := w.upstream.reused && isReplayable(req)
+	keepAlive, err = w.forwardRequest(log, req, rb, wb)
+	var fe *forwardEndedError
+	// Origins close idle connections as they see fit, which only shows once
+	// a request is sent over a reused one
+	if err != nil && retry && w.outcome == "" && !errors.As(err, &fe) {
+		log.Info("Retrying request over a fresh connection", zap.Error(err))
+		if err := w.acquireUpstream(log, hostport, true); err != nil {
+			log.Error("Failed to establish tunnel", w.dialErrorFields(err)...)
+			responseCode = dialStatus(err)
+			return false
+		}
+		setUpstream(access, w.upstream.conn, w.parent)
+		keepAlive, err = w.forwardRequest(log, req, rb, wb)
+	}
+	responseCode = 0
+	if err != nil {
+		w.closeUpstream()
+		if !errors.As(err, &fe) {
+			log.Error("Failed to forward request", zap.Error(err))
+			// Unless the response is already on its way
+			if w.outcome == "" {
+				responseCode = http.StatusBadGateway
 			}
+			return false
+		}
+		log.Info("Forward timed out", zap.String("reason", fe.reason))
+		// Unless the response is already on its way, the client deadlines
+		// having expired as well
+		if w.outcome == "" {
+			_ = w.conn.SetWriteDeadline(time.Now().Add(w.idleTimeout))
+			responseCode = http.StatusGatewayTimeout
+		}
+		return false
+	}
+	return keepAlive
+}
+
+// authorizeRequest checks the proxy credentials sent with the request. It
+// returns the authenticated user and the status code to respond with on
+// failure, zero otherwise.
+func (w *Worker) authorizeRequest(log *zap.Logger, req *http.Request) (*zap.Logger, string, int) {
+	if !w.authorization {
+		return log, "", 0
+	}
+	auth := req.Header.Get(authHeaderName)
+	if !strings.HasPrefix(auth, authHeaderPrefix) {
+		return log, "", http.StatusProxyAuthRequired
+	}
+
+	dec, err := w.b64enc.DecodeString(auth[len(authHeaderPrefix):])
+	if err != nil {
+		log.Error("Malformed authorization header", zap.Error(err))
+		w.authFailed(authMalformed)
+		return log, "", http.StatusBadRequest
+	}
+
+	parts := strings.SplitN(string(dec), ":", 2)
+	if len(parts) < 2 {
+		log.Error("Malformed authorization header")
+		w.authFailed(authMalformed)
+		return log, "", http.StatusBadRequest
+	}
+
+	username, password := parts[0], parts[1]
+	log = log.With(zap.String("user", username))
+	if !w.authenticate(log, username, password) {
+		return log, username, http.StatusForbidden
+	}
+	return log, username, 0
+}
+
+// authenticate checks the credentials given by the peer, logging the reason
+// of any failure.
+func (w *Worker) authenticate(log *zap.Logger, username, password string) bool {
+	pw, ok := w.credentials[username]
+	if !ok {
+		log.Error("Username not found")
+		w.authFailed(authUnknownUser)
+		return false
+	}
+	if pw.Compare([]byte(password)) != nil {
+		log.Error("Password mismatch")
+		w.authFailed(authPasswordMismatch)
+		return false
+	}
+	return true
+}
+
+// forwardRequest relays a plain HTTP request to the current upstream and
+// writes back its response, leaving both connections at a message boundary.
+func (w *Worker) forwardRequest(log *zap.Logger, req *http.Request, rb *bufio.Reader, wb *bufio.Writer) (keepAlive bool, err error) {
+	tr, tw := w.tunnel.reader, w.tunnel.writer
+	w.upstream.reusable = false
+	upgrade := upgradeType(req.Header)
+	removeHopHeaders(req.Header)
+	if upgrade != "" {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", upgrade)
+	}
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// Prevent the default Go user agent from being sent upstream
+		req.Header.Set("User-Agent", "")
+	}
+
+	log.Debug("Forwarding request",
+		zap.String("method", req.Method),
+		zap.String("url", req.URL.String()),
+	)
+	// Message bodies are accounted, upgraded connections being accounted
+	// by the relay
+	var upload, download int64
+	defer func() {
+		w.account(w.traffic, upload, download)
+		w.traffic.quota.Add(upload + download)
+	}()
+	// Either side stalling ends the request like an idle tunnel
+	watch := w.watchForward(w.conn, w.upstream.conn)
+	defer func() {
+		// Deadlines expiring even once done leave the connections unusable
+		if reason := watch.stop(); reason != "" {
+			keepAlive, err = false, &forwardEndedError{reason: reason}
 		}
-		b, err := httputil.DumpRequestOut(req, true)
+	}()
+	req.Body = countBody(limitBody(watch.body(req.Body), w.bandwidth.upload), &upload)
+	if w.forwarder != nil {
+		w.forwarder.PrepareForward(req)
+		err := req.WriteProxy(tw)
 		if err != nil {
-			log.Error("Failed to dump request", zap.Error(err))
-			return
+			return false, err
 		}
-		if _, err := tw.Write(b); err != nil {
-			log.Error("Failed to write request to buffer", zap.Error(err))
-			return
+	} else if err := req.Write(tw); err != nil {
+		return false, err
+	}
+	if err := tw.Flush(); err != nil {
+		return false, err
+	}
+	watch.touch()
+
+	res, err := http.ReadResponse(tr, req)
+	// Relay interim responses as they come, except for protocol switching
+	for err == nil && res.StatusCode >= 100 && res.StatusCode < 200 && res.StatusCode != http.StatusSwitchingProtocols {
+		if err = res.Write(wb); err != nil {
+			return false, err
 		}
-		if err := tw.Flush(); err != nil {
-			log.Error("Failed to write request to tunnel", zap.Error(err))
-			return
+		if err = wb.Flush(); err != nil {
+			return false, err
 		}
+		watch.touch()
+		res, err = http.ReadResponse(tr, req)
 	}
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	res.Body = countBody(limitBody(watch.body(res.Body), w.bandwidth.download), &download)
+	w.outcome = strconv.Itoa(res.StatusCode)
 
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		if upgrade == "" || !strings.EqualFold(upgrade, upgradeType(res.Header)) {
+			return false, fmt.Errorf("unexpected protocol switch: %q", upgradeType(res.Header))
+		}
+		if err := res.Write(wb); err != nil {
+			return false, err
+		}
+		if err := wb.Flush(); err != nil {
+			return false, err
+		}
+		if watch.stop() != "" {
+			return false, nil
+		}
+		w.relay(log, w.conn, w.upstream.conn, rb, wb, tr, tw)
+		w.closeUpstream()
+		return false, nil
+	}
+
+	upstreamReusable := !res.Close
+	removeHopHeaders(res.Header)
+	res.Close = req.Close
+	if err := res.Write(wb); err != nil {
+		return false, err
+	}
+	if err := wb.Flush(); err != nil {
+		return false, err
+	}
+	if !upstreamReusable {
+		w.closeUpstream()
+	} else {
+		w.upstream.reusable = true
+	}
+	return !req.Close, nil
+}
+
+// openTunnel connects to the destination of a tunnel and prepares the
+// tunnel buffers for relaying.
+func (w *Worker) openTunnel(log *zap.Logger, hostport string) (net.Conn, error) {
+	log.Info("Opening proxy connection")
+	t, err := w.dialTunnel(log, w.conn, hostport)
+	if err != nil {
+		log.Error("Failed to establish tunnel", w.dialErrorFields(err)...)
+		return nil, err
+	}
+	setUpstream(w.traffic.access, t, w.parent)
+	acquireReader(w.tunnel.reader, t)
+	acquireWriter(w.tunnel.writer, t)
+	return t, nil
+}
+
+// relay copies bytes in both directions between the peer connection c and
+// the tunnel t until either side is closed or the tunnel times out.
+func (w *Worker) relay(log *zap.Logger, c, t net.Conn, rb *bufio.Reader, wb *bufio.Writer, tr *bufio.Reader, tw *bufio.Writer) {
+	watch := w.watchTunnel(c, t)
+	var upload, download int64
 	g := &errgroup.Group{}
 	// Peer -> Proxy -> Tunnel
 	g.Go(func() error {
 		for {
-			n, err := rb.Read(w.peerBuf)
+			n, err := rb.Read(w.bandwidth.upload.Limit(w.peerBuf))
 			if err != nil {
 				return err
 			}
+			watch.touch()
+			upload += int64(n)
+			w.countQuota(w.traffic.quota, watch, n)
+			w.bandwidth.upload.Wait(n)
 			if _, err := tw.Write(w.peerBuf[:n]); err != nil {
 				return err
 			}
@@ -248,10 +718,14 @@ func (w *Worker) ServeConn(c net.Conn) {
 	// Tunnel -> Proxy -> Peer
 	g.Go(func() error {
 		for {
-			n, err := tr.Read(w.tunnelBuf)
+			n, err := tr.Read(w.bandwidth.download.Limit(w.tunnelBuf))
 			if err != nil {
 				return err
 			}
+			watch.touch()
+			download += int64(n)
+			w.countQuota(w.traffic.quota, watch, n)
+			w.bandwidth.download.Wait(n)
 			if _, err := wb.Write(w.tunnelBuf[:n]); err != nil {
 				return err
 			}
@@ -260,13 +734,178 @@ func (w *Worker) ServeConn(c net.Conn) {
 			}
 		}
 	})
-	if err := g.Wait(); err != nil && err != io.EOF {
+	err := g.Wait()
+	w.account(w.traffic, upload, download)
+	if reason := watch.stop(); reason == reasonQuotaExceeded {
+		log.Warn("Tunnel closed", zap.String("reason", reason))
+	} else if reason == reasonShutdown {
+		log.Info("Tunnel closed", zap.String("reason", reason))
+	} else if reason != "" {
+		log.Info("Tunnel timed out", zap.String("reason", reason))
+	} else if err != nil && err != io.EOF {
 		log.Error("Tunnel error", zap.Error(err))
 	}
 }
 
+// acquireUpstream makes sure the current upstream connection points to the
+// given host, replacing it with a pooled or fresh connection when it does not,
+// only ever a fresh one if asked to. Requests for any host share the parent
+// proxy connection when forwarding.
+func (w *Worker) acquireUpstream(log *zap.Logger, hostport string, fresh bool) error {
+	hostport = w.rewriteDestination(log, hostport)
+	if err := w.checkUpstreamGuard(hostport); err != nil {
+		return err
+	}
+	key := w.upstreamKey(hostport)
+	if fresh {
+		w.closeUpstream()
+	}
+	if w.upstream.conn != nil && w.upstream.hostport == key {
+		log.Debug("Reusing proxy connection")
+		w.upstream.reused = true
+		return nil
+	}
+	w.releaseUpstream()
+	t, private, pooled, err := w.dialUpstream(log, w.conn, hostport, !fresh)
+	if err != nil {
+		return err
+	}
+	w.upstream.conn = t
+	w.upstream.hostport = key
+	w.upstream.private = private
+	w.upstream.reused = pooled
+	acquireReader(w.tunnel.reader, t)
+	acquireWriter(w.tunnel.writer, t)
+	return nil
+}
+
+// upstreamKey returns the address plain requests to the host are sent to.
+func (w *Worker) upstreamKey(hostport string) string {
+	if w.forwarder != nil {
+		return w.forwarder.Address()
+	}
+	return hostport
+}
+
+// dialUpstream returns a fresh connection for plain requests to the already
+// rewritten host, or a pooled one if allowed. It also reports whether a PROXY
+// protocol header ties it to the client and whether it was pooled.
+func (w *Worker) dialUpstream(log *zap.Logger, c net.Conn, hostport string, pool bool) (t net.Conn, private, pooled bool, err error) {
+	dial := w.establishTunnel
+	// Pooled connections may have been opened on behalf of other clients
+	version := w.proxyProtocolVersion(hostport)
+	if w.forwarder != nil {
+		dial = w.establishForward
+	}
+	if w.forwarder != nil || c == nil {
+		version = 0
+	}
+	key := w.upstreamKey(hostport)
+	if pool && w.connPool != nil && version == 0 {
+		if t := w.connPool.Get(key); t != nil {
+			log.Debug("Reusing pooled proxy connection")
+			return t, false, true, nil
+		}
+	}
+	log.Info("Opening proxy connection")
+	if t, err = dial(key); err != nil {
+		return nil, false, false, err
+	}
+	if version != 0 {
+		if err := sendProxyHeader(t, c, version); err != nil {
+			_ = t.Close()
+			return nil, false, false, err
+		}
+	}
+	return t, version != 0, false, nil
+}
+
+// releaseUpstream hands the current upstream connection over to the pool if
+// it can be reused, closing it otherwise.
+func (w *Worker) releaseUpstream() {
+	if w.upstream.conn == nil {
+		return
+	}
+	if w.connPool == nil || !w.upstream.reusable || w.upstream.private || w.tunnel.reader.Buffered() > 0 {
+		w.closeUpstream()
+		return
+	}
+	w.connPool.Put(w.upstream.hostport, w.upstream.conn)
+	w.resetUpstream()
+}
+
+func (w *Worker) closeUpstream() {
+	if w.upstream.conn == nil {
+		return
+	}
+	_ = w.upstream.conn.Close()
+	w.resetUpstream()
+}
+
+func (w *Worker) resetUpstream() {
+	w.upstream.conn = nil
+	w.upstream.hostport = ""
+	w.upstream.reusable = false
+	w.upstream.private = false
+	w.upstream.reused = false
+	w.tunnel.reader.Reset(nil)
+	w.tunnel.writer.Reset(nil)
+}
+
 func (w *Worker) establishTunnel(hostport string) (net.Conn, error) {
-	return w.dialer.Dial("tcp", hostport)
+	ctx, cancel := context.WithTimeout(context.Background(), w.dialTimeout)
+	defer cancel()
+	start := time.Now()
+	t, err := w.dialer.DialContext(ctx, "tcp", hostport)
+	w.observeDial(start, err)
+	return t, err
+}
+
+// dialTunnel connects to the destination of a tunnel opened by the client,
+// sending it a PROXY protocol header if configured to.
+func (w *Worker) dialTunnel(log *zap.Logger, c net.Conn, hostport string) (net.Conn, error) {
+	hostport = w.rewriteDestination(log, hostport)
+	if err := w.checkUpstreamGuard(hostport); err != nil {
+		return nil, err
+	}
+	t, err := w.establishTunnel(hostport)
+	if err != nil {
+		return nil, err
+	}
+	if v := w.proxyProtocolVersion(hostport); v != 0 && c != nil {
+		if err := sendProxyHeader(t, c, v); err != nil {
+			_ = t.Close()
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (w *Worker) establishForward(_ string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), w.dialTimeout)
+	defer cancel()
+	start := time.Now()
+	t, err := w.forwarder.DialForward(ctx)
+	w.observeDial(start, err)
+	return t, err
+}
+
+func (w *Worker) dialErrorFields(err error) []zap.Field {
+	fields := []zap.Field{zap.Error(err)}
+	if w.upstreamAddr != "" {
+		fields = append(fields, zap.String("upstream", w.upstreamAddr))
+	}
+	var ue *upstream.Error
+	if errors.As(err, &ue) {
+		fields = append(fields, zap.Int("upstream_status", ue.StatusCode))
+	}
+	var be *acl.BlockedError
+	if errors.As(err, &be) {
+		fields = append(fields, zap.String("reason", "blocked address"))
+	} else if isDialTimeout(err) {
+		fields = append(fields, zap.String("reason", "dial timeout"))
+	}
+	return fields
 }
 
 func readRequest(rb *bufio.Reader) (*http.Request, error) {
@@ -286,6 +925,49 @@ func handleTunneling(log *zap.Logger, req *http.Request, wb *bufio.Writer) bool
 	return true
 }
 
+// isReplayable reports whether the request may safely be sent again, being
+// idempotent and without a body.
+func isReplayable(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+func upgradeType(h http.Header) string {
+	for _, v := range h["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "Upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+func removeHopHeaders(h http.Header) {
+	// Headers listed in Connection are hop-by-hop as well
+	for _, v := range h["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				h.Del(token)
+			}
+		}
+	}
+	for _, key := range hopHeaders {
+		h.Del(key)
+	}
+	for key := range h {
+		if strings.HasPrefix(key, "Proxy") {
+			h.Del(key)
+		}
+	}
+}
+
 func respond(req *http.Request, code int, header ...http.Header) *http.Response {
 	if req == nil {
 		req = defaultRequest
@@ -302,6 +984,8 @@ func respond(req *http.Request, code int, header ...http.Header) *http.Response
 		ProtoMajor: req.ProtoMajor,
 		ProtoMinor: req.ProtoMinor,
 		Header:     hdr,
+		// Responses generated by the proxy always end the connection
+		Close: true,
 	}
 }
 
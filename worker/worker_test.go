@@ -5,12 +5,19 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync/atomic"
 	"testing"
 
+	"github.com/Frizz925/gilgamesh/acl"
 	"github.com/Frizz925/gilgamesh/auth"
+	"github.com/Frizz925/gilgamesh/upstream"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 	"go.uber.org/zap"
@@ -141,6 +148,266 @@ func (suite *WorkerTestSuite) TestTunneling() {
 	}
 }
 
+func (suite *WorkerTestSuite) TestKeepAlive() {
+	suite.setupWorker(false)
+	require := suite.Require()
+	for i := 0; i < 3; i++ {
+		res, err := suite.client.Get(suite.url.String())
+		require.NoError(err)
+		require.Equal(http.StatusOK, res.StatusCode)
+		require.NoError(res.Body.Close())
+	}
+}
+
+func (suite *WorkerTestSuite) TestKeepAliveRouting() {
+	suite.setupWorker(false)
+	require := suite.Require()
+	origins := []*httptest.Server{
+		httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_, _ = w.Write([]byte("first"))
+		})),
+		httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_, _ = w.Write([]byte("second"))
+		})),
+	}
+	defer origins[0].Close()
+	defer origins[1].Close()
+
+	c := suite.pipe.client
+	br, bw := bufio.NewReader(c), bufio.NewWriter(c)
+	for _, expected := range []struct {
+		origin *httptest.Server
+		body   string
+	}{
+		{origins[0], "first"},
+		{origins[1], "second"},
+		{origins[0], "first"},
+	} {
+		req, err := http.NewRequest(http.MethodGet, expected.origin.URL, nil)
+		require.NoError(err)
+		require.NoError(req.WriteProxy(bw))
+		require.NoError(bw.Flush())
+
+		res, err := http.ReadResponse(br, req)
+		require.NoError(err)
+		require.Equal(http.StatusOK, res.StatusCode)
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(err)
+		require.Equal(expected.body, string(body))
+		require.NoError(res.Body.Close())
+	}
+}
+
+func (suite *WorkerTestSuite) TestConnPool() {
+	require := suite.Require()
+	pool := NewConnPool(ConnPoolConfig{HealthCheck: true})
+	defer pool.Close()
+	w := New(Config{
+		Logger:   suite.logger,
+		ConnPool: pool,
+	})
+	done := make(chan struct{})
+	go func() {
+		w.ServeConn(suite.pipe.server)
+		close(done)
+	}()
+
+	res, err := suite.client.Get(suite.url.String())
+	require.NoError(err)
+	require.Equal(http.StatusOK, res.StatusCode)
+	require.NoError(res.Body.Close())
+	require.NoError(suite.pipe.client.Close())
+	<-done
+	require.Equal(1, pool.Len())
+}
+
+func (suite *WorkerTestSuite) TestStaleUpstreamRetry() {
+	require := suite.Require()
+	l, accepted := startClosingOrigin(suite.T())
+	defer l.Close()
+	suite.setupWorker(false)
+
+	// The second request goes over the connection the origin closed
+	for i := 0; i < 2; i++ {
+		res, err := suite.client.Get("http://" + l.Addr().String())
+		require.NoError(err)
+		require.Equal(http.StatusOK, res.StatusCode)
+		require.NoError(res.Body.Close())
+	}
+	require.Equal(int32(2), atomic.LoadInt32(accepted))
+}
+
+func (suite *WorkerTestSuite) TestStaleUpstreamBadGateway() {
+	require := suite.Require()
+	l, _ := startClosingOrigin(suite.T())
+	defer l.Close()
+	suite.setupWorker(false)
+
+	res, err := suite.client.Get("http://" + l.Addr().String())
+	require.NoError(err)
+	require.Equal(http.StatusOK, res.StatusCode)
+	require.NoError(res.Body.Close())
+
+	// Requests with a body are never sent twice
+	res, err = suite.client.Post("http://"+l.Addr().String(), "text/plain", strings.NewReader("body"))
+	require.NoError(err)
+	require.Equal(http.StatusBadGateway, res.StatusCode)
+	require.NoError(res.Body.Close())
+}
+
+func (suite *WorkerTestSuite) TestParentProxy() {
+	require := suite.Require()
+	l := suite.startParentProxy()
+	defer l.Close()
+	suite.setupUpstreamWorker(fmt.Sprintf("http://%s:%s@%s", suite.username, suite.password, l.Addr()))
+
+	res, err := suite.client.Get(suite.url.String())
+	require.NoError(err)
+	require.Equal(http.StatusOK, res.StatusCode)
+	require.NoError(res.Body.Close())
+
+	res, err = suite.client.Do(&http.Request{
+		Method: http.MethodConnect,
+		URL:    suite.url,
+	})
+	require.NoError(err)
+	require.Equal(http.StatusOK, res.StatusCode)
+}
+
+func (suite *WorkerTestSuite) TestParentProxyFailure() {
+	require := suite.Require()
+	l := suite.startParentProxy()
+	defer l.Close()
+	suite.setupUpstreamWorker("http://" + l.Addr().String())
+
+	res, err := suite.client.Do(&http.Request{
+		Method: http.MethodConnect,
+		URL:    suite.url,
+	})
+	require.NoError(err)
+	require.Equal(http.StatusBadGateway, res.StatusCode)
+}
+
+func (suite *WorkerTestSuite) TestACLDenied() {
+	require := suite.Require()
+	port := suite.listener.Addr().(*net.TCPAddr).Port
+	w := New(Config{
+		Logger: suite.logger,
+		ACL: acl.New(acl.Config{
+			Rules: []acl.Rule{{
+				Action: acl.Deny,
+				Ports:  []acl.PortRange{{From: port, To: port}},
+			}},
+		}),
+	})
+	go w.ServeConn(suite.pipe.server)
+
+	res, err := suite.client.Get(suite.url.String())
+	require.NoError(err)
+	require.Equal(http.StatusForbidden, res.StatusCode)
+	require.NoError(res.Body.Close())
+}
+
+func (suite *WorkerTestSuite) TestGuardBlocked() {
+	require := suite.Require()
+	w := New(Config{
+		Logger: suite.logger,
+		Guard:  acl.NewGuard(acl.GuardConfig{}),
+	})
+	go w.ServeConn(suite.pipe.server)
+
+	res, err := suite.client.Get(suite.url.String())
+	require.NoError(err)
+	require.Equal(http.StatusForbidden, res.StatusCode)
+	require.NoError(res.Body.Close())
+}
+
+func (suite *WorkerTestSuite) TestGuardBlockedUpstream() {
+	require := suite.Require()
+	l := suite.startParentProxy()
+	defer l.Close()
+	d, err := upstream.Parse(fmt.Sprintf("http://%s:%s@%s", suite.username, suite.password, l.Addr()), upstream.Config{})
+	require.NoError(err)
+	w := New(Config{
+		Logger:   suite.logger,
+		Upstream: d,
+		Guard:    acl.NewGuard(acl.GuardConfig{}),
+	})
+	go w.ServeConn(suite.pipe.server)
+
+	// Destinations are checked before being handed to the parent proxy
+	res, err := suite.client.Get(suite.url.String())
+	require.NoError(err)
+	require.Equal(http.StatusForbidden, res.StatusCode)
+	require.NoError(res.Body.Close())
+
+	// Tunnels alike, over a connection of their own as denials close it
+	client, server := net.Pipe()
+	defer client.Close()
+	go New(Config{
+		Logger:   suite.logger,
+		Upstream: d,
+		Guard:    acl.NewGuard(acl.GuardConfig{}),
+	}).ServeConn(server)
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    suite.url,
+		Host:   suite.url.Host,
+	}
+	require.NoError(req.Write(client))
+	res, err = http.ReadResponse(bufio.NewReader(client), req)
+	require.NoError(err)
+	require.Equal(http.StatusForbidden, res.StatusCode)
+}
+
+func (suite *WorkerTestSuite) TestConnectPortNotAllowed() {
+	require := suite.Require()
+	w := New(Config{
+		Logger: suite.logger,
+		Ports:  PortPolicy{ConnectPorts: []acl.PortRange{{From: 443, To: 443}}},
+	})
+	go w.ServeConn(suite.pipe.server)
+
+	res, err := suite.client.Do(&http.Request{
+		Method: http.MethodConnect,
+		URL:    suite.url,
+	})
+	require.NoError(err)
+	require.Equal(http.StatusMethodNotAllowed, res.StatusCode)
+}
+
+func (suite *WorkerTestSuite) TestHTTPPortNotAllowed() {
+	require := suite.Require()
+	w := New(Config{
+		Logger: suite.logger,
+		Ports:  PortPolicy{HTTPPorts: []acl.PortRange{{From: 80, To: 80}}},
+	})
+	go w.ServeConn(suite.pipe.server)
+
+	res, err := suite.client.Get(suite.url.String())
+	require.NoError(err)
+	require.Equal(http.StatusForbidden, res.StatusCode)
+	require.NoError(res.Body.Close())
+}
+
+func (suite *WorkerTestSuite) TestHostsRewrite() {
+	require := suite.Require()
+	hosts, err := NewHosts([]HostRule{
+		{From: "staging.invalid", To: suite.listener.Addr().String()},
+	})
+	require.NoError(err)
+	w := New(Config{
+		Logger: suite.logger,
+		Hosts:  hosts,
+	})
+	go w.ServeConn(suite.pipe.server)
+
+	res, err := suite.client.Get("http://staging.invalid/")
+	require.NoError(err)
+	require.Equal(http.StatusOK, res.StatusCode)
+	require.NoError(res.Body.Close())
+}
+
 func (suite *WorkerTestSuite) TestMalformedRequest() {
 	suite.setupWorker(false)
 	require := suite.Require()
@@ -253,6 +520,69 @@ func (suite *WorkerTestSuite) setupWorker(withAuth bool) {
 	go w.ServeConn(suite.pipe.server)
 }
 
+func (suite *WorkerTestSuite) setupUpstreamWorker(rawurl string) {
+	d, err := upstream.Parse(rawurl, upstream.Config{})
+	suite.Require().NoError(err)
+	w := New(Config{
+		Logger:   suite.logger,
+		Upstream: d,
+	})
+	go w.ServeConn(suite.pipe.server)
+}
+
+// startParentProxy runs an authenticated proxy for workers to chain through.
+func (suite *WorkerTestSuite) startParentProxy() net.Listener {
+	require := suite.Require()
+	pw, err := auth.CreatePassword([]byte(suite.password))
+	require.NoError(err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	p := NewPool(0, Config{
+		Logger:      suite.logger,
+		Credentials: auth.Credentials{suite.username: pw},
+	})
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				w := p.Get()
+				w.ServeConn(c)
+				p.Put(w)
+			}()
+		}
+	}()
+	return l
+}
+
+// startClosingOrigin starts an origin answering a single request per
+// connection before closing it without telling, counting the connections.
+func startClosingOrigin(t *testing.T) (net.Listener, *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var accepted int32
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				defer c.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(c)); err == nil {
+					_, _ = io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+				}
+			}()
+		}
+	}()
+	return l, &accepted
+}
+
 func createAuthHeader(username, password string) http.Header {
 	auth := fmt.Sprintf("%s:%s", username, password)
 	authEnc := base64.URLEncoding.EncodeToString([]byte(auth))
@@ -260,3 +590,32 @@ func createAuthHeader(username, password string) http.Header {
 	header.Set("Proxy-Authorization", fmt.Sprintf("Basic %s", authEnc))
 	return header
 }
+
+func TestCheckPort(t *testing.T) {
+	require := require.New(t)
+	w := New(Config{
+		Logger: zap.NewNop(),
+		Ports:  PortPolicy{ConnectPorts: []acl.PortRange{{From: 443, To: 443}}},
+		UserPorts: map[string]PortPolicy{
+			"admin": {ConnectPorts: []acl.PortRange{{From: 1, To: 65535}}},
+			"guest": {HTTPPorts: []acl.PortRange{{From: 80, To: 80}}},
+		},
+	})
+	log := zap.NewNop()
+	for _, tc := range []struct {
+		user     string
+		method   string
+		hostport string
+		code     int
+	}{
+		{"", http.MethodConnect, "example.com:443", 0},
+		{"", http.MethodConnect, "example.com:22", http.StatusMethodNotAllowed},
+		{"", http.MethodGet, "example.com:8080", 0},
+		{"admin", http.MethodConnect, "example.com:22", 0},
+		{"guest", http.MethodConnect, "example.com:22", http.StatusMethodNotAllowed},
+		{"guest", http.MethodGet, "example.com:8080", http.StatusForbidden},
+		{"guest", http.MethodGet, "example.com:80", 0},
+	} {
+		require.Equal(tc.code, w.checkPort(log, tc.user, tc.method, tc.hostport), tc)
+	}
+}